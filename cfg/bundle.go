@@ -0,0 +1,153 @@
+package cfg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/revlist"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// bundleSignature is the first line of a v2 git bundle
+const bundleSignature = "# v2 git bundle\n"
+
+// WriteBundle writes the refs of the repository, and all of the objects they reach, to w
+// as a git bundle. It can be cloned and fetched from with git, or read back with ReadBundle.
+func WriteBundle(w io.Writer, sto storer.Storer) error {
+	iter, err := sto.IterReferences()
+	if err != nil {
+		return ErrBundle.F(err)
+	}
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), "refs/") {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return ErrBundle.F(err)
+	}
+	if len(refs) == 0 {
+		return ErrBundleEmpty
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+
+	// HEAD is listed so that a clone of the bundle checks out the default branch
+	bw := bufio.NewWriter(w)
+	bw.WriteString(bundleSignature)
+	if head, err := storer.ResolveReference(sto, plumbing.HEAD); err == nil {
+		fmt.Fprintf(bw, "%s %s\n", head.Hash(), plumbing.HEAD)
+	}
+	hashes := make([]plumbing.Hash, 0, len(refs))
+	for _, ref := range refs {
+		fmt.Fprintf(bw, "%s %s\n", ref.Hash(), ref.Name())
+		hashes = append(hashes, ref.Hash())
+	}
+	bw.WriteString("\n")
+
+	objs, err := revlist.Objects(sto, hashes, nil)
+	if err != nil {
+		return ErrBundle.F(err)
+	}
+	if _, err := packfile.NewEncoder(bw, sto, false).Encode(objs, 10); err != nil {
+		return ErrBundle.F(err)
+	}
+	if err := bw.Flush(); err != nil {
+		return ErrBundle.F(err)
+	}
+	return nil
+}
+
+// ReadBundle reads the git bundle r into the repository and returns the refs that moved.
+// The refs of the bundle are set over the ones of the repository, the refs that aren't in
+// the bundle are left as they are. The repository must have the commits that the bundle
+// was made on top of, if it was made with any.
+func ReadBundle(r io.Reader, sto storer.Storer) ([]ReceivePackData, error) {
+	br := bufio.NewReader(r)
+	if line, err := br.ReadString('\n'); err != nil || line != bundleSignature {
+		return nil, ErrBundleVersion
+	}
+
+	var head plumbing.Hash
+	var refs []*plumbing.Reference
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, ErrBundle.F(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break // the pack is next
+		}
+
+		if strings.HasPrefix(line, "-") {
+			fields := strings.Fields(line[1:])
+			if len(fields) == 0 || len(fields[0]) != 40 {
+				return nil, ErrBundleHeader.F(line)
+			}
+			h := plumbing.NewHash(fields[0])
+			if err := sto.HasEncodedObject(h); err != nil {
+				return nil, ErrBundlePrereq.F(h)
+			}
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != 40 {
+			return nil, ErrBundleHeader.F(line)
+		}
+		h := plumbing.NewHash(fields[0])
+		switch name := plumbing.ReferenceName(fields[1]); {
+		case name == plumbing.HEAD:
+			head = h
+		case strings.HasPrefix(name.String(), "refs/"):
+			refs = append(refs, plumbing.NewHashReference(name, h))
+		default:
+			return nil, ErrBundleHeader.F(line)
+		}
+	}
+	if len(refs) == 0 {
+		return nil, ErrBundleEmpty
+	}
+
+	if err := packfile.UpdateObjectStorage(sto, br); err != nil && err != packfile.ErrEmptyPackfile {
+		return nil, ErrBundle.F(err)
+	}
+
+	var moved []ReceivePackData
+	for _, ref := range refs {
+		if err := sto.HasEncodedObject(ref.Hash()); err != nil {
+			return nil, ErrBundle.F(fmt.Errorf("%s: %v", ref.Name(), err))
+		}
+		old := plumbing.ZeroHash
+		if cur, err := sto.Reference(ref.Name()); err == nil {
+			old = cur.Hash()
+		}
+		if old == ref.Hash() {
+			continue
+		}
+		if err := sto.SetReference(ref); err != nil {
+			return nil, ErrBundle.F(err)
+		}
+		moved = append(moved, ReceivePackData{OldHash: old.String(), NewHash: ref.Hash().String(), RefName: ref.Name().String()})
+	}
+
+	// HEAD is kept on its branch when the bundle agrees with it, otherwise it is moved to a
+	// branch of the bundle that is where the HEAD of the bundle is
+	if !head.IsZero() {
+		if cur, err := storer.ResolveReference(sto, plumbing.HEAD); err != nil || cur.Hash() != head {
+			for _, ref := range refs {
+				if ref.Name().IsBranch() && ref.Hash() == head {
+					sto.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, ref.Name()))
+					break
+				}
+			}
+		}
+	}
+	return moved, nil
+}
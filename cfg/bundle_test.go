@@ -0,0 +1,217 @@
+package cfg
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestBundle(t *testing.T) {
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, _ := repo.Worktree()
+	commit := func(name, contents string) plumbing.Hash {
+		if err := util.WriteFile(fs, name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wt.Add(name)
+		sig := &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+		h, err := wt.Commit("commit "+name, &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	empty := new(bytes.Buffer)
+	if err := WriteBundle(empty, repo.Storer); err != ErrBundleEmpty {
+		t.Fatalf("have: %v want: %v", err, ErrBundleEmpty)
+	}
+
+	h1 := commit("a.toml", "a = 1\n")
+	repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/dev", h1))
+	h2 := commit("b.toml", "b = 1\n")
+	tag, err := repo.CreateTag("v1", h2, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)},
+		Message: "v1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := new(bytes.Buffer)
+	if err := WriteBundle(bundle, repo.Storer); err != nil {
+		t.Fatal(err)
+	}
+	want := "# v2 git bundle\n" +
+		h2.String() + " HEAD\n" +
+		h1.String() + " refs/heads/dev\n" +
+		h2.String() + " refs/heads/master\n" +
+		tag.Hash().String() + " refs/tags/v1\n\n"
+	if !strings.HasPrefix(bundle.String(), want) {
+		t.Fatalf("have: %q want: %q", bundle.String()[:len(want)], want)
+	}
+
+	// into a new repository
+	restored, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := ReadBundle(bytes.NewReader(bundle.Bytes()), restored.Storer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 3 || moved[1].RefName != "refs/heads/master" || moved[1].OldHash != plumbing.ZeroHash.String() || moved[1].NewHash != h2.String() {
+		t.Fatalf("have: %+v want: the 3 refs made", moved)
+	}
+	if head, err := restored.Head(); err != nil || head.Hash() != h2 {
+		t.Fatalf("have: %v %v want: HEAD at %s", head, err, h2)
+	}
+	if _, err := restored.TagObject(tag.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ A, B int }
+	if err := Load(restored, "refs/heads/dev", "a.toml", &v); err != nil || v.A != 1 {
+		t.Fatalf("have: %+v %v want: a.toml from dev", v, err)
+	}
+
+	// into an existing one only the refs that moved are given
+	h3 := commit("a.toml", "a = 2\n")
+	bundle.Reset()
+	if err := WriteBundle(bundle, repo.Storer); err != nil {
+		t.Fatal(err)
+	}
+	moved, err = ReadBundle(bundle, restored.Storer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 1 || moved[0].OldHash != h2.String() || moved[0].NewHash != h3.String() {
+		t.Fatalf("have: %+v want: master from %s to %s", moved, h2, h3)
+	}
+
+	// a bundle made on top of a commit needs it
+	thin := "# v2 git bundle\n-" + h3.String() + " commit\n" + h3.String() + " refs/heads/master\n\n"
+	other, _ := git.Init(memory.NewStorage(), nil)
+	if _, err := ReadBundle(strings.NewReader(thin), other.Storer); !errors.Is(err, ErrBundlePrereq) {
+		t.Fatalf("have: %v want: %v", err, ErrBundlePrereq)
+	}
+	if _, err := ReadBundle(strings.NewReader("# v3 git bundle\n"), other.Storer); err != ErrBundleVersion {
+		t.Fatalf("have: %v want: %v", err, ErrBundleVersion)
+	}
+	if _, err := ReadBundle(strings.NewReader("# v2 git bundle\nnot a ref\n\n"), other.Storer); !errors.Is(err, ErrBundleHeader) {
+		t.Fatalf("have: %v want: %v", err, ErrBundleHeader)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfg-snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, _ := repo.Worktree()
+	util.WriteFile(fs, "a.toml", []byte("a = 1\n"), 0644)
+	wt.Add("a.toml")
+	sig := &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+	h, err := wt.Commit("commit", &git.CommitOptions{Author: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, _ := git.Init(memory.NewStorage(), nil)
+	reg := NewMapRegistry(map[string]*git.Repository{"team/config": repo, "empty": empty})
+
+	snaps := NewSnapshots(dir, time.Hour)
+	if err := snaps.Save(reg); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "team", "config.bundle")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "empty.bundle")); !os.IsNotExist(err) {
+		t.Fatalf("have: %v want: no bundle of an empty repository", err)
+	}
+
+	// a repository that hasn't changed isn't written again
+	os.Remove(path)
+	if err := snaps.Save(reg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("have: %v want: the bundle not written again", err)
+	}
+	snaps = NewSnapshots(dir, time.Hour)
+	if err := snaps.Save(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the restart
+	restored := NewMapRegistry(nil)
+	if err := NewSnapshots(dir, time.Hour).Restore(restored); err != nil {
+		t.Fatal(err)
+	}
+	r, ok := restored.Lookup("team/config")
+	if !ok {
+		t.Fatalf("have: %v want: team/config restored", restored.List())
+	}
+	if head, err := r.Head(); err != nil || head.Hash() != h {
+		t.Fatalf("have: %v %v want: HEAD at %s", head, err, h)
+	}
+
+	// a repository whose refs were all deleted doesn't get them back on a restart
+	if err := repo.Storer.RemoveReference("refs/heads/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := snaps.Save(reg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("have: %v want: the bundle of the emptied repository removed", err)
+	}
+	emptied := NewMapRegistry(nil)
+	if err := NewSnapshots(dir, time.Hour).Restore(emptied); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := emptied.Lookup("team/config"); ok {
+		t.Fatal("have: team/config restored want: nothing to restore")
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/master", h)); err != nil {
+		t.Fatal(err)
+	}
+	if err := snaps.Save(reg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("have: %v want: the bundle written again", err)
+	}
+
+	// the bundle of a repository that was removed is removed
+	reg.Remove("team/config")
+	if err := snaps.Save(reg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("have: %v want: the bundle removed", err)
+	}
+}
@@ -0,0 +1,319 @@
+package cfg
+
+import (
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/utils/merkletrie"
+)
+
+// ChangeKind is how a push changes a ref
+type ChangeKind string
+
+// The kinds of change to a ref
+const (
+	ChangeCreate      ChangeKind = "create"
+	ChangeDelete      ChangeKind = "delete"
+	ChangeFastForward ChangeKind = "fast-forward"
+	ChangeForceUpdate ChangeKind = "force-update"
+)
+
+// FileAction is how a commit changes a file
+type FileAction string
+
+// The actions on a file
+const (
+	FileAdd    FileAction = "add"
+	FileModify FileAction = "modify"
+	FileDelete FileAction = "delete"
+)
+
+// FileChange is a file that a commit changed, compared to its first parent
+type FileChange struct {
+	Path   string
+	Action FileAction
+}
+
+// CommitChanges holds the files that a single commit changed
+type CommitChanges struct {
+	Commit *object.Commit
+	Files  []FileChange
+}
+
+// changes holds what a push does to a ref, it is worked out the first time
+// one of the helpers asks for it and shared by the copies of the data
+type changes struct {
+	sto    storer.Storer
+	before *refsBefore
+
+	mu      sync.Mutex
+	kind    ChangeKind
+	commits []*object.Commit
+	files   []CommitChanges
+	done    bool
+	err     error
+}
+
+// refsBefore holds where the refs of a repository were before a push
+type refsBefore struct {
+	hashes map[string]plumbing.Hash
+	err    error
+}
+
+// WithStorer returns copies of refs whose change helpers (Kind, Commits and Changes)
+// read the objects from the repository storage sto. The other references are the ones
+// of sto as they are now, with the refs of the push put back at their old hashes, so the
+// refs are the same as before the push even when sto has already been updated.
+func WithStorer(refs []ReceivePackData, sto storer.Storer) []ReceivePackData {
+	before := &refsBefore{hashes: make(map[string]plumbing.Hash)}
+	if iter, err := sto.IterReferences(); err != nil {
+		before.err = err
+	} else {
+		before.err = iter.ForEach(func(ref *plumbing.Reference) error {
+			if ref.Type() == plumbing.HashReference {
+				before.hashes[ref.Name().String()] = ref.Hash()
+			}
+			return nil
+		})
+	}
+	for _, ref := range refs {
+		if ref.OldHash == plumbing.ZeroHash.String() {
+			delete(before.hashes, ref.RefName)
+		} else {
+			before.hashes[ref.RefName] = plumbing.NewHash(ref.OldHash)
+		}
+	}
+
+	out := make([]ReceivePackData, 0, len(refs))
+	for _, ref := range refs {
+		ref.changes = &changes{sto: sto, before: before}
+		out = append(out, ref)
+	}
+	return out
+}
+
+// Kind returns how the push changes the ref. An update is a fast-forward when the
+// old commit is in the history of the new one, otherwise it is a force-update.
+func (d ReceivePackData) Kind() (ChangeKind, error) {
+	switch plumbing.ZeroHash.String() {
+	case d.OldHash:
+		return ChangeCreate, nil
+	case d.NewHash:
+		return ChangeDelete, nil
+	}
+	if err := d.load(); err != nil {
+		return "", err
+	}
+	return d.changes.kind, nil
+}
+
+// Commits returns the commits that the push adds to the ref, newest first. These are
+// the commits of the new history that are not in the history of any ref of the repository
+// before the push, so the refs that are pushed together all have the commits that are new
+// to the repository. A delete has no commits.
+func (d ReceivePackData) Commits() ([]*object.Commit, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d.changes.commits, nil
+}
+
+// Changes returns the files that each of the commits of the push changed, in the same
+// order as Commits. A commit is compared to its first parent, so a merge lists the files
+// that it brings in from the other side.
+func (d ReceivePackData) Changes() ([]CommitChanges, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d.changes.files, nil
+}
+
+// load works out the changes of the push once
+func (d ReceivePackData) load() error {
+	if d.changes == nil {
+		return ErrNoStorer
+	}
+
+	c := d.changes
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done {
+		c.err = c.load(d)
+		c.done = true
+	}
+	return c.err
+}
+
+func (c *changes) load(d ReceivePackData) error {
+	if d.NewHash == plumbing.ZeroHash.String() {
+		c.kind = ChangeDelete
+		return nil
+	}
+
+	newCommit := c.commit(plumbing.NewHash(d.NewHash))
+	if newCommit == nil {
+		c.kind = ChangeForceUpdate // not a commit, so there is no history
+		if d.OldHash == plumbing.ZeroHash.String() {
+			c.kind = ChangeCreate
+		}
+		return nil
+	}
+
+	// the commits that are already known are the history of the refs before the
+	// push, the old history of the ref is one of them
+	if c.before.err != nil {
+		return c.before.err
+	}
+	var known []*object.Commit
+	for _, h := range c.before.hashes {
+		if commit := c.commit(h); commit != nil {
+			known = append(known, commit)
+		}
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	if err := walk(known, seen, nil); err != nil {
+		return err
+	}
+
+	var oldReachable bool
+	if err := walk([]*object.Commit{newCommit}, seen, func(commit *object.Commit) {
+		c.commits = append(c.commits, commit)
+	}); err != nil {
+		return err
+	}
+
+	switch {
+	case d.OldHash == plumbing.ZeroHash.String():
+		c.kind = ChangeCreate
+	default:
+		if old := c.commit(plumbing.NewHash(d.OldHash)); old != nil {
+			var err error
+			if oldReachable, err = isAncestor(old, newCommit); err != nil {
+				return err
+			}
+		}
+		c.kind = ChangeForceUpdate
+		if oldReachable {
+			c.kind = ChangeFastForward
+		}
+	}
+
+	for _, commit := range c.commits {
+		files, err := changedFiles(commit)
+		if err != nil {
+			return err
+		}
+		c.files = append(c.files, CommitChanges{Commit: commit, Files: files})
+	}
+	return nil
+}
+
+// commit returns the commit of h, annotated tags are peeled. Nil is returned
+// when h doesn't lead to a commit.
+func (c *changes) commit(h plumbing.Hash) *object.Commit { return peel(c.sto, h) }
+
+// peel returns the commit of h from the storage, annotated tags are peeled.
+// Nil is returned when h doesn't lead to a commit.
+func peel(sto storer.EncodedObjectStorer, h plumbing.Hash) *object.Commit {
+	obj, err := object.GetObject(sto, h)
+	for err == nil {
+		switch o := obj.(type) {
+		case *object.Commit:
+			return o
+		case *object.Tag:
+			obj, err = o.Object()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// walk calls fn for each commit in the history of from that is not in seen yet, and
+// adds it to seen. The commits are walked newest first.
+func walk(from []*object.Commit, seen map[plumbing.Hash]bool, fn func(*object.Commit)) error {
+	for stack := from; len(stack) > 0; {
+		commit := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[commit.Hash] {
+			continue
+		}
+		seen[commit.Hash] = true
+		if fn != nil {
+			fn(commit)
+		}
+
+		parents := commit.Parents()
+		var ps []*object.Commit
+		if err := parents.ForEach(func(p *object.Commit) error {
+			ps = append(ps, p)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for i := len(ps) - 1; i >= 0; i-- {
+			stack = append(stack, ps[i]) // the first parent is walked first
+		}
+	}
+	return nil
+}
+
+// isAncestor returns true when old is in the history of commit
+func isAncestor(old, commit *object.Commit) (bool, error) {
+	var found bool
+	err := walk([]*object.Commit{commit}, make(map[plumbing.Hash]bool), func(c *object.Commit) {
+		found = found || c.Hash == old.Hash
+	})
+	return found, err
+}
+
+// changedFiles returns the files that the commit changed compared to its first parent
+func changedFiles(commit *object.Commit) ([]FileChange, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	var parentTree *object.Tree
+	if commit.NumParents() > 0 {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return nil, err
+		}
+	}
+
+	diff, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]FileChange, 0, len(diff))
+	for _, change := range diff {
+		file, err := fileChange(change)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// fileChange returns the file and the action of a change between two trees
+func fileChange(change *object.Change) (FileChange, error) {
+	action, err := change.Action()
+	if err != nil {
+		return FileChange{}, err
+	}
+	switch action {
+	case merkletrie.Insert:
+		return FileChange{Path: change.To.Name, Action: FileAdd}, nil
+	case merkletrie.Delete:
+		return FileChange{Path: change.From.Name, Action: FileDelete}, nil
+	}
+	return FileChange{Path: change.To.Name, Action: FileModify}, nil
+}
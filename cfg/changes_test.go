@@ -0,0 +1,139 @@
+package cfg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestReceivePackDataChanges(t *testing.T) {
+	sto := memory.NewStorage()
+	fs := memfs.New()
+	repo, err := git.Init(sto, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func(files map[string]string, remove ...string) plumbing.Hash {
+		for name, contents := range files {
+			if err := util.WriteFile(fs, name, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			wt.Add(name)
+		}
+		for _, name := range remove {
+			wt.Remove(name)
+		}
+		sig := &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+		h, err := wt.Commit("commit", &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	c1 := commit(map[string]string{"a.toml": "a = 1\n", "b.toml": "b = 1\n"})
+	c2 := commit(map[string]string{"a.toml": "a = 2\n", "c.toml": "c = 1\n"}, "b.toml")
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: c1, Branch: "refs/heads/other", Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	c3 := commit(map[string]string{"a.toml": "a = 3\n"})
+	sto.SetReference(plumbing.NewHashReference("refs/heads/master", c2))
+	sto.SetReference(plumbing.NewHashReference("refs/heads/other", c1))
+
+	zero := plumbing.ZeroHash.String()
+	tests := []struct {
+		name        string
+		data        ReceivePackData
+		wantKind    ChangeKind
+		wantCommits []plumbing.Hash
+		wantFiles   [][]FileChange
+	}{
+		{
+			name:        "fast-forward",
+			data:        ReceivePackData{OldHash: c1.String(), NewHash: c2.String(), RefName: "refs/heads/master"},
+			wantKind:    ChangeFastForward,
+			wantCommits: []plumbing.Hash{c2},
+			wantFiles:   [][]FileChange{{{"a.toml", FileModify}, {"b.toml", FileDelete}, {"c.toml", FileAdd}}},
+		},
+		{
+			name:        "force-update",
+			data:        ReceivePackData{OldHash: c2.String(), NewHash: c3.String(), RefName: "refs/heads/master"},
+			wantKind:    ChangeForceUpdate,
+			wantCommits: []plumbing.Hash{c3},
+			wantFiles:   [][]FileChange{{{"a.toml", FileModify}}},
+		},
+		{
+			name:     "create at a known commit",
+			data:     ReceivePackData{OldHash: zero, NewHash: c2.String(), RefName: "refs/heads/new"},
+			wantKind: ChangeCreate,
+		},
+		{
+			name:        "create",
+			data:        ReceivePackData{OldHash: zero, NewHash: c3.String(), RefName: "refs/heads/new"},
+			wantKind:    ChangeCreate,
+			wantCommits: []plumbing.Hash{c3},
+			wantFiles:   [][]FileChange{{{"a.toml", FileModify}}},
+		},
+		{
+			name:     "delete",
+			data:     ReceivePackData{OldHash: c2.String(), NewHash: zero, RefName: "refs/heads/master"},
+			wantKind: ChangeDelete,
+		},
+	}
+
+	for _, test := range tests {
+		func(data ReceivePackData, wantKind ChangeKind, wantCommits []plumbing.Hash, wantFiles [][]FileChange) {
+			t.Run(test.name, func(t *testing.T) {
+				data = WithStorer([]ReceivePackData{data}, sto)[0]
+
+				kind, err := data.Kind()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if kind != wantKind {
+					t.Fatalf("have: %s want: %s", kind, wantKind)
+				}
+
+				commits, err := data.Commits()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var haveCommits []plumbing.Hash
+				for _, c := range commits {
+					haveCommits = append(haveCommits, c.Hash)
+				}
+				if !reflect.DeepEqual(haveCommits, wantCommits) {
+					t.Fatalf("have: %v want: %v", haveCommits, wantCommits)
+				}
+
+				changes, err := data.Changes()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var haveFiles [][]FileChange
+				for _, c := range changes {
+					haveFiles = append(haveFiles, c.Files)
+				}
+				if !reflect.DeepEqual(haveFiles, wantFiles) {
+					t.Fatalf("have: %v want: %v", haveFiles, wantFiles)
+				}
+			})
+		}(test.data, test.wantKind, test.wantCommits, test.wantFiles)
+	}
+
+	if _, err := (ReceivePackData{OldHash: c1.String(), NewHash: c2.String()}).Commits(); err != ErrNoStorer {
+		t.Fatalf("have: %v want: %v", err, ErrNoStorer)
+	}
+}
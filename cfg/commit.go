@@ -0,0 +1,30 @@
+package cfg
+
+import "gopkg.in/src-d/go-git.v4/plumbing/object"
+
+// CommitFile is a change to a single file of a Commit. The file is written with the
+// content, or removed when Delete is set.
+type CommitFile struct {
+	Path    string
+	Content []byte
+	Delete  bool
+}
+
+// Commit is a commit that the server makes itself on a ref, from changes to the files of
+// the commit that the ref is at. The old hash is the commit the ref is expected to be at,
+// the commit is only made when it still is. An empty or zero old hash creates the ref.
+// The author needs a name and an email, the committer is the author when it is empty, and
+// both are dated when the commit is made unless they have a time. The pusher and the push-options are what
+// the hooks are given, the same as they would be for a push.
+type Commit struct {
+	RefName string
+	OldHash string
+	Files   []CommitFile
+	Message string
+
+	Author    object.Signature
+	Committer object.Signature
+
+	Pusher      Pusher
+	PushOptions PushOptions
+}
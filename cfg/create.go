@@ -0,0 +1,108 @@
+package cfg
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// CreateOnPush makes a repository the first time it is pushed to, when its name isn't in
+// the registry of the server.
+type CreateOnPush struct {
+	// Authorize is asked if the pusher can make the repository, it is allowed when nil is
+	// returned. Without it no repository is made.
+	Authorize func(ctx context.Context, repoName string, pusher Pusher) error
+
+	// Init makes the empty repository, InitMemory is used when it is nil. Use InitDir
+	// to make it on disk, such as under the root of a DirRegistry.
+	Init func(repoName string) (*git.Repository, error)
+
+	// Template is copied into the new repository when it is set, its objects and refs
+	Template *git.Repository
+}
+
+// Allow returns nil when the pusher can make the repository, and ErrCreateDenied when
+// Authorize doesn't allow it
+func (c CreateOnPush) Allow(ctx context.Context, repoName string, pusher Pusher) error {
+	if err := checkRepoName(repoName); err != nil {
+		return err
+	}
+	if c.Authorize == nil {
+		return ErrCreateDenied.F(repoName, errors.New("no authorization"))
+	}
+	if err := c.Authorize(ctx, repoName, pusher); err != nil {
+		return ErrCreateDenied.F(repoName, err)
+	}
+	return nil
+}
+
+// Create makes the repository for the pusher and adds it to the registry, when Allow does
+func (c CreateOnPush) Create(ctx context.Context, reg Registry, repoName string, pusher Pusher) (*git.Repository, error) {
+	if err := c.Allow(ctx, repoName, pusher); err != nil {
+		return nil, err
+	}
+
+	init := c.Init
+	if init == nil {
+		init = InitMemory
+	}
+	repo, err := init(repoName)
+	if err != nil {
+		return nil, ErrCreateRepo.F(repoName, err)
+	}
+	if c.Template != nil {
+		if err := copyRepo(repo.Storer, c.Template.Storer); err != nil {
+			return nil, ErrCreateRepo.F(repoName, err)
+		}
+	}
+
+	// a repository that was made under the root of a registry is found there already
+	if found, ok := reg.Lookup(repoName); ok {
+		return found, nil
+	}
+	if err := reg.Add(repoName, repo); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// InitMemory makes an empty repository in memory
+func InitMemory(repoName string) (*git.Repository, error) {
+	return git.Init(memory.NewStorage(), nil)
+}
+
+// InitDir returns an Init func that makes an empty bare repository under the root, in
+// root/<repoName>.git
+func InitDir(root string) func(repoName string) (*git.Repository, error) {
+	return func(repoName string) (*git.Repository, error) {
+		return git.PlainInit(filepath.Join(root, filepath.FromSlash(repoName))+".git", true)
+	}
+}
+
+// copyRepo copies the objects and the refs of src into dst
+func copyRepo(dst, src storer.Storer) error {
+	objs, err := src.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return err
+	}
+	err = objs.ForEach(func(obj plumbing.EncodedObject) error {
+		_, err := dst.SetEncodedObject(obj)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	refs, err := src.IterReferences()
+	if err != nil {
+		return err
+	}
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		return dst.SetReference(ref)
+	})
+}
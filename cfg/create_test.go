@@ -0,0 +1,98 @@
+package cfg
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestCreateOnPush(t *testing.T) {
+	ctx := context.Background()
+	errDenied := errors.New("only the team can make repositories")
+	c := CreateOnPush{
+		Authorize: func(_ context.Context, repoName string, pusher Pusher) error {
+			if pusher.Username != "team" {
+				return errDenied
+			}
+			return nil
+		},
+	}
+
+	reg := NewMapRegistry(nil)
+	if _, err := c.Create(ctx, reg, "config", Pusher{Username: "other"}); !errors.Is(err, ErrCreateDenied) {
+		t.Fatalf("have: %v want: %v", err, ErrCreateDenied)
+	}
+	if _, err := (CreateOnPush{}).Create(ctx, reg, "config", Pusher{Username: "team"}); !errors.Is(err, ErrCreateDenied) {
+		t.Fatalf("have: %v want: %v without an Authorize", err, ErrCreateDenied)
+	}
+	if _, err := c.Create(ctx, reg, "../config", Pusher{Username: "team"}); !errors.Is(err, ErrRepoName) {
+		t.Fatalf("have: %v want: %v", err, ErrRepoName)
+	}
+	if names := reg.List(); len(names) != 0 {
+		t.Fatalf("have: %v want: nothing made", names)
+	}
+
+	repo, err := c.Create(ctx, reg, "config", Pusher{Username: "team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := reg.Lookup("config"); !ok || found != repo {
+		t.Fatalf("have: %v %v want: the new repository added", found, ok)
+	}
+	if _, err := repo.Head(); err != plumbing.ErrReferenceNotFound {
+		t.Fatalf("have: %v want: an empty repository", err)
+	}
+
+	// the template is copied into the new repository
+	fs := memfs.New()
+	tmpl, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, _ := tmpl.Worktree()
+	util.WriteFile(fs, "config.toml", []byte("a = 1\n"), 0644)
+	wt.Add("config.toml")
+	sig := &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+	h, err := wt.Commit("template", &git.CommitOptions{Author: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := ioutil.TempDir("", "cfg-create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dirReg, err := NewDirRegistry(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Template, c.Init = tmpl, InitDir(dirReg.Root())
+	repo, err = c.Create(ctx, dirReg, "team/config", Pusher{Username: "team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "team", "config.git", "HEAD")); err != nil {
+		t.Fatalf("have: %v want: a bare repository on disk", err)
+	}
+	if head, err := repo.Head(); err != nil || head.Hash() != h {
+		t.Fatalf("have: %v %v want: the template at %s", head, err, h)
+	}
+	if err := Load(repo, "refs/heads/master", "config.toml", &struct{ A int }{}); err != nil {
+		t.Fatal(err)
+	}
+	if names := dirReg.List(); len(names) != 1 || names[0] != "team/config" {
+		t.Fatalf("have: %v want: [team/config]", names)
+	}
+}
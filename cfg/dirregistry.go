@@ -0,0 +1,221 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// DirRegistry is a Registry of the bare repositories in the directories under a root. The
+// name of a repository is its path from the root, with or without a ".git" on the end, so
+// "team/config" is found at root/team/config or root/team/config.git. The directories are
+// looked at on each lookup, so a repository made under the root is served without a restart.
+// The repositories are opened with filesystem storage the first time they are looked up, and
+// the handle is kept for the lookups after.
+type DirRegistry struct {
+	root string
+
+	mu      sync.Mutex
+	opened  map[string]*git.Repository // by directory
+	added   map[string]*git.Repository // by name, the ones that aren't under the root
+	removed map[string]bool            // by directory
+}
+
+// NewDirRegistry returns a registry of the bare repositories under the root directory
+func NewDirRegistry(root string) (*DirRegistry, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, ErrRepoRoot.F(root, err)
+	}
+	if fi, err := os.Stat(root); err != nil {
+		return nil, ErrRepoRoot.F(root, err)
+	} else if !fi.IsDir() {
+		return nil, ErrRepoRoot.F(root, "not a directory")
+	}
+	return &DirRegistry{
+		root:    root,
+		opened:  make(map[string]*git.Repository),
+		added:   make(map[string]*git.Repository),
+		removed: make(map[string]bool),
+	}, nil
+}
+
+// Root returns the directory the repositories are found under
+func (r *DirRegistry) Root() string { return r.root }
+
+// Add adds the repository with the name, it fails when the name is taken. The repository
+// is served as it is, to have it found under the root make it there with git.PlainInit.
+func (r *DirRegistry) Add(name string, repo *git.Repository) error {
+	if err := checkRepoName(name); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.added[name]; ok || r.find(name) != "" {
+		return ErrRepoExists.F(name)
+	}
+	r.added[name] = repo
+	return nil
+}
+
+// Remove stops serving the repository with the name. The directory of the repository is
+// left on disk, it isn't served again until it is added back.
+func (r *DirRegistry) Remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.added[name]; ok {
+		delete(r.added, name)
+		return nil
+	}
+	dir := r.find(name)
+	if dir == "" {
+		return ErrRepoNotFound.F(name)
+	}
+	delete(r.opened, dir)
+	r.removed[dir] = true
+	return nil
+}
+
+// Rename moves the repository of the old name to the new name, it fails when the new name
+// is taken. The directory of a repository under the root is moved on disk.
+func (r *DirRegistry) Rename(oldName, newName string) error {
+	if err := checkRepoName(newName); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.added[newName]; ok || r.find(newName) != "" {
+		return ErrRepoExists.F(newName)
+	}
+	if repo, ok := r.added[oldName]; ok {
+		delete(r.added, oldName)
+		r.added[newName] = repo
+		return nil
+	}
+	dir := r.find(oldName)
+	if dir == "" {
+		return ErrRepoNotFound.F(oldName)
+	}
+
+	newDir := filepath.Join(r.root, filepath.FromSlash(newName))
+	if strings.HasSuffix(dir, ".git") && !strings.HasSuffix(newDir, ".git") {
+		newDir += ".git"
+	}
+	if err := os.MkdirAll(filepath.Dir(newDir), 0755); err != nil {
+		return ErrRepoRename.F(oldName, err)
+	}
+	if err := os.Rename(dir, newDir); err != nil {
+		return ErrRepoRename.F(oldName, err)
+	}
+	delete(r.opened, dir) // the storage of the handle is at the old path
+	delete(r.removed, newDir)
+	return nil
+}
+
+// List returns the names of the repositories in order. The repositories under the root are
+// named without the ".git" on the end.
+func (r *DirRegistry) List() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for name := range r.added {
+		seen[name] = true
+	}
+	filepath.Walk(r.root, func(dir string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() || dir == r.root {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !isBareRepo(dir) {
+			return nil
+		}
+		if !r.removed[dir] {
+			name, _ := filepath.Rel(r.root, dir)
+			seen[strings.TrimSuffix(filepath.ToSlash(name), ".git")] = true
+		}
+		return filepath.SkipDir // the directories of a repository aren't repositories
+	})
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the repository with the name, it is opened the first time it is looked up
+func (r *DirRegistry) Lookup(name string) (*git.Repository, bool) {
+	if checkRepoName(name) != nil {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if repo, ok := r.added[name]; ok {
+		return repo, true
+	}
+	dir := r.find(name)
+	if dir == "" {
+		for _, dir := range r.dirs(name) {
+			delete(r.opened, dir) // it is opened again if it is made again
+		}
+		return nil, false
+	}
+	if repo, ok := r.opened[dir]; ok {
+		return repo, true
+	}
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, false
+	}
+	r.opened[dir] = repo
+	return repo, true
+}
+
+// find returns the directory of the bare repository with the name, or "" when there isn't
+// one that is served
+func (r *DirRegistry) find(name string) string {
+	if checkRepoName(name) != nil {
+		return ""
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return "" // hidden, like the .git of a repository with a worktree
+		}
+	}
+	for _, dir := range r.dirs(name) {
+		if !r.removed[dir] && isBareRepo(dir) {
+			return dir
+		}
+	}
+	return ""
+}
+
+// dirs returns the directories the repository with the name can be in
+func (r *DirRegistry) dirs(name string) []string {
+	dir := filepath.Join(r.root, filepath.FromSlash(name))
+	if strings.HasSuffix(dir, ".git") {
+		return []string{dir, strings.TrimSuffix(dir, ".git")}
+	}
+	return []string{dir, dir + ".git"}
+}
+
+// isBareRepo reports if the directory looks like a bare git repository
+func isBareRepo(dir string) bool {
+	if fi, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || fi.IsDir() {
+		return false
+	}
+	for _, sub := range []string{"objects", "refs"} {
+		if fi, err := os.Stat(filepath.Join(dir, sub)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package cfg
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestDirRegistry(t *testing.T) {
+	root, err := ioutil.TempDir("", "cfg-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	initBare := func(dir string) {
+		if _, err := git.PlainInit(filepath.Join(root, dir), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	initBare("config")
+	initBare("team/config.git")
+	initBare("team/nested/deep")
+	if _, err := git.PlainInit(filepath.Join(root, "worktree"), false); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(root, "empty"), 0755)
+
+	reg, err := NewDirRegistry(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := reg.List(), []string{"config", "team/config", "team/nested/deep"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("have: %v want: %v", have, want)
+	}
+
+	for _, name := range []string{"config", "config.git", "team/config", "team/config.git", "team/nested/deep"} {
+		if _, ok := reg.Lookup(name); !ok {
+			t.Fatalf("have: no %s want: it found", name)
+		}
+	}
+	for _, name := range []string{"worktree", "worktree/.git", "empty", "team", "../config", "team/../config"} {
+		if _, ok := reg.Lookup(name); ok {
+			t.Fatalf("have: %s want: it not found", name)
+		}
+	}
+
+	// the handle is kept
+	repo, _ := reg.Lookup("config")
+	if again, _ := reg.Lookup("config"); again != repo {
+		t.Fatal("have: a new handle want: the kept one")
+	}
+
+	// a repository that is made under the root is found without a restart
+	initBare("tenants/acme")
+	if _, ok := reg.Lookup("tenants/acme"); !ok {
+		t.Fatal("have: no tenants/acme want: it found")
+	}
+	if err := reg.Add("tenants/acme", repo); !errors.Is(err, ErrRepoExists) {
+		t.Fatalf("have: %v want: %v", err, ErrRepoExists)
+	}
+
+	if err := reg.Rename("tenants/acme", "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "acme", "HEAD")); err != nil {
+		t.Fatalf("have: %v want: the directory moved", err)
+	}
+	if _, ok := reg.Lookup("tenants/acme"); ok {
+		t.Fatal("have: tenants/acme want: it renamed")
+	}
+	if err := reg.Rename("team/config", "acme"); !errors.Is(err, ErrRepoExists) {
+		t.Fatalf("have: %v want: %v", err, ErrRepoExists)
+	}
+	if err := reg.Rename("team/config", "config2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "config2.git")); err != nil {
+		t.Fatalf("have: %v want: the .git kept on the directory", err)
+	}
+
+	// a removed repository stays on disk but isn't served
+	if err := reg.Remove("acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reg.Lookup("acme"); ok {
+		t.Fatal("have: acme want: it removed")
+	}
+	if _, err := os.Stat(filepath.Join(root, "acme")); err != nil {
+		t.Fatalf("have: %v want: the directory left", err)
+	}
+	if err := reg.Remove("acme"); !errors.Is(err, ErrRepoNotFound) {
+		t.Fatalf("have: %v want: %v", err, ErrRepoNotFound)
+	}
+
+	// repositories that aren't under the root can be added too
+	mem, _ := git.Init(memory.NewStorage(), nil)
+	if err := reg.Add("memory", mem); err != nil {
+		t.Fatal(err)
+	}
+	if repo, ok := reg.Lookup("memory"); !ok || repo != mem {
+		t.Fatalf("have: %v %v want: the added repository", repo, ok)
+	}
+	if have, want := reg.List(), []string{"config", "config2", "memory", "team/nested/deep"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("have: %v want: %v", have, want)
+	}
+
+	if _, err := NewDirRegistry(filepath.Join(root, "missing")); !errors.Is(err, ErrRepoRoot) {
+		t.Fatalf("have: %v want: %v", err, ErrRepoRoot)
+	}
+}
@@ -0,0 +1,91 @@
+package cfg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errors we handle
+const (
+	ErrNoStorer     strErr = "the receive-pack data has no repository to read the changes from"
+	ErrNoRepository strErr = "the hook data has no repository to load the configuration from"
+
+	ErrLoadRevision strErr = "load %s: %v"
+	ErrLoadFile     strErr = "load %s: %v"
+	ErrLoadFormat   strErr = "load %s: unknown configuration format"
+	ErrDecode       strErr = "decode %s: %v"
+	ErrInvalid      strErr = "invalid %s: %v"
+
+	ErrRollback        strErr = "roll back %s: %v"
+	ErrRollbackCommit  strErr = "roll back %s: %s is not a commit"
+	ErrRollbackHistory strErr = "roll back %s: %s is not in its history"
+	ErrRollbackAuthor  strErr = "roll back %s: the author or the pusher, with an email or a remote address, is required"
+	ErrRollbackEmpty   strErr = "roll back %s: there are no changes to undo"
+	ErrRevertConflict  strErr = "revert: %s has changed since %s"
+
+	ErrRepoExists   strErr = "repository %s already exists"
+	ErrRepoNotFound strErr = "repository %s not found"
+	ErrRepoName     strErr = "bad repository name %q"
+	ErrRepoRoot     strErr = "repository root %s: %v"
+	ErrRepoRename   strErr = "rename repository %s: %v"
+	ErrCreateDenied strErr = "create repository %s: not allowed: %v"
+	ErrCreateRepo   strErr = "create repository %s: %v"
+
+	ErrBundle        strErr = "bundle: %v"
+	ErrBundleVersion strErr = "bundle: not a v2 git bundle"
+	ErrBundleHeader  strErr = "bundle: bad header line %q"
+	ErrBundlePrereq  strErr = "bundle: the repository doesn't have %s, which the bundle needs"
+	ErrBundleEmpty   strErr = "bundle: there are no refs"
+	ErrSnapshot      strErr = "snapshot %s: %v"
+
+	ErrNamespaceRepo strErr = "repository %s has no namespace"
+	ErrNamespaceUser strErr = "repository %s: a username is needed for the namespace"
+)
+
+// strErr provides an error wrapper for strings with an option to
+// provide formatting values. It is used for error constants that
+// have built-in formatting directives. So we can provide a base
+// string constant that can be comparable by type or 'sentinel' value.
+type strErr string
+
+func (e strErr) Error() string { return string(e) }
+
+// F captures the values for an error string formatting. This is a
+// separate method so an error can be matched with its base
+// formatting directives.
+func (e strErr) F(v ...interface{}) error {
+	var hasErr, hasNil bool
+	for _, vv := range v {
+		switch err := vv.(type) {
+		case error:
+			if err == nil {
+				return nil
+			}
+			hasErr = true
+		case nil:
+			hasNil = true
+		}
+	}
+
+	// if there is no error object, and we have a nil, then the err is nil
+	// otherwise we have some nil item, but a valid err, so pass the err along
+	if hasNil && !hasErr {
+		return nil
+	}
+
+	return fmtErr{err: fmt.Errorf("%w", e), v: v}
+}
+
+// fmtErr is for errors that will be formatted. It hold the
+// formatting values in a field so they can be added when the
+// error is stringfied. Otherwise the underlining error without
+// formatting can be matched.
+type fmtErr struct {
+	err error
+	v   []interface{}
+}
+
+func (e fmtErr) Error() string { return fmt.Sprintf(e.err.Error(), e.v...) }
+
+// Unwrap is a method to help unwrap errors to the base error for go1.13
+func (e fmtErr) Unwrap() error { return errors.Unwrap(e.err) }
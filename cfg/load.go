@@ -0,0 +1,99 @@
+package cfg
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+
+	toml "github.com/pelletier/go-toml"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Validator is a configuration type that checks its own values. Validate is called after
+// the configuration has been decoded by Load, LoadCommit or Decode.
+type Validator interface {
+	Validate() error
+}
+
+// Load decodes the file at path from the commit of rev into v. The rev can be a ref name,
+// a short name like "master" or the hash of a commit or tag.
+func Load(repo *git.Repository, rev, path string, v interface{}) error {
+	h, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return ErrLoadRevision.F(rev, err)
+	}
+	commit, err := repo.CommitObject(*h)
+	if err != nil {
+		return ErrLoadRevision.F(rev, err)
+	}
+	return LoadCommit(commit, path, v)
+}
+
+// LoadCommit decodes the file at path from the commit into v
+func LoadCommit(commit *object.Commit, path string, v interface{}) error {
+	file, err := commit.File(path)
+	if err != nil {
+		return ErrLoadFile.F(path, err)
+	}
+	r, err := file.Reader()
+	if err != nil {
+		return ErrLoadFile.F(path, err)
+	}
+	defer r.Close()
+	return Decode(path, r, v)
+}
+
+// Decode decodes the configuration in r into v, the extension of the file name picks
+// the decoder: .toml, .yaml or .yml, and .json. If v is a Validator it is validated.
+func Decode(name string, r io.Reader, v interface{}) error {
+	var err error
+	switch strings.ToLower(path.Ext(name)) {
+	case ".toml":
+		err = toml.NewDecoder(r).Decode(v)
+	case ".yaml", ".yml":
+		if err = yaml.NewDecoder(r).Decode(v); err == io.EOF {
+			err = nil // an empty file
+		}
+	case ".json":
+		err = json.NewDecoder(r).Decode(v)
+	default:
+		return ErrLoadFormat.F(name)
+	}
+	if err != nil {
+		return ErrDecode.F(name, err)
+	}
+
+	if val, ok := v.(Validator); ok {
+		if err := val.Validate(); err != nil {
+			return ErrInvalid.F(name, err)
+		}
+	}
+	return nil
+}
+
+// PreReceiveLoadHook returns a pre-receive hook that rejects a push to the ref named refName
+// when the file at path of the new commit can't be loaded into the value that newValue returns,
+// so a configuration that would fail to load never lands. The other refs are accepted.
+func PreReceiveLoadHook(refName, path string, newValue func() interface{}) PreReceivePackRefHookContextFunc {
+	return func(_ context.Context, _ io.Writer, data *PreReceivePackHookData) *PreReceivePackHookResult {
+		result := &PreReceivePackHookResult{}
+		for _, ref := range data.Refs {
+			if ref.RefName != refName || ref.NewHash == plumbing.ZeroHash.String() {
+				continue
+			}
+			if data.Repository == nil {
+				result.Reject(ref, ErrNoRepository.Error())
+				continue
+			}
+			if err := Load(data.Repository, ref.NewHash, path, newValue()); err != nil {
+				result.Reject(ref, err.Error())
+			}
+		}
+		return result
+	}
+}
@@ -0,0 +1,106 @@
+package cfg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+type testConfig struct {
+	Name string `toml:"name" yaml:"name" json:"name"`
+	Port int    `toml:"port" yaml:"port" json:"port"`
+}
+
+func (c *testConfig) Validate() error {
+	if c.Port <= 0 {
+		return errors.New("the port must be more than zero")
+	}
+	return nil
+}
+
+func TestLoad(t *testing.T) {
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"config.toml":  "name = \"a\"\nport = 80\n",
+		"config.yml":   "name: a\nport: 80\n",
+		"config.json":  `{"name": "a", "port": 80}`,
+		"invalid.toml": "name = \"a\"\nport = 0\n",
+		"broken.json":  `{"name": "a", "port": "80"}`,
+		"config.ini":   "name=a",
+	}
+	for name, contents := range files {
+		if err := util.WriteFile(fs, name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wt.Add(name)
+	}
+	sig := &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+	h, err := wt.Commit("commit", &git.CommitOptions{Author: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, rev, path string
+		wantErr         error
+	}{
+		{"toml", "refs/heads/master", "config.toml", nil},
+		{"yaml", "master", "config.yml", nil},
+		{"json", h.String(), "config.json", nil},
+		{"invalid", "master", "invalid.toml", ErrInvalid},
+		{"decode", "master", "broken.json", ErrDecode},
+		{"format", "master", "config.ini", ErrLoadFormat},
+		{"missing", "master", "missing.toml", ErrLoadFile},
+		{"revision", "nope", "config.toml", ErrLoadRevision},
+	}
+
+	for _, test := range tests {
+		func(rev, path string, wantErr error) {
+			t.Run(test.name, func(t *testing.T) {
+				var conf testConfig
+				err := Load(repo, rev, path, &conf)
+				if !errors.Is(err, wantErr) {
+					t.Fatalf("have: %v want: %v", err, wantErr)
+				}
+				if wantErr == nil && (conf != testConfig{Name: "a", Port: 80}) {
+					t.Fatalf("have: %+v want: %+v", conf, testConfig{Name: "a", Port: 80})
+				}
+			})
+		}(test.rev, test.path, test.wantErr)
+	}
+
+	data := &PreReceivePackHookData{Repository: repo}
+	data.Refs = []ReceivePackData{
+		{OldHash: h.String(), NewHash: h.String(), RefName: "refs/heads/master"},
+		{OldHash: h.String(), NewHash: h.String(), RefName: "refs/heads/other"},
+	}
+	newValue := func() interface{} { return &testConfig{} }
+
+	result := PreReceiveLoadHook("refs/heads/master", "config.toml", newValue)(context.Background(), nil, data)
+	if _, rej := result.Rejected("refs/heads/master"); rej {
+		t.Fatal("want refs/heads/master accepted")
+	}
+	result = PreReceiveLoadHook("refs/heads/master", "invalid.toml", newValue)(context.Background(), nil, data)
+	if reason, rej := result.Rejected("refs/heads/master"); !rej || !strings.Contains(reason, "the port must be more than zero") {
+		t.Fatalf("have: %t %q want: rejected", rej, reason)
+	}
+	if _, rej := result.Rejected("refs/heads/other"); rej {
+		t.Fatal("want refs/heads/other accepted")
+	}
+}
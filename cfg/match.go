@@ -0,0 +1,35 @@
+package cfg
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchPath returns if the path glob matches the whole of the file name. Each part of
+// the glob between slashes is matched the way path.Match does, and a '**' part matches
+// any number of directories.
+func MatchPath(glob, name string) bool {
+	return match(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+// match matches the parts of a path glob to the parts of a file name
+func match(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if match(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,25 @@
+package cfg
+
+import "testing"
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		glob, name string
+		want       bool
+	}{
+		{"*.toml", "a.toml", true},
+		{"*.toml", "a/a.toml", false},
+		{"**/*.toml", "a.toml", true},
+		{"**/*.toml", "a/b/a.toml", true},
+		{"a/**", "a/b/c.json", true},
+		{"a/**/c.json", "a/c.json", true},
+		{"a/**/c.json", "b/c.json", false},
+	}
+
+	for _, test := range tests {
+		have := MatchPath(test.glob, test.name)
+		if have != test.want {
+			t.Errorf("%s %s have: %t want: %t", test.glob, test.name, have, test.want)
+		}
+	}
+}
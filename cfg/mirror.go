@@ -0,0 +1,19 @@
+package cfg
+
+import (
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// DefaultMirrorInterval is how often a mirror fetches when its interval isn't set
+const DefaultMirrorInterval = time.Minute
+
+// Mirror is the upstream repository that a repository is a read-only mirror of. The refs
+// are fetched from the URL every interval and moved to where they are upstream, refs that
+// are gone upstream are removed. Pushes to the mirror are rejected with the URL to push to.
+type Mirror struct {
+	URL      string
+	Auth     transport.AuthMethod
+	Interval time.Duration
+}
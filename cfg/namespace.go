@@ -0,0 +1,30 @@
+package cfg
+
+import "strings"
+
+// NamespaceFunc picks the repository and the git namespace (see gitnamespaces(7)) that a
+// request for the repoName is served from, the pusher is whoever made the request. The
+// refs of the namespace are the only ones the request can see or change, and the objects
+// are shared with the rest of the repository. An empty namespace serves the whole
+// repository, and an error refuses the request.
+type NamespaceFunc func(repoName string, pusher Pusher) (repo, namespace string, err error)
+
+// NamespaceFromRepoName serves a repoName of <namespace>/<repo> from the namespace of the
+// repository, so acme/config is the acme namespace of config. A repoName without a
+// namespace is refused.
+func NamespaceFromRepoName(repoName string, _ Pusher) (string, string, error) {
+	i := strings.Index(repoName, "/")
+	if i <= 0 || i == len(repoName)-1 {
+		return "", "", ErrNamespaceRepo.F(repoName)
+	}
+	return repoName[i+1:], repoName[:i], nil
+}
+
+// NamespaceFromUsername serves each user from a namespace of the repository with their
+// username. A request without a username is refused.
+func NamespaceFromUsername(repoName string, pusher Pusher) (string, string, error) {
+	if pusher.Username == "" {
+		return "", "", ErrNamespaceUser.F(repoName)
+	}
+	return repoName, pusher.Username, nil
+}
@@ -0,0 +1,36 @@
+package cfg
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNamespaceFunc(t *testing.T) {
+	tests := []struct {
+		name     string
+		fn       NamespaceFunc
+		repoName string
+		pusher   Pusher
+		repo, ns string
+		err      error
+	}{
+		{name: "from the repo name", fn: NamespaceFromRepoName, repoName: "acme/config", repo: "config", ns: "acme"},
+		{name: "nested repo name", fn: NamespaceFromRepoName, repoName: "acme/team/config", repo: "team/config", ns: "acme"},
+		{name: "no namespace in the name", fn: NamespaceFromRepoName, repoName: "config", err: ErrNamespaceRepo},
+		{name: "no repo in the name", fn: NamespaceFromRepoName, repoName: "acme/", err: ErrNamespaceRepo},
+		{name: "from the username", fn: NamespaceFromUsername, repoName: "config", pusher: Pusher{Username: "acme"}, repo: "config", ns: "acme"},
+		{name: "no username", fn: NamespaceFromUsername, repoName: "config", err: ErrNamespaceUser},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo, ns, err := test.fn(test.repoName, test.pusher)
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Fatalf("have: %v want: %v", err, test.err)
+			}
+			if repo != test.repo || ns != test.ns {
+				t.Fatalf("have: %q %q want: %q %q", repo, ns, test.repo, test.ns)
+			}
+		})
+	}
+}
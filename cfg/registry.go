@@ -0,0 +1,140 @@
+package cfg
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+)
+
+// Registry holds the repositories that the servers serve by name. Repositories can be
+// added, removed and renamed while the servers run, so it must be safe for concurrent use.
+// A name is a clean slash separated path, such as "config" or "team/config", that is
+// added on to the endpoint of the server.
+type Registry interface {
+	Add(name string, repo *git.Repository) error
+	Remove(name string) error
+	Rename(oldName, newName string) error
+	List() []string
+	Lookup(name string) (*git.Repository, bool)
+}
+
+// MapRegistry is a Registry that keeps the repositories in a map
+type MapRegistry struct {
+	mu    sync.RWMutex
+	repos map[string]*git.Repository
+}
+
+// NewMapRegistry returns a registry with a copy of the repositories of m, a nil map
+// starts it empty. The names of m are not checked.
+func NewMapRegistry(m map[string]*git.Repository) *MapRegistry {
+	r := &MapRegistry{repos: make(map[string]*git.Repository, len(m))}
+	for name, repo := range m {
+		r.repos[name] = repo
+	}
+	return r
+}
+
+// Add adds the repository with the name, it fails when the name is taken
+func (r *MapRegistry) Add(name string, repo *git.Repository) error {
+	if err := checkRepoName(name); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.repos[name]; ok {
+		return ErrRepoExists.F(name)
+	}
+	r.repos[name] = repo
+	return nil
+}
+
+// Remove removes the repository with the name, the repository itself is left as it is
+func (r *MapRegistry) Remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.repos[name]; !ok {
+		return ErrRepoNotFound.F(name)
+	}
+	delete(r.repos, name)
+	return nil
+}
+
+// Rename moves the repository of the old name to the new name, it fails when the new
+// name is taken
+func (r *MapRegistry) Rename(oldName, newName string) error {
+	if err := checkRepoName(newName); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repo, ok := r.repos[oldName]
+	if !ok {
+		return ErrRepoNotFound.F(oldName)
+	}
+	if _, ok := r.repos[newName]; ok {
+		return ErrRepoExists.F(newName)
+	}
+	delete(r.repos, oldName)
+	r.repos[newName] = repo
+	return nil
+}
+
+// List returns the names of the repositories in order
+func (r *MapRegistry) List() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.repos))
+	for name := range r.repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the repository with the name
+func (r *MapRegistry) Lookup(name string) (*git.Repository, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	repo, ok := r.repos[name]
+	return repo, ok
+}
+
+// checkRepoName checks that name can be used for a repository
+func checkRepoName(name string) error {
+	if name == "" || name == "/" || path.Clean(name) != name || strings.HasPrefix(name, "..") {
+		return ErrRepoName.F(name)
+	}
+	return nil
+}
+
+// NewRegistryLoader returns a go-git transport loader for the repositories of the registry.
+// The name of a repository is the path of the endpoint it is loaded with, after the path of
+// the endpoint that the server was given.
+func NewRegistryLoader(reg Registry, endpoint string) server.Loader {
+	prefix := endpoint
+	if ep, err := transport.NewEndpoint(endpoint); err == nil {
+		prefix = ep.Path
+	}
+	return registryLoader{reg: reg, prefix: prefix}
+}
+
+// registryLoader loads the repositories of a registry
+type registryLoader struct {
+	reg    Registry
+	prefix string
+}
+
+// Load returns the storage of the repository of the endpoint
+func (l registryLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	repo, ok := l.reg.Lookup(strings.TrimPrefix(ep.Path, l.prefix))
+	if !ok {
+		return nil, transport.ErrRepositoryNotFound
+	}
+	return repo.Storer, nil
+}
@@ -0,0 +1,103 @@
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestMapRegistry(t *testing.T) {
+	newRepo := func() *git.Repository {
+		repo, err := git.Init(memory.NewStorage(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	}
+
+	config := newRepo()
+	reg := NewMapRegistry(map[string]*git.Repository{"config": config})
+
+	tenant := newRepo()
+	if err := reg.Add("team/config", tenant); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Add("config", newRepo()); !errors.Is(err, ErrRepoExists) {
+		t.Fatalf("have: %v want: %v", err, ErrRepoExists)
+	}
+	for _, name := range []string{"", "/", "team/../config", "../config", "team/", "./config"} {
+		if err := reg.Add(name, newRepo()); !errors.Is(err, ErrRepoName) {
+			t.Fatalf("%q have: %v want: %v", name, err, ErrRepoName)
+		}
+	}
+	if have, want := reg.List(), []string{"config", "team/config"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("have: %v want: %v", have, want)
+	}
+
+	// the loader finds the repositories after the path of the server endpoint
+	loader := NewRegistryLoader(reg, "file:///")
+	for name, repo := range map[string]*git.Repository{"config": config, "team/config": tenant} {
+		ep, err := transport.NewEndpoint("file:///" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sto, err := loader.Load(ep)
+		if err != nil || sto != repo.Storer {
+			t.Fatalf("%s have: %v %v want: its storage", name, sto, err)
+		}
+	}
+
+	if err := reg.Rename("team/config", "config"); !errors.Is(err, ErrRepoExists) {
+		t.Fatalf("have: %v want: %v", err, ErrRepoExists)
+	}
+	if err := reg.Rename("missing", "other"); !errors.Is(err, ErrRepoNotFound) {
+		t.Fatalf("have: %v want: %v", err, ErrRepoNotFound)
+	}
+	if err := reg.Rename("team/config", "tenant"); err != nil {
+		t.Fatal(err)
+	}
+	if repo, ok := reg.Lookup("tenant"); !ok || repo != tenant {
+		t.Fatalf("have: %v %v want: the renamed repository", repo, ok)
+	}
+	if _, ok := reg.Lookup("team/config"); ok {
+		t.Fatal("have: the old name want: it gone")
+	}
+
+	if err := reg.Remove("config"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Remove("config"); !errors.Is(err, ErrRepoNotFound) {
+		t.Fatalf("have: %v want: %v", err, ErrRepoNotFound)
+	}
+	ep, _ := transport.NewEndpoint("file:///config")
+	if _, err := loader.Load(ep); err != transport.ErrRepositoryNotFound {
+		t.Fatalf("have: %v want: %v", err, transport.ErrRepositoryNotFound)
+	}
+
+	// the registry can be changed while it is read
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("tenant-%d", i)
+			for j := 0; j < 100; j++ {
+				reg.Add(name, tenant)
+				reg.Lookup(name)
+				reg.List()
+				reg.Rename(name, name+"-new")
+				reg.Remove(name + "-new")
+			}
+		}(i)
+	}
+	wg.Wait()
+	if have, want := reg.List(), []string{"tenant"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("have: %v want: %v", have, want)
+	}
+}
@@ -0,0 +1,11 @@
+package cfg
+
+import "gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+// Replicator sends the refs that were updated in a repository on to other instances. The
+// servers call Replicate after the refs of a push (or of a server-side commit) are updated,
+// with the push-options of the push so that a push that was itself replicated can be told
+// apart. Replicate must not block the push, the sending is done in the background.
+type Replicator interface {
+	Replicate(repoName string, sto storer.Storer, refs []ReceivePackData, pushOptions PushOptions)
+}
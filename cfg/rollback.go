@@ -0,0 +1,229 @@
+package cfg
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// Rollback undoes changes to a ref with a new commit on top of it, so the history is kept and
+// the undo goes through the hooks like any other push. The files of the ref are set back to
+// how they are at the target commit, or with Revert only the changes that the target commit
+// made (compared to its first parent) are undone. The target must be in the history of the ref.
+//
+// The old hash is the commit the ref is expected to be at, when it is empty the rollback is
+// on top of wherever the ref is. The author is who is doing it, the username of the pusher is
+// used when it has no name, and <username>@<host of the remote address> when it has no email.
+// The reason goes into the message of the commit.
+type Rollback struct {
+	RefName string
+	OldHash string
+	Target  string
+	Revert  bool
+	Reason  string
+
+	Author object.Signature
+	Pusher Pusher
+}
+
+// Commit returns the commit that does the rollback on top of the commit head. The hooks are
+// given a "rollback" or "revert" push-option with the target commit, so they can tell it apart
+// from a push.
+func (r Rollback) Commit(sto storer.EncodedObjectStorer, head string) (*Commit, error) {
+	headCommit := peel(sto, plumbing.NewHash(head))
+	if headCommit == nil || headCommit.Hash.String() != head {
+		return nil, ErrRollbackCommit.F(r.RefName, head)
+	}
+	target := peel(sto, plumbing.NewHash(r.Target))
+	if target == nil || target.Hash.String() != r.Target {
+		return nil, ErrRollbackCommit.F(r.RefName, r.Target)
+	}
+	if ok, err := isAncestor(target, headCommit); err != nil {
+		return nil, ErrRollback.F(r.RefName, err)
+	} else if !ok {
+		return nil, ErrRollbackHistory.F(r.RefName, r.Target)
+	}
+
+	author := r.Author
+	if author.Name == "" {
+		author.Name = r.Pusher.Username
+	}
+	if author.Email == "" {
+		author.Email = r.Pusher.email()
+	}
+	if author.Name == "" || author.Email == "" {
+		return nil, ErrRollbackAuthor.F(r.RefName)
+	}
+	if author.When.IsZero() {
+		author.When = time.Now()
+	}
+
+	var files []CommitFile
+	var err error
+	if r.Revert {
+		files, err = revertFiles(headCommit, target)
+	} else {
+		files, err = rollbackFiles(headCommit, target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, ErrRollbackEmpty.F(r.RefName)
+	}
+
+	return &Commit{
+		RefName:     r.RefName,
+		OldHash:     head,
+		Files:       files,
+		Message:     r.message(target),
+		Author:      author,
+		Pusher:      r.Pusher,
+		PushOptions: PushOptions{{Key: r.action(), Value: r.Target}},
+	}, nil
+}
+
+// email returns the email of the pusher made from its username and the host it pushes
+// from, it is empty when either one isn't known
+func (p Pusher) email() string {
+	host, _, err := net.SplitHostPort(p.RemoteAddr)
+	if err != nil {
+		host = p.RemoteAddr
+	}
+	if p.Username == "" || host == "" {
+		return ""
+	}
+	return p.Username + "@" + host
+}
+
+// action is the name of what is being done
+func (r Rollback) action() string {
+	if r.Revert {
+		return "revert"
+	}
+	return "rollback"
+}
+
+// message returns the commit message in the same form as git revert
+func (r Rollback) message(target *object.Commit) string {
+	subject := strings.SplitN(strings.TrimSpace(target.Message), "\n", 2)[0]
+
+	msg := new(strings.Builder)
+	if r.Revert {
+		fmt.Fprintf(msg, "Revert %q\n\nThis reverts commit %s.\n", subject, target.Hash)
+	} else {
+		fmt.Fprintf(msg, "Roll back to %q\n\nThis rolls back to commit %s.\n", subject, target.Hash)
+	}
+	if reason := strings.TrimSpace(r.Reason); reason != "" {
+		fmt.Fprintf(msg, "\n%s\n", reason)
+	}
+	if r.Pusher.Username != "" {
+		if r.Revert {
+			fmt.Fprintf(msg, "\nReverted-by: %s\n", r.Pusher.Username)
+		} else {
+			fmt.Fprintf(msg, "\nRolled-back-by: %s\n", r.Pusher.Username)
+		}
+	}
+	return msg.String()
+}
+
+// rollbackFiles returns the changes that make the files of head the same as the files of target
+func rollbackFiles(head, target *object.Commit) ([]CommitFile, error) {
+	headTree, err := head.Tree()
+	if err != nil {
+		return nil, err
+	}
+	targetTree, err := target.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return treeFiles(headTree, targetTree, nil)
+}
+
+// revertFiles returns the changes that undo the changes of commit on top of head. A file
+// that has changed again since commit is a conflict.
+func revertFiles(head, commit *object.Commit) ([]CommitFile, error) {
+	headTree, err := head.Tree()
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	var parentTree *object.Tree
+	if commit.NumParents() > 0 {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return nil, err
+		}
+	}
+
+	return treeFiles(tree, parentTree, func(name string, from *object.File) error {
+		entry, err := headTree.FindEntry(name)
+		switch {
+		case err == object.ErrEntryNotFound || err == object.ErrDirectoryNotFound:
+			if from == nil {
+				return nil
+			}
+		case err != nil:
+			return err
+		case from != nil && entry.Hash == from.Hash:
+			return nil
+		}
+		return ErrRevertConflict.F(name, commit.Hash)
+	})
+}
+
+// treeFiles returns the changes that turn the files of the tree from into the files of the
+// tree to. The check is called with the file as it is in from (nil when it isn't) before a
+// change is added.
+func treeFiles(from, to *object.Tree, check func(string, *object.File) error) ([]CommitFile, error) {
+	changes, err := object.DiffTree(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []CommitFile
+	for _, change := range changes {
+		fromFile, toFile, err := change.Files()
+		if err != nil {
+			return nil, err
+		}
+		name := change.From.Name
+		if name == "" {
+			name = change.To.Name
+		}
+		if check != nil {
+			if err := check(name, fromFile); err != nil {
+				return nil, err
+			}
+		}
+
+		if toFile == nil {
+			files = append(files, CommitFile{Path: name, Delete: true})
+			continue
+		}
+		content := new(bytes.Buffer)
+		rd, err := toFile.Reader()
+		if err != nil {
+			return nil, err
+		}
+		_, err = content.ReadFrom(rd)
+		rd.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, CommitFile{Path: name, Content: content.Bytes()})
+	}
+	return files, nil
+}
@@ -0,0 +1,163 @@
+package cfg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestRollbackCommit(t *testing.T) {
+	sto := memory.NewStorage()
+	fs := memfs.New()
+	repo, err := git.Init(sto, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func(msg string, files map[string]string, remove ...string) string {
+		for name, contents := range files {
+			if err := util.WriteFile(fs, name, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			wt.Add(name)
+		}
+		for _, name := range remove {
+			wt.Remove(name)
+		}
+		sig := &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+		h, err := wt.Commit(msg, &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.String()
+	}
+
+	c1 := commit("one", map[string]string{"a.toml": "a = 1\n", "b.toml": "b = 1\n"})
+	c2 := commit("two\n\nmore about two", map[string]string{"a.toml": "a = 2\n", "c.toml": "c = 1\n"}, "b.toml")
+	c3 := commit("three", map[string]string{"d/d.toml": "d = 1\n"})
+	c4 := commit("four", map[string]string{"a.toml": "a = 4\n"})
+
+	pusher := Pusher{Username: "ops", RemoteAddr: "10.0.0.1:52000"}
+	tests := []struct {
+		name      string
+		head      string
+		rollback  Rollback
+		wantFiles map[string]string // a missing value is a delete
+		wantErr   error
+	}{
+		{
+			name:      "rollback",
+			head:      c3,
+			rollback:  Rollback{Target: c1, Pusher: pusher},
+			wantFiles: map[string]string{"a.toml": "a = 1\n", "b.toml": "b = 1\n", "c.toml": "", "d/d.toml": ""},
+		},
+		{
+			name:      "revert",
+			head:      c3,
+			rollback:  Rollback{Target: c2, Revert: true, Pusher: pusher},
+			wantFiles: map[string]string{"a.toml": "a = 1\n", "b.toml": "b = 1\n", "c.toml": ""},
+		},
+		{
+			name:      "revert the head",
+			head:      c4,
+			rollback:  Rollback{Target: c4, Revert: true, Pusher: pusher},
+			wantFiles: map[string]string{"a.toml": "a = 2\n"},
+		},
+		{
+			name:     "revert a file that changed since",
+			head:     c4,
+			rollback: Rollback{Target: c2, Revert: true, Pusher: pusher},
+			wantErr:  ErrRevertConflict,
+		},
+		{
+			name:     "not in the history",
+			head:     c1,
+			rollback: Rollback{Target: c3, Pusher: pusher},
+			wantErr:  ErrRollbackHistory,
+		},
+		{
+			name:     "not a commit",
+			head:     c3,
+			rollback: Rollback{Target: "1234", Pusher: pusher},
+			wantErr:  ErrRollbackCommit,
+		},
+		{
+			name:     "nothing to undo",
+			head:     c3,
+			rollback: Rollback{Target: c3, Pusher: pusher},
+			wantErr:  ErrRollbackEmpty,
+		},
+		{
+			name:     "no one",
+			head:     c3,
+			rollback: Rollback{Target: c1},
+			wantErr:  ErrRollbackAuthor,
+		},
+		{
+			name:     "no email",
+			head:     c3,
+			rollback: Rollback{Target: c1, Pusher: Pusher{Username: "ops"}},
+			wantErr:  ErrRollbackAuthor,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.rollback.RefName = "refs/heads/master"
+			c, err := test.rollback.Commit(sto, test.head)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("have: %v want: %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if c.OldHash != test.head || c.RefName != "refs/heads/master" || c.Author.Name != "ops" || c.Author.Email != "ops@10.0.0.1" || c.Author.When.IsZero() {
+				t.Fatalf("have: %s %s %v want: %s on refs/heads/master by ops@10.0.0.1", c.OldHash, c.RefName, c.Author, test.head)
+			}
+			if len(c.Files) != len(test.wantFiles) {
+				t.Fatalf("have: %v want: %v", c.Files, test.wantFiles)
+			}
+			for _, f := range c.Files {
+				want, ok := test.wantFiles[f.Path]
+				if !ok || f.Delete != (want == "") || string(f.Content) != want {
+					t.Fatalf("have: %s %q (delete %t) want: %q", f.Path, f.Content, f.Delete, want)
+				}
+			}
+		})
+	}
+
+	c, err := Rollback{RefName: "refs/heads/master", Target: c2, Revert: true, Reason: "two broke the build", Pusher: pusher}.Commit(sto, c3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMsg := "Revert \"two\"\n\nThis reverts commit " + c2 + ".\n\ntwo broke the build\n\nReverted-by: ops\n"
+	if c.Message != wantMsg {
+		t.Fatalf("have: %q want: %q", c.Message, wantMsg)
+	}
+	if v, ok := c.PushOptions.Get("revert"); !ok || v != c2 {
+		t.Fatalf("have: %v want: revert=%s", c.PushOptions, c2)
+	}
+
+	c, err = Rollback{RefName: "refs/heads/master", Target: c1, Author: object.Signature{Name: "Jo", Email: "jo@example.com"}}.Commit(sto, c3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(c.Message, "Roll back to \"one\"\n\nThis rolls back to commit "+c1) || strings.Contains(c.Message, "Rolled-back-by") {
+		t.Fatalf("have: %q want: a rollback to one without a pusher", c.Message)
+	}
+	if c.Author.Email != "jo@example.com" {
+		t.Fatalf("have: %v want: jo", c.Author)
+	}
+}
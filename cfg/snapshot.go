@@ -0,0 +1,236 @@
+package cfg
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// DefaultSnapshotInterval is how often the snapshots are saved when no interval is given
+const DefaultSnapshotInterval = time.Minute
+
+// Snapshots keeps the in-memory repositories of a registry as git bundles in a directory,
+// so they aren't lost on a restart. The bundle of a repository is at dir/<name>.bundle.
+// Repositories that are stored some other way are left alone, they are kept already.
+type Snapshots struct {
+	dir      string
+	interval time.Duration
+
+	mu    sync.Mutex
+	saved map[string]string // the refs of each repository when its bundle was written
+	err   error
+}
+
+// NewSnapshots returns snapshots that are kept in dir, and saved every interval by Run
+func NewSnapshots(dir string, interval time.Duration) *Snapshots {
+	if interval <= 0 {
+		interval = DefaultSnapshotInterval
+	}
+	return &Snapshots{dir: dir, interval: interval, saved: make(map[string]string)}
+}
+
+// Restore reads the bundles of the directory into the registry, it is done at startup
+// before the repositories are served. A repository that isn't in the registry is made
+// in memory, and one that is in memory already has its bundle read into it. The bundles
+// that can be read are, even when others can't.
+func (s *Snapshots) Restore(reg Registry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var first error
+	err := filepath.Walk(s.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, ".bundle") {
+			return nil
+		}
+		name, _ := filepath.Rel(s.dir, path)
+		name = strings.TrimSuffix(filepath.ToSlash(name), ".bundle")
+		if err := s.restore(reg, name, path); err != nil && first == nil {
+			first = err
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return ErrSnapshot.F(s.dir, err)
+	}
+	return first
+}
+
+// restore reads the bundle at path into the repository with the name
+func (s *Snapshots) restore(reg Registry, name, path string) error {
+	repo, ok := reg.Lookup(name)
+	if ok && !inMemory(repo) {
+		return nil
+	}
+	if !ok {
+		var err error
+		if repo, err = InitMemory(name); err != nil {
+			return ErrSnapshot.F(name, err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return ErrSnapshot.F(name, err)
+	}
+	defer f.Close()
+	if _, err := ReadBundle(f, repo.Storer); err != nil {
+		return ErrSnapshot.F(name, err)
+	}
+	if !ok {
+		if err := reg.Add(name, repo); err != nil {
+			return ErrSnapshot.F(name, err)
+		}
+	}
+	s.saved[name] = refState(repo)
+	return nil
+}
+
+// Save writes a bundle of each in-memory repository of the registry that has changed since
+// its bundle was written. The bundle of a repository that was removed from the registry, or
+// whose refs were all deleted, is removed too.
+func (s *Snapshots) Save(reg Registry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var first error
+	names := make(map[string]bool)
+	for _, name := range reg.List() {
+		names[name] = true
+		repo, ok := reg.Lookup(name)
+		if !ok || !inMemory(repo) {
+			continue
+		}
+		state := refState(repo)
+		if state == s.saved[name] {
+			continue // not changed
+		}
+		if state == "" {
+			// every ref was deleted, so the old bundle would bring them back
+			if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+				if first == nil {
+					first = ErrSnapshot.F(name, err)
+				}
+				continue
+			}
+			delete(s.saved, name)
+			continue
+		}
+		if err := s.save(name, repo); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		s.saved[name] = state
+	}
+	for name := range s.saved {
+		if !names[name] {
+			if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) && first == nil {
+				first = ErrSnapshot.F(name, err)
+			}
+			delete(s.saved, name)
+		}
+	}
+	s.err = first
+	return first
+}
+
+// save writes the bundle of the repository, to a temporary file that is moved over the
+// old bundle once it is all written
+func (s *Snapshots) save(name string, repo *git.Repository) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return ErrSnapshot.F(name, err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".snapshot-")
+	if err != nil {
+		return ErrSnapshot.F(name, err)
+	}
+	defer os.Remove(f.Name()) // a no-op once it is renamed
+
+	if err := WriteBundle(f, repo.Storer); err != nil {
+		f.Close()
+		return ErrSnapshot.F(name, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return ErrSnapshot.F(name, err)
+	}
+	if err := f.Close(); err != nil {
+		return ErrSnapshot.F(name, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return ErrSnapshot.F(name, err)
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir syncs the directory, so a file that was moved into it stays there
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Run saves the snapshots every interval until ctx is done, and then once more so that
+// the last pushes are kept. A save that fails is tried again on the next interval, it
+// can be seen with Err. The error of the last save is returned.
+func (s *Snapshots) Run(ctx context.Context, reg Registry) error {
+	tick := time.NewTicker(s.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return s.Save(reg)
+		case <-tick.C:
+			s.Save(reg)
+		}
+	}
+}
+
+// Err returns the error of the last save, or nil when it worked
+func (s *Snapshots) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// path returns the file of the bundle of the repository
+func (s *Snapshots) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name)+".bundle")
+}
+
+// inMemory reports if the repository is stored in memory
+func inMemory(repo *git.Repository) bool {
+	_, ok := repo.Storer.(*memory.Storage)
+	return ok
+}
+
+// refState returns where the refs of the repository are, to tell if it has changed. It is
+// empty when there are no refs.
+func refState(repo *git.Repository) string {
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return ""
+	}
+	var refs []string
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs = append(refs, ref.String())
+		}
+		return nil
+	})
+	sort.Strings(refs)
+	return strings.Join(refs, "\n")
+}
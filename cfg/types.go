@@ -1,27 +1,83 @@
 package cfg /* import "gopkg.xa4b.com/git/cfg" */
 
 import (
+	"context"
 	"io"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
 )
 
-// ReceivePackData holds the receive-pack data that's sent to the 'pre' and 'post' receive-pack hooks
-type ReceivePackData struct{ OldHash, NewHash, RefName string }
+// ReceivePackData holds the receive-pack data that's sent to the 'pre' and 'post' receive-pack hooks. The helpers Kind, Commits and Changes read from the repository, and are worked out the first time they are called.
+type ReceivePackData struct {
+	OldHash, NewHash, RefName string
+
+	changes *changes
+}
+
+// String returns the data the way git passes it to a hook: <old> <new> <ref>
+func (d ReceivePackData) String() string { return d.OldHash + " " + d.NewHash + " " + d.RefName }
 
-// ReceivePackHookData holds all of the data needed to interact with the receive-pack hooks. This data cannot be changed, it is read-only.
+// ReceivePackHookData holds all of the data needed to interact with the receive-pack hooks. This data cannot be changed, it is read-only. When the push is to a namespace of the repository the Namespace is set, and the refs are the ones in the namespace.
 type ReceivePackHookData struct {
-	RepoName string
-	Refs     []ReceivePackData
+	RepoName    string
+	Namespace   string
+	Refs        []ReceivePackData
+	PushOptions PushOptions
+	Pusher      Pusher
 }
 
-// PreReceivePackHookData is a wrapper around the ReceivePackHookData for the pre-receive-pack hook.
+// Pusher is who is pushing, as far as the transport knows. Over HTTP the username and auth method are set by auth middleware, over SSH they come from the connection. The key fingerprint is only set for SSH public keys (in the SHA256:... form), and the agent is the one that the git client sent (i.e. git/2.39.0).
+type Pusher struct {
+	Username       string
+	AuthMethod     string
+	KeyFingerprint string
+	RemoteAddr     string
+	Agent          string
+}
+
+// PreReceivePackHookData is a wrapper around the ReceivePackHookData for the pre-receive-pack hook. The Repository is a read-only view of the repository with the pushed objects in it, so the hook can read the new commits before they are accepted. The references are the ones from before the push.
 type PreReceivePackHookData struct {
 	ReceivePackHookData
+	Repository *git.Repository
 }
 
-// PostReceivePackHookData is a wrapper around the ReceivePackHookData for the post-receive-pack hook. It also includes any push-options that may have been included.
+// PostReceivePackHookData is a wrapper around the ReceivePackHookData for the post-receive-pack hook.
 type PostReceivePackHookData struct {
 	ReceivePackHookData
-	PushOptions map[string]string
+}
+
+// PushOption is a single push-option sent with: git push -o key=value. An option without an '=' has an empty value.
+type PushOption struct{ Key, Value string }
+
+// NewPushOption splits the push-option s into its key and value
+func NewPushOption(s string) PushOption {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) == 1 {
+		return PushOption{Key: kv[0]}
+	}
+	return PushOption{Key: kv[0], Value: kv[1]}
+}
+
+// String returns the push-option the way it was sent by the client
+func (o PushOption) String() string {
+	if o.Value == "" {
+		return o.Key
+	}
+	return o.Key + "=" + o.Value
+}
+
+// PushOptions holds all of the push-options in the order they were sent by the client
+type PushOptions []PushOption
+
+// Get returns the value of the last push-option sent with the key, and if the key was sent at all.
+func (po PushOptions) Get(key string) (string, bool) {
+	for i := len(po) - 1; i >= 0; i-- {
+		if po[i].Key == key {
+			return po[i].Value, true
+		}
+	}
+	return "", false
 }
 
 // ReceivePackHookError represents 60 characters of a string that will be displayed as rejected text to git, use the RejectText() method to manipulate this string.
@@ -36,8 +92,66 @@ func (e *ReceivePackHookError) Error() string { return e.String() }
 // RejectText accepts a string that will be written to the git output when rejected. Only the first 60 characters of a string will be used.
 func (e *ReceivePackHookError) RejectText(s string) { copy(e[:], []rune(s)) }
 
+// ReceivePackRefResult is the decision of a pre-receive hook for a single ref. The reason a ref is rejected can be any length and have more than one line.
+type ReceivePackRefResult struct {
+	ReceivePackData
+	Rejected bool
+	Reason   string
+}
+
+// PreReceivePackHookResult holds the decisions of a pre-receive hook for the refs of a push. A ref without a decision is accepted.
+type PreReceivePackHookResult struct {
+	Refs []ReceivePackRefResult
+}
+
+// Accept accepts the ref, replacing any earlier decision for it
+func (r *PreReceivePackHookResult) Accept(ref ReceivePackData) {
+	r.set(ReceivePackRefResult{ReceivePackData: ref})
+}
+
+// Reject rejects the ref with the reason, replacing any earlier decision for it
+func (r *PreReceivePackHookResult) Reject(ref ReceivePackData, reason string) {
+	r.set(ReceivePackRefResult{ReceivePackData: ref, Rejected: true, Reason: reason})
+}
+
+// Rejected returns the reason the ref named refName was rejected, and if it was rejected at all
+func (r *PreReceivePackHookResult) Rejected(refName string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	for _, res := range r.Refs {
+		if res.RefName == refName {
+			return res.Reason, res.Rejected
+		}
+	}
+	return "", false
+}
+
+// set adds the decision for a ref, or replaces the one that is there
+func (r *PreReceivePackHookResult) set(res ReceivePackRefResult) {
+	for i := range r.Refs {
+		if r.Refs[i].RefName == res.RefName {
+			r.Refs[i] = res
+			return
+		}
+	}
+	r.Refs = append(r.Refs, res)
+}
+
 // PreReceivePackHookFunc a type describing the pre-receive-pack hook callback
 type PreReceivePackHookFunc func(io.Writer, *PreReceivePackHookData) (string, *ReceivePackHookError)
 
+// PreReceivePackRefHookFunc a type describing the pre-receive-pack hook callback that accepts or rejects each ref on its own
+type PreReceivePackRefHookFunc func(io.Writer, *PreReceivePackHookData) *PreReceivePackHookResult
+
+// PreReceivePackHookContextFunc is a PreReceivePackHookFunc that is passed a context, which is done when the client goes away or the hook times out
+type PreReceivePackHookContextFunc func(context.Context, io.Writer, *PreReceivePackHookData) (string, *ReceivePackHookError)
+
+// PreReceivePackRefHookContextFunc is a PreReceivePackRefHookFunc that is passed a context, which is done when the client goes away or the hook times out
+type PreReceivePackRefHookContextFunc func(context.Context, io.Writer, *PreReceivePackHookData) *PreReceivePackHookResult
+
 // PostReceivePackHookFunc a type describing the post-receive-pack hook callback
 type PostReceivePackHookFunc func(io.Writer, *PostReceivePackHookData)
+
+// PostReceivePackHookContextFunc is a PostReceivePackHookFunc that is passed a context, which is done when the client goes away or the hook times out
+type PostReceivePackHookContextFunc func(context.Context, io.Writer, *PostReceivePackHookData)
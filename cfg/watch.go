@@ -0,0 +1,250 @@
+package cfg
+
+import (
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// ChangeEvent is a change to a file on a ref that a subscription watches. The old content
+// is nil when the file was added, and the new content is nil when it was deleted. The
+// commits are the ones the ref moved from and to, a zero hash when it was created or deleted.
+type ChangeEvent struct {
+	RepoName, RefName    string
+	OldCommit, NewCommit string
+
+	Path       string
+	Action     FileAction
+	OldContent []byte
+	NewContent []byte
+}
+
+// Watchers sends the file changes of the pushes to a repository to the subscriptions that
+// watch them. The events of a repository are sent in the order the pushes were published,
+// and publishing never waits on a subscriber. The zero value is ready to use.
+type Watchers struct {
+	mu    sync.Mutex
+	subs  []*Subscription
+	repos map[string][]publication // the publications waiting per repository
+}
+
+// publication is a push to a repository that is waiting to be sent
+type publication struct {
+	sto  storer.EncodedObjectStorer
+	refs []ReceivePackData
+}
+
+// Subscribe returns a subscription to the changes to the files that match the path glob on
+// the ref of the repository (see MatchPath). An empty ref name watches every ref. The events
+// are held for a slow subscriber until it reads them, so it should read until it calls Close.
+func (w *Watchers) Subscribe(repoName, refName, glob string) *Subscription {
+	s := &Subscription{
+		RepoName: repoName, RefName: refName, Glob: glob,
+		w: w, c: make(chan ChangeEvent), done: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+
+	w.mu.Lock()
+	w.subs = append(w.subs, s)
+	w.mu.Unlock()
+	return s
+}
+
+// Publish queues the refs that a push updated in the repository, the file changes are read
+// from the storage sto and sent to the subscriptions in the background.
+func (w *Watchers) Publish(repoName string, sto storer.EncodedObjectStorer, refs []ReceivePackData) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(refs) == 0 || !w.watched(repoName) {
+		return
+	}
+	if w.repos == nil {
+		w.repos = make(map[string][]publication)
+	}
+
+	queue, running := w.repos[repoName]
+	w.repos[repoName] = append(queue, publication{sto: sto, refs: refs})
+	if !running {
+		go w.send(repoName)
+	}
+}
+
+// watched returns if any subscription watches the repository, w.mu must be held
+func (w *Watchers) watched(repoName string) bool {
+	for _, s := range w.subs {
+		if s.RepoName == repoName {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends the publications of the repository one at a time, until there are none left.
+// There is only one of these running for a repository, that is what keeps the events in order.
+func (w *Watchers) send(repoName string) {
+	for {
+		w.mu.Lock()
+		queue := w.repos[repoName]
+		if len(queue) == 0 {
+			delete(w.repos, repoName)
+			w.mu.Unlock()
+			return
+		}
+		pub := queue[0]
+		w.repos[repoName] = queue[1:]
+		w.mu.Unlock()
+
+		for _, ref := range pub.refs {
+			w.sendRef(repoName, pub.sto, ref)
+		}
+	}
+}
+
+// sendRef sends the file changes of the ref to the subscriptions that watch them
+func (w *Watchers) sendRef(repoName string, sto storer.EncodedObjectStorer, ref ReceivePackData) {
+	w.mu.Lock()
+	var subs []*Subscription
+	for _, s := range w.subs {
+		if s.RepoName == repoName && (s.RefName == "" || s.RefName == ref.RefName) {
+			subs = append(subs, s)
+		}
+	}
+	w.mu.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	oldTree, newTree := tree(sto, ref.OldHash), tree(sto, ref.NewHash)
+	if oldTree == nil && newTree == nil {
+		return // neither side has files, i.e. a tag of a blob
+	}
+	diff, err := object.DiffTree(oldTree, newTree)
+	if err != nil {
+		return
+	}
+
+	for _, change := range diff {
+		file, err := fileChange(change)
+		if err != nil {
+			continue
+		}
+		var ev *ChangeEvent
+		for _, s := range subs {
+			if !MatchPath(s.Glob, file.Path) {
+				continue
+			}
+			if ev == nil {
+				ev = &ChangeEvent{
+					RepoName: repoName, RefName: ref.RefName, OldCommit: ref.OldHash, NewCommit: ref.NewHash,
+					Path: file.Path, Action: file.Action,
+				}
+				from, to, _ := change.Files()
+				ev.OldContent, ev.NewContent = contents(from), contents(to)
+			}
+			s.push(*ev)
+		}
+	}
+}
+
+// tree returns the tree of the commit of h, or nil when there is none
+func tree(sto storer.EncodedObjectStorer, h string) *object.Tree {
+	if h == plumbing.ZeroHash.String() {
+		return nil
+	}
+	commit := peel(sto, plumbing.NewHash(h))
+	if commit == nil {
+		return nil
+	}
+	t, err := commit.Tree()
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+// contents returns the contents of the file, or nil when there is no file
+func contents(f *object.File) []byte {
+	if f == nil {
+		return nil
+	}
+	s, err := f.Contents()
+	if err != nil {
+		return nil
+	}
+	return []byte(s)
+}
+
+// Subscription is a subscription to the changes to the files of a repository
+type Subscription struct {
+	RepoName, RefName, Glob string
+
+	w *Watchers
+	c chan ChangeEvent
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []ChangeEvent
+	closed bool
+	done   chan struct{}
+}
+
+// Events returns the channel that the change events are sent on, it is closed by Close
+func (s *Subscription) Events() <-chan ChangeEvent { return s.c }
+
+// Close stops the subscription, the events that haven't been read are dropped
+func (s *Subscription) Close() {
+	s.w.mu.Lock()
+	for i, sub := range s.w.subs {
+		if sub == s {
+			s.w.subs = append(s.w.subs[:i], s.w.subs[i+1:]...)
+			break
+		}
+	}
+	s.w.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+		s.cond.Broadcast()
+	}
+}
+
+// push adds the event to the queue of the subscription, it doesn't wait for it to be read
+func (s *Subscription) push(ev ChangeEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.queue = append(s.queue, ev)
+	s.cond.Signal()
+}
+
+// run sends the queued events on the channel in order, until the subscription is closed
+func (s *Subscription) run() {
+	defer close(s.c)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		ev := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.c <- ev:
+		case <-s.done:
+			return
+		}
+	}
+}
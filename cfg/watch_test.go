@@ -0,0 +1,107 @@
+package cfg
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestWatchers(t *testing.T) {
+	sto := memory.NewStorage()
+	fs := memfs.New()
+	repo, err := git.Init(sto, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func(files map[string]string, remove ...string) string {
+		for name, contents := range files {
+			if err := util.WriteFile(fs, name, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			wt.Add(name)
+		}
+		for _, name := range remove {
+			wt.Remove(name)
+		}
+		sig := &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+		h, err := wt.Commit("commit", &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.String()
+	}
+	zero := plumbing.ZeroHash.String()
+	c1 := commit(map[string]string{"a.toml": "a = 1\n", "readme.md": "hi"})
+	c2 := commit(map[string]string{"a.toml": "a = 2\n", "b/b.toml": "b = 1\n"})
+	c3 := commit(nil, "a.toml")
+
+	var w Watchers
+	sub := w.Subscribe("config", "refs/heads/master", "**/*.toml")
+	defer sub.Close()
+	slow := w.Subscribe("config", "", "**") // never read
+	defer slow.Close()
+	other := w.Subscribe("other", "", "**")
+	defer other.Close()
+
+	pushes := [][]ReceivePackData{
+		{{OldHash: zero, NewHash: c1, RefName: "refs/heads/master"}},
+		{{OldHash: c1, NewHash: c2, RefName: "refs/heads/master"}, {OldHash: zero, NewHash: c2, RefName: "refs/heads/dev"}},
+		{{OldHash: c2, NewHash: c3, RefName: "refs/heads/master"}},
+	}
+	for _, refs := range pushes {
+		published := make(chan struct{})
+		go func(refs []ReceivePackData) {
+			w.Publish("config", sto, refs)
+			close(published)
+		}(refs)
+		select {
+		case <-published:
+		case <-time.After(time.Second):
+			t.Fatal("publish waited on a subscriber")
+		}
+	}
+
+	want := []ChangeEvent{
+		{RefName: "refs/heads/master", OldCommit: zero, NewCommit: c1, Path: "a.toml", Action: FileAdd, NewContent: []byte("a = 1\n")},
+		{RefName: "refs/heads/master", OldCommit: c1, NewCommit: c2, Path: "a.toml", Action: FileModify, OldContent: []byte("a = 1\n"), NewContent: []byte("a = 2\n")},
+		{RefName: "refs/heads/master", OldCommit: c1, NewCommit: c2, Path: "b/b.toml", Action: FileAdd, NewContent: []byte("b = 1\n")},
+		{RefName: "refs/heads/master", OldCommit: c2, NewCommit: c3, Path: "a.toml", Action: FileDelete, OldContent: []byte("a = 2\n")},
+	}
+	for _, wantEv := range want {
+		wantEv.RepoName = "config"
+		select {
+		case ev := <-sub.Events():
+			if ev.RefName != wantEv.RefName || ev.OldCommit != wantEv.OldCommit || ev.NewCommit != wantEv.NewCommit ||
+				ev.Path != wantEv.Path || ev.Action != wantEv.Action ||
+				string(ev.OldContent) != string(wantEv.OldContent) || string(ev.NewContent) != string(wantEv.NewContent) {
+				t.Fatalf("have: %+v want: %+v", ev, wantEv)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want: %+v", wantEv)
+		}
+	}
+
+	select {
+	case ev := <-sub.Events():
+		t.Fatalf("have: %+v want: no more events", ev)
+	case ev := <-other.Events():
+		t.Fatalf("have: %+v want: no events for another repository", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sub.Close()
+	if _, ok := <-sub.Events(); ok {
+		t.Fatal("want the events closed")
+	}
+}
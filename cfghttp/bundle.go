@@ -0,0 +1,18 @@
+package cfghttp
+
+import (
+	"context"
+	"io"
+
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// ExportBundle writes the repository to w as a git bundle, see cfg.WriteBundle
+func (s *GoGitServer) ExportBundle(w io.Writer, repoName string) error {
+	return s.srv.ExportBundle(w, repoName)
+}
+
+// ImportBundle reads the git bundle r into the repository, see protocol.Server.ImportBundle
+func (s *GoGitServer) ImportBundle(ctx context.Context, w io.Writer, repoName string, r io.Reader) ([]cfg.ReceivePackData, error) {
+	return s.srv.ImportBundle(ctx, w, repoName, r)
+}
@@ -0,0 +1,18 @@
+package cfghttp
+
+import (
+	"context"
+	"io"
+
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// Commit makes the commit c on a ref of the repository, see protocol.Server.Commit
+func (s *GoGitServer) Commit(ctx context.Context, w io.Writer, repoName string, c cfg.Commit) (string, error) {
+	return s.srv.Commit(ctx, w, repoName, c)
+}
+
+// Rollback undoes changes to a ref of the repository, see protocol.Server.Rollback
+func (s *GoGitServer) Rollback(ctx context.Context, w io.Writer, repoName string, r cfg.Rollback) (string, error) {
+	return s.srv.Rollback(ctx, w, repoName, r)
+}
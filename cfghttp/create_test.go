@@ -0,0 +1,115 @@
+package cfghttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+func TestCreateOnPush(t *testing.T) {
+	reg := cfg.NewMapRegistry(nil)
+	gs := LoadRegistry(reg, "file:///")
+	srv := httptest.NewServer(NewServer(gs,
+		WithCreateOnPush(cfg.CreateOnPush{Authorize: func(_ context.Context, _ string, p cfg.Pusher) error {
+			if p.Username != "team" {
+				return errors.New("not on the team")
+			}
+			return nil
+		}}),
+		WithMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				username, _, _ := r.BasicAuth()
+				next.ServeHTTP(w, SetPusher(r, cfg.Pusher{Username: username}))
+			})
+		}),
+	))
+	defer srv.Close()
+
+	infoRefs := func(repoName, service, username string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/"+repoName+"/info/refs?service="+service, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(username, "")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		name     string
+		repoName string
+		service  string
+		username string
+		status   int
+	}{
+		{name: "advertised to the team", repoName: "new", service: "git-receive-pack", username: "team", status: http.StatusOK},
+		{name: "not allowed to make it", repoName: "new", service: "git-receive-pack", username: "other", status: http.StatusForbidden},
+		{name: "nothing to fetch", repoName: "new", service: "git-upload-pack", username: "team", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := infoRefs(test.repoName, test.service, test.username); status != test.status {
+				t.Fatalf("have: %d want: %d", status, test.status)
+			}
+		})
+	}
+	if _, ok := reg.Lookup("new"); ok {
+		t.Fatal("have: new want: the repository only made by a push")
+	}
+
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.WriteFile(fs, "configuration.toml", []byte("a = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add("configuration.toml"); err != nil {
+		t.Fatal(err)
+	}
+	sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1e9, 0)}
+	h, err := wt.Commit("commit", &git.CommitOptions{Author: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{srv.URL + "/new"}}); err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Push(&git.PushOptions{
+		RefSpecs: []config.RefSpec{"refs/heads/master:refs/heads/master"},
+		Auth:     &githttp.BasicAuth{Username: "team"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	made, ok := reg.Lookup("new")
+	if !ok {
+		t.Fatal("have: nothing want: the repository made by the push")
+	}
+	if ref, err := made.Reference("refs/heads/master", false); err != nil || ref.Hash() != h {
+		t.Fatalf("have: %v %v want: master at %s", ref, err, h)
+	}
+}
@@ -3,22 +3,24 @@ package cfghttp
 import (
 	"errors"
 	"fmt"
+
+	"gopkg.xa4b.com/git/protocol"
 )
 
 // all provided errors
 const (
-	ErrSession         strErr = "%s session: %v"
 	ErrSessionAdvRefs  strErr = "%s session advertised references: %v"
+	ErrAdvertise       strErr = "%s advertise capabilities: %v"
 	ErrPackDecode      strErr = "pack decode: %v"
 	ErrPackScanAdvRefs strErr = "pack scan [1] advertised references: %v"
 
 	ErrReceivePack       strErr = "bad receive pack: %v"
+	ErrPushOptions       strErr = "bad push-options: %v"
 	ErrUploadPackRequest strErr = "bad upload pack: %v"
 	ErrUploadPack        strErr = "bad upload pack: %v"
 
-	ErrTransportEndpoint strErr = "repo [%s] endpoint invalid: %v"
-	ErrNoServiceFound    strErr = "no service found"
-	ErrEmptyHookData     strErr = "empty receive-pack hook data"
+	ErrNoServiceFound strErr = "no service found"
+	ErrEmptyHookData  strErr = "empty receive-pack hook data"
 )
 
 // strErr provides an error wrapper for strings with an option to
@@ -68,3 +70,18 @@ func (e fmtErr) Error() string { return fmt.Sprintf(e.err.Error(), e.v...) }
 
 // Unwrap is a method to help unwrap errors to the base error for go1.13
 func (e fmtErr) Unwrap() error { return errors.Unwrap(e.err) }
+
+// the errors of the server that the transport is built on, see protocol.Server
+const (
+	ErrSession           = protocol.ErrSession
+	ErrTransportEndpoint = protocol.ErrEndpoint
+	ErrNamespace         = protocol.ErrRepoNamespace
+
+	ErrCommitRejected = protocol.ErrCommitRejected
+	ErrCommitStale    = protocol.ErrCommitStale
+	ErrCommitFailed   = protocol.ErrCommitFailed
+
+	ErrMirrorPush  = protocol.ErrMirrorPush
+	ErrNotMirror   = protocol.ErrNotMirror
+	ErrMirrorFetch = protocol.ErrMirrorFetch
+)
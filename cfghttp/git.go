@@ -2,6 +2,7 @@ package cfghttp
 
 import (
 	"net/http"
+	"time"
 
 	"gopkg.xa4b.com/git/cfg"
 )
@@ -17,6 +18,46 @@ type GitServer interface {
 	WithPostReceiveHook(cfg.PostReceivePackHookFunc)
 }
 
+// The optional interfaces below are what a GitServer implements for the server options
+// that need more than the GitServer interface, GoGitServer implements all of them. An
+// option is ignored when the GitServer doesn't implement its interface.
+
+// HookGitServer is a GitServer with the hooks that are passed a context, the per-ref
+// pre-receive hooks and the hook timeouts
+type HookGitServer interface {
+	WithPreReceiveHookContext(cfg.PreReceivePackHookContextFunc)
+	WithPreReceiveRefHook(cfg.PreReceivePackRefHookFunc)
+	WithPreReceiveRefHookContext(cfg.PreReceivePackRefHookContextFunc)
+	WithPostReceiveHookContext(cfg.PostReceivePackHookContextFunc)
+	WithHookTimeouts(pre, post time.Duration)
+}
+
+// LimitGitServer is a GitServer that limits the push-options and the packfile of a push
+type LimitGitServer interface {
+	WithPushOptionsLimit(count, size int)
+	WithPackLimits(maxSize, spillSize int64)
+}
+
+// ReplicaGitServer is a GitServer that sends the refs that each push updates to a replicator
+type ReplicaGitServer interface {
+	WithReplicator(cfg.Replicator)
+}
+
+// MirrorGitServer is a GitServer that serves read-only mirrors of upstream repositories
+type MirrorGitServer interface {
+	WithMirror(repoName string, m cfg.Mirror)
+}
+
+// CreateGitServer is a GitServer that makes a repository the first time it is pushed to
+type CreateGitServer interface {
+	WithCreateOnPush(cfg.CreateOnPush)
+}
+
+// NamespaceGitServer is a GitServer that serves the requests from git namespaces
+type NamespaceGitServer interface {
+	WithNamespace(cfg.NamespaceFunc)
+}
+
 // InfoRefser returns HTTP requests for '/info/ref'
 type InfoRefser interface {
 	DoHTTP(http.ResponseWriter, *http.Request) InfoRefser
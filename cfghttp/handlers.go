@@ -1,25 +1,34 @@
 package cfghttp
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.xa4b.com/git/cfg"
 )
 
 // InfoRefsHandler handles HTTP requests for 'info-refs/'
 func (s *Server) InfoRefsHandler(w http.ResponseWriter, r *http.Request) {
-	refs := s.git.NewInfoRefs(chi.URLParam(r, "repoName"))
+	refs := s.git.NewInfoRefs(repoName(r))
 	refs.DoHTTP(w, r)
 
-	if refs.Err() != nil {
+	switch err := refs.Err(); {
+	case err == nil:
+	case errors.Is(err, cfg.ErrCreateDenied):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	default:
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
 	}
 }
 
 // ReceivePackHandler handles HTTP requests for 'receive-pack/'
 func (s *Server) ReceivePackHandler(w http.ResponseWriter, r *http.Request) {
-	pack := s.git.NewReceivePack(chi.URLParam(r, "repoName"))
+	pack := s.git.NewReceivePack(repoName(r))
 	defer pack.Cleanup()
 
 	pack.DoHTTP(w, r)
@@ -32,7 +41,7 @@ func (s *Server) ReceivePackHandler(w http.ResponseWriter, r *http.Request) {
 
 // UploadPackHandler handles HTTP requests for 'upload-pack/'
 func (s *Server) UploadPackHandler(w http.ResponseWriter, r *http.Request) {
-	pack := s.git.NewUploadPack(chi.URLParam(r, "repoName"))
+	pack := s.git.NewUploadPack(repoName(r))
 	defer pack.Cleanup()
 
 	pack.DoHTTP(w, r)
@@ -42,3 +51,33 @@ func (s *Server) UploadPackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// nestedHandler handles the HTTP requests of repositories with a "/" in their name, which
+// the {repoName} routes don't match
+func (s *Server) nestedHandler(w http.ResponseWriter, r *http.Request) {
+	path := chi.URLParam(r, "*")
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/info/refs"):
+		s.InfoRefsHandler(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/git-receive-pack"):
+		s.ReceivePackHandler(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/git-upload-pack"):
+		s.UploadPackHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// repoName returns the name of the repository of the request
+func repoName(r *http.Request) string {
+	if name := chi.URLParam(r, "repoName"); name != "" {
+		return name
+	}
+	name := chi.URLParam(r, "*")
+	for _, suffix := range []string{"/info/refs", "/git-receive-pack", "/git-upload-pack"} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return ""
+}
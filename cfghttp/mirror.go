@@ -0,0 +1,27 @@
+package cfghttp
+
+import (
+	"context"
+	"io"
+
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// WithMirror makes the repository a read-only mirror of the upstream m, pushes and commits
+// to it are rejected with the URL of the upstream. The repository must be in the registry
+// of the server. The refs are fetched with FetchMirror, or every interval by RunMirrors.
+// Mirrors are set up before the server is used.
+func (s *GoGitServer) WithMirror(repoName string, m cfg.Mirror) {
+	s.srv.SetMirror(repoName, m)
+}
+
+// RunMirrors fetches each mirror from its upstream right away and then every interval,
+// until ctx is done. A fetch that fails is logged and tried again on the next interval.
+func (s *GoGitServer) RunMirrors(ctx context.Context) {
+	s.srv.RunMirrors(ctx)
+}
+
+// FetchMirror moves the refs of the mirror to its upstream, see protocol.Server.FetchMirror
+func (s *GoGitServer) FetchMirror(ctx context.Context, w io.Writer, repoName string) ([]cfg.ReceivePackData, error) {
+	return s.srv.FetchMirror(ctx, w, repoName)
+}
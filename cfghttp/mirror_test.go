@@ -0,0 +1,106 @@
+package cfghttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+func TestFetchMirror(t *testing.T) {
+	ctx := context.Background()
+	newRepo := func() *git.Repository {
+		repo, err := git.Init(memory.NewStorage(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	}
+
+	upRepo := newRepo()
+	up := LoadGoGit(map[string]*git.Repository{"config": upRepo}, "file:///")
+	srv := httptest.NewServer(NewServer(up))
+	defer srv.Close()
+
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1e9, 0)}
+	commit := func(refName, oldHash, content string) string {
+		t.Helper()
+		h, err := up.Commit(ctx, nil, "config", cfg.Commit{
+			RefName: refName,
+			OldHash: oldHash,
+			Files:   []cfg.CommitFile{{Path: "configuration.toml", Content: []byte(content)}},
+			Message: "commit",
+			Author:  sig,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	master := commit("refs/heads/master", "", "a = 1\n")
+	dev := commit("refs/heads/dev", "", "a = 2\n")
+
+	mirRepo := newRepo()
+	mir := LoadGoGit(map[string]*git.Repository{"config": mirRepo}, "file:///")
+	var post []*cfg.PostReceivePackHookData
+	mir.WithPostReceiveHook(func(_ io.Writer, data *cfg.PostReceivePackHookData) {
+		post = append(post, data)
+	})
+	mir.WithMirror("config", cfg.Mirror{URL: srv.URL + "/config"})
+
+	if _, err := mir.FetchMirror(ctx, nil, "other"); !errors.Is(err, ErrNotMirror) {
+		t.Fatalf("have: %v want: %v", err, ErrNotMirror)
+	}
+
+	refs, err := mir.FetchMirror(ctx, nil, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 || refs[0].RefName != "refs/heads/dev" || refs[0].NewHash != dev || refs[1].NewHash != master {
+		t.Fatalf("have: %v want: dev at %s and master at %s", refs, dev, master)
+	}
+	if ref, err := mirRepo.Reference("refs/heads/master", true); err != nil || ref.Hash().String() != master {
+		t.Fatalf("have: %v %v want: master at %s", ref, err, master)
+	}
+	if len(post) != 1 {
+		t.Fatalf("have: %d want: one post-receive", len(post))
+	}
+	if url, _ := post[0].PushOptions.Get("mirror"); url != srv.URL+"/config" {
+		t.Fatalf("have: %q want: %q", url, srv.URL+"/config")
+	}
+
+	// nothing moved upstream
+	if refs, err := mir.FetchMirror(ctx, nil, "config"); err != nil || len(refs) != 0 {
+		t.Fatalf("have: %v %v want: no refs moved", refs, err)
+	}
+
+	// a ref that moves upstream moves, and one that is removed is removed
+	master2 := commit("refs/heads/master", master, "a = 3\n")
+	if err := upRepo.Storer.RemoveReference("refs/heads/dev"); err != nil {
+		t.Fatal(err)
+	}
+	refs, err = mir.FetchMirror(ctx, nil, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 || refs[0].NewHash != plumbing.ZeroHash.String() || refs[1].OldHash != master || refs[1].NewHash != master2 {
+		t.Fatalf("have: %v want: dev removed and master from %s to %s", refs, master, master2)
+	}
+	if _, err := mirRepo.Reference("refs/heads/dev", false); err != plumbing.ErrReferenceNotFound {
+		t.Fatalf("have: %v want: %v", err, plumbing.ErrReferenceNotFound)
+	}
+
+	// the mirror is read-only
+	_, err = mir.Commit(ctx, nil, "config", cfg.Commit{RefName: "refs/heads/master", OldHash: master2, Author: sig})
+	if !errors.Is(err, ErrCommitRejected) {
+		t.Fatalf("have: %v want: %v", err, ErrCommitRejected)
+	}
+}
@@ -0,0 +1,9 @@
+package cfghttp
+
+import "gopkg.xa4b.com/git/cfg"
+
+// WithNamespace serves the requests from git namespaces of the repositories, fn picks the
+// repository and the namespace of each request, see cfg.NamespaceFunc
+func (s *GoGitServer) WithNamespace(fn cfg.NamespaceFunc) {
+	s.srv.NamespaceFunc = fn
+}
@@ -0,0 +1,34 @@
+package cfghttp
+
+import (
+	"context"
+	"net/http"
+
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// pusherKey is the context key for the pusher that auth middleware sets
+type pusherKey struct{}
+
+// SetPusher returns a shallow copy of r that carries who is pushing. Auth middleware
+// (see WithMiddleware) calls it once the user is known, so that the receive-pack
+// hooks can see who they are. The remote address is filled in from r when it is empty.
+func SetPusher(r *http.Request, p cfg.Pusher) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pusherKey{}, p))
+}
+
+// pusher returns who is pushing with the request r. Without auth middleware that
+// called SetPusher only the remote address and the agent are known.
+func pusher(r *http.Request, agent string) cfg.Pusher {
+	p, _ := r.Context().Value(pusherKey{}).(cfg.Pusher)
+	if p.RemoteAddr == "" {
+		p.RemoteAddr = r.RemoteAddr
+	}
+	if p.Agent == "" {
+		p.Agent = agent
+	}
+	if p.Agent == "" {
+		p.Agent = r.UserAgent()
+	}
+	return p
+}
@@ -35,6 +35,10 @@ func NewServer(gs GitServer, opts ...ServerOption) http.Handler {
 	s.mux.Post(fmt.Sprintf("/git-upload-pack"), s.UploadPackHandler)
 	s.mux.Post(fmt.Sprintf("/{repoName}/git-upload-pack"), s.UploadPackHandler)
 
+	// repositories with nested names, such as team/config
+	s.mux.Get("/*", s.nestedHandler)
+	s.mux.Post("/*", s.nestedHandler)
+
 	return s
 }
 
@@ -3,51 +3,56 @@ package cfghttp
 // This file wraps around the go-git library to create a GitServer interface
 
 import (
-	"bufio"
-	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	logg "log"
 	"net/http"
-	"strings"
+	"time"
 
 	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
 	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
-	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
 	"gopkg.xa4b.com/git/cfg"
 	"gopkg.xa4b.com/git/pktline"
+	"gopkg.xa4b.com/git/protocol"
 )
 
 // LoadGoGit loads a mapping of git repositories (go-git) to a repository endpoint
 func LoadGoGit(m map[string]*git.Repository, endpoint string) *GoGitServer {
-	ml := make(server.MapLoader)
-	for k, v := range m {
-		ml[endpoint+k] = v.Storer
-	}
+	return LoadRegistry(cfg.NewMapRegistry(m), endpoint)
+}
 
+// LoadRegistry loads the git repositories (go-git) of the registry to a repository endpoint.
+// Repositories that are added to the registry, or removed from it, are served right away.
+func LoadRegistry(reg cfg.Registry, endpoint string) *GoGitServer {
 	caps := []capability.Capability{
 		capability.Sideband,
 		capability.Sideband64k,
 		capability.PushOptions,
+		capability.Atomic,
 	}
 
-	return &GoGitServer{repos: m, transport: server.NewServer(ml), endpoint: endpoint, capabilities: caps, log: log{}}
+	return &GoGitServer{
+		srv: protocol.NewServer(reg, endpoint), capabilities: caps, log: log{},
+		maxPushOptions:    protocol.DefaultMaxPushOptions,
+		maxPushOptionSize: protocol.DefaultMaxPushOptionSize,
+	}
 }
 
 // GoGitServer wraps concepts for go-git into a GitServer HTTP interface
 type GoGitServer struct {
-	repos     map[string]*git.Repository
-	transport transport.Transport
-	endpoint  string
+	srv *protocol.Server // the repositories, the hooks and what is done after a push
 
 	capabilities []capability.Capability
 	log          log
 
-	preReceiveHookFn  cfg.PreReceivePackHookFunc
-	postReceiveHookfn cfg.PostReceivePackHookFunc
+	maxPushOptions    int
+	maxPushOptionSize int
 }
 
 // WithLogger takes in logger/s to display debug and info logs for the GoGitServer object
@@ -64,18 +69,95 @@ func (s *GoGitServer) WithLogger(logger ...interface{}) {
 			logg.Printf("invalid logger %T passed", v)
 		}
 	}
+	s.srv.Log = s.log.Info
 }
 
 // WithPreReceiveHook sets the pre-receive hook for receive-pack requests
 func (s *GoGitServer) WithPreReceiveHook(fn cfg.PreReceivePackHookFunc) {
-	s.preReceiveHookFn = fn
+	s.srv.PreReceiveHook = nil
+	if fn != nil {
+		s.srv.PreReceiveHook = func(_ context.Context, w io.Writer, data *cfg.PreReceivePackHookData) (string, *cfg.ReceivePackHookError) {
+			return fn(w, data)
+		}
+	}
+}
+
+// WithPreReceiveHookContext sets the pre-receive hook for receive-pack requests, the
+// hook is passed a context that ends with the request or when the hook times out
+func (s *GoGitServer) WithPreReceiveHookContext(fn cfg.PreReceivePackHookContextFunc) {
+	s.srv.PreReceiveHook = fn
+}
+
+// WithPreReceiveRefHook sets the pre-receive hook that accepts or rejects each
+// ref of a receive-pack request on its own
+func (s *GoGitServer) WithPreReceiveRefHook(fn cfg.PreReceivePackRefHookFunc) {
+	s.srv.PreReceiveRefHook = nil
+	if fn != nil {
+		s.srv.PreReceiveRefHook = func(_ context.Context, w io.Writer, data *cfg.PreReceivePackHookData) *cfg.PreReceivePackHookResult {
+			return fn(w, data)
+		}
+	}
+}
+
+// WithPreReceiveRefHookContext sets the pre-receive hook that accepts or rejects each
+// ref of a receive-pack request on its own, the hook is passed a context that ends
+// with the request or when the hook times out
+func (s *GoGitServer) WithPreReceiveRefHookContext(fn cfg.PreReceivePackRefHookContextFunc) {
+	s.srv.PreReceiveRefHook = fn
 }
 
 // WithPostReceiveHook sets the post-receive hook for receive-pack requests
 func (s *GoGitServer) WithPostReceiveHook(fn cfg.PostReceivePackHookFunc) {
-	s.postReceiveHookfn = fn
+	s.srv.PostReceiveHook = nil
+	if fn != nil {
+		s.srv.PostReceiveHook = func(_ context.Context, w io.Writer, data *cfg.PostReceivePackHookData) {
+			fn(w, data)
+		}
+	}
+}
+
+// WithPostReceiveHookContext sets the post-receive hook for receive-pack requests, the
+// hook is passed a context that ends with the request or when the hook times out
+func (s *GoGitServer) WithPostReceiveHookContext(fn cfg.PostReceivePackHookContextFunc) {
+	s.srv.PostReceiveHook = fn
+}
+
+// WithHookTimeouts sets how long the pre-receive and post-receive hooks can each run
+// for, zero or less is no limit. A pre-receive hook that runs out of time rejects the push.
+func (s *GoGitServer) WithHookTimeouts(pre, post time.Duration) {
+	s.srv.PreReceiveTimeout, s.srv.PostReceiveTimeout = pre, post
+}
+
+// WithPushOptionsLimit sets the maximum number of push-options and the maximum
+// size of each push-option that a single push can send. Zero or less is unlimited.
+func (s *GoGitServer) WithPushOptionsLimit(count, size int) {
+	s.maxPushOptions, s.maxPushOptionSize = count, size
 }
 
+// WithPackLimits sets the maximum size of the packfile that a single push can send,
+// zero or less is unlimited. Packs that are larger than the spill size are written to a
+// temporary file while they are received, instead of being held in memory.
+func (s *GoGitServer) WithPackLimits(maxSize, spillSize int64) {
+	s.srv.MaxPackSize, s.srv.PackSpillSize = maxSize, spillSize
+}
+
+// WithReplicator sets the replicator that the refs updated by each push are sent to
+func (s *GoGitServer) WithReplicator(r cfg.Replicator) {
+	s.srv.Replicator = r
+}
+
+// Subscribe returns a subscription to the changes of the files that match the path glob
+// on the ref of the repository, an empty ref name is every ref. The repository name is the
+// same one the hooks are given. The events of a repository arrive in the order the pushes
+// were made, and a slow subscriber doesn't hold up a push. Close the subscription when done.
+func (s *GoGitServer) Subscribe(repoName, refName, glob string) *cfg.Subscription {
+	return s.srv.Subscribe(repoName, refName, glob)
+}
+
+// Registry returns the registry of the repositories that are served, so they can be
+// added, removed and renamed while the server runs
+func (s *GoGitServer) Registry() cfg.Registry { return s.srv.Registry }
+
 // InfoRefs holds all of the data needed to handle the git interface for
 // info-ref requests
 type InfoRefs struct {
@@ -114,28 +196,51 @@ func (ir *InfoRefs) DoHTTP(w http.ResponseWriter, r *http.Request) InfoRefser {
 		ir.service = serv[0]
 	}
 
-	endpoint, err := transport.NewEndpoint(ir.endpoint + ir.repoName)
+	// only the refs of the namespace are advertised, when there is one
+	repoName, ns, err := ir.srv.Namespace(ir.repoName, pusher(r, ""))
 	if err != nil {
-		return ir.withErr(ErrTransportEndpoint.F(ir.repoName, err))
+		return ir.withErr(ErrSession.F(ir.service, err))
+	}
+
+	if ir.service == "git-upload-pack" && protocol.Version(r.Header.Get("Git-Protocol")) == protocol.V2 {
+		return ir.doHTTPv2(w, repoName, ns)
+	}
+
+	endpoint, err := transport.NewEndpoint(ir.srv.Endpoint + repoName)
+	if err != nil {
+		return ir.withErr(ErrTransportEndpoint.F(repoName, err))
 	}
 
 	switch ir.service {
 	case "git-receive-pack":
-		if rps, err := ir.transport.NewReceivePackSession(endpoint, nil); err != nil {
+		// a repository that the push can make is advertised without refs
+		sto, err := ir.srv.ReceivePackStorer(r.Context(), repoName, ns, pusher(r, ""))
+		if err != nil {
+			return ir.withErr(sessionErr(ir.service, err))
+		}
+		if rps, err := ir.srv.Sessions(sto).NewReceivePackSession(endpoint, nil); err != nil {
 			return ir.withErr(ErrSession.F(ir.service, err))
 		} else if ir.refs, err = rps.AdvertisedReferences(); err != nil {
 			return ir.withErr(ErrSessionAdvRefs.F(ir.service, err))
 		}
+		for _, cap := range ir.capabilities {
+			ir.refs.Capabilities.Set(cap)
+		}
 	case "git-upload-pack":
-		if ups, err := ir.transport.NewUploadPackSession(endpoint, nil); err != nil {
+		sto, err := ir.srv.NamespaceStorer(repoName, ns)
+		if err != nil {
+			return ir.withErr(sessionErr(ir.service, err))
+		}
+		if ups, err := ir.srv.Sessions(sto).NewUploadPackSession(endpoint, nil); err != nil {
 			return ir.withErr(ErrSession.F(ir.service, err))
 		} else if ir.refs, err = ups.AdvertisedReferences(); err != nil {
 			return ir.withErr(ErrSessionAdvRefs.F(ir.service, err))
 		}
-	}
-
-	for _, cap := range ir.capabilities {
-		ir.refs.Capabilities.Set(cap)
+		if err := protocol.NewUploadPack(sto).SetCapabilities(ir.refs.Capabilities); err != nil {
+			return ir.withErr(ErrAdvertise.F(ir.service, err))
+		}
+	default:
+		return ir.withErr(ErrNoServiceFound)
 	}
 
 	ir.log.Info(ir.logPrefix, "setting the proper headers")
@@ -152,6 +257,28 @@ func (ir *InfoRefs) DoHTTP(w http.ResponseWriter, r *http.Request) InfoRefser {
 	return ir
 }
 
+// doHTTPv2 sends the protocol v2 capability advertisement, there are no
+// references sent. The client asks for them with the ls-refs command.
+func (ir *InfoRefs) doHTTPv2(w http.ResponseWriter, repoName, ns string) InfoRefser {
+	ir.log.Debug(ir.logPrefix, "fn: doHTTPv2...")
+
+	sto, err := ir.srv.NamespaceStorer(repoName, ns)
+	if err != nil {
+		return ir.withErr(sessionErr(ir.service, err))
+	}
+
+	ir.log.Info(ir.logPrefix, "setting the proper headers")
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", ir.service))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ir.log.Info(ir.logPrefix, "sending back the protocol v2 capabilities...")
+	if err := protocol.NewUploadPack(sto).AdvertiseV2(w); err != nil {
+		return ir.withErr(ErrAdvertise.F(ir.service, err))
+	}
+
+	return ir
+}
+
 // Err return any errors
 func (ir *InfoRefs) Err() error { return ir.err }
 
@@ -163,20 +290,23 @@ func (ir *InfoRefs) withErr(err error) InfoRefser {
 	return ir
 }
 
+// sessionErr returns the error of a session for the service, the errors that the handlers
+// answer with a status of their own are kept as they are
+func sessionErr(service string, err error) error {
+	if errors.Is(err, cfg.ErrCreateDenied) || errors.Is(err, transport.ErrRepositoryNotFound) {
+		return err
+	}
+	return ErrSession.F(service, err)
+}
+
 // ReceivePack holds all of the data needed to handle the git interface for
 // receive-pack requests through HTTP
 type ReceivePack struct {
 	*GoGitServer
 
 	repoName string
-	encOpts  []pktline.EncoderOption
 	cleanup  []func()
 
-	sess  transport.ReceivePackSession
-	refs  *packp.AdvRefs
-	rReq  *packp.ReferenceUpdateRequest
-	rStat *packp.ReportStatus
-
 	logPrefix string
 	err       error
 }
@@ -200,91 +330,25 @@ func (rp *ReceivePack) DoHTTP(w http.ResponseWriter, r *http.Request) ReceivePac
 		rp.log.Debug(rp.logPrefix, "skip: on error")
 		return rp
 	}
-
-	endpoint, err := transport.NewEndpoint(rp.endpoint + rp.repoName)
-	if err != nil {
-		return rp.withErr(ErrTransportEndpoint.F(rp.repoName, err))
-	}
-
-	if rp.sess, err = rp.transport.NewReceivePackSession(endpoint, nil); err != nil {
-		return rp.withErr(ErrSession.F("receive-pack", err))
-	}
-
-	if rp.refs, err = rp.sess.AdvertisedReferences(); err != nil {
-		return rp.withErr(ErrSessionAdvRefs.F("receive-pack", err))
-	}
-
-	for _, cap := range rp.capabilities {
-		rp.refs.Capabilities.Set(cap)
-	}
-
-	rp.rReq = packp.NewReferenceUpdateRequest()
-
-	buf := new(bytes.Buffer)
-	if err = rp.rReq.Decode(io.TeeReader(r.Body, buf)); err != nil {
-		return rp.withErr(ErrPackDecode.F(err))
-	}
 	rp.addCleanup(func() { r.Body.Close() }) // always close the body
 
-	var hookData *cfg.ReceivePackHookData
-	// TODO(njones): add push-option support
-	rp.encOpts, hookData, err = encOpts(strings.NewReader(buf.String()))
-	if err != nil {
-		return rp.withErr(err) // is a pre-wrapped error
-	}
-	hookData.RepoName = rp.repoName
-
-	rp.log.Info("adding the pre-receive hook...")
-	// the git pre-receive-hook function
-	if rp.preReceiveHookFn != nil {
-		rp.log.Debug(rp.logPrefix, "fn: (preHookFn)...")
-		buf := new(bytes.Buffer)
-		if hookData == nil {
-			return rp.withErr(ErrEmptyHookData.F(err))
-		}
-		refBranch, err := rp.preReceiveHookFn(buf, &cfg.PreReceivePackHookData{*hookData})
-		if err != nil {
-			enc := pktline.NewEncoder(w, rp.encOpts...).WithSidebandCapability(pktline.Sideband64k)
-			scn := bufio.NewScanner(buf)
-			for scn.Scan() {
-				enc.Sideband.EncodeProgress(scn.Text() + "\n")
-			}
-			enc.EncodeString("unpack ok\n")
-			enc.EncodeString(fmt.Sprintf("ng %s %s\n", refBranch, err))
-			enc.Sideband.Flush()
-			enc.Flush()
-
-			return rp // done
-		}
-	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	rp.addCleanup(func() { cancel() })
-
-	if rp.rStat, err = rp.sess.ReceivePack(ctx, rp.rReq); err != nil {
-		return rp.withErr(ErrReceivePack.F(err))
+	// the commands and push-options are read up front, the packfile is
+	// left on the body so it can be streamed into the repository
+	req, err := protocol.ReadReceiveRequest(r.Body, rp.maxPushOptions, rp.maxPushOptionSize)
+	switch {
+	case errors.Is(err, protocol.ErrPushOptionsCount), errors.Is(err, protocol.ErrPushOptionSize):
+		rp.log.Info(rp.logPrefix, "rejected:", err)
+		req.Report(w, req.Reject(nil, err))
+		return rp // done
+	case err != nil:
+		return rp.withErr(ErrPackDecode.F(err))
 	}
 
-	if rp.postReceiveHookfn != nil {
-		if hookData == nil {
-			return rp.withErr(ErrEmptyHookData.F(err))
-		}
-		pr, pw := io.Pipe()
-		go func() {
-			rp.postReceiveHookfn(pw, &cfg.PostReceivePackHookData{*hookData, make(map[string]string)})
-			pw.Close()
-		}()
-		enc := pktline.NewEncoder(w, rp.encOpts...).WithSidebandCapability(pktline.Sideband64k)
-		scn := bufio.NewScanner(pr)
-		for scn.Scan() {
-			enc.Sideband.EncodeProgress(scn.Text() + "\n")
-		}
+	// the hooks run with a context that ends with the HTTP request, so
+	// they can stop when the client goes away
+	if err := rp.srv.Push(r.Context(), w, rp.repoName, pusher(r, ""), req); err != nil {
+		return rp.withErr(err)
 	}
-
-	enc := pktline.NewEncoder(w, rp.encOpts...).WithSidebandCapability(pktline.Sideband64k)
-	pktline.ReportStatus(enc, rp.rStat)
-	enc.Flush()
-
 	return rp
 }
 
@@ -328,11 +392,6 @@ type UploadPack struct {
 	*GoGitServer
 	repoName string
 
-	sess  transport.UploadPackSession
-	refs  *packp.AdvRefs
-	uReq  *packp.UploadPackRequest
-	uResp *packp.UploadPackResponse
-
 	cleanup []func()
 
 	logPrefix string
@@ -355,52 +414,74 @@ func (up *UploadPack) DoHTTP(w http.ResponseWriter, r *http.Request) UploadPacke
 		return up
 	}
 
-	endpoint, err := transport.NewEndpoint(up.endpoint + up.repoName)
+	defer r.Body.Close() // close when we're done
+
+	// a fetch from a namespace only sees the refs of the namespace
+	repoName, ns, err := up.srv.Namespace(up.repoName, pusher(r, ""))
 	if err != nil {
-		return up.withErr(ErrTransportEndpoint.F(up.repoName, err))
+		return up.withErr(ErrSession.F("upload-pack", err))
 	}
-
-	if up.sess, err = up.transport.NewUploadPackSession(endpoint, nil); err != nil {
+	sto, err := up.srv.NamespaceStorer(repoName, ns)
+	if err != nil {
 		return up.withErr(ErrSession.F("upload-pack", err))
 	}
 
-	up.uReq = packp.NewUploadPackRequest()
-	if err = up.uReq.Decode(r.Body); err != nil {
+	body, err := requestBody(r)
+	if err != nil {
 		return up.withErr(ErrUploadPackRequest.F(err))
 	}
-	defer r.Body.Close() // close when we're done
 
-	// the capablities need to be added before the UploadPack call
-	if up.refs, err = up.sess.AdvertisedReferences(); err != nil {
-		return up.withErr(ErrSessionAdvRefs.F("upload-pack", err))
+	if protocol.Version(r.Header.Get("Git-Protocol")) == protocol.V2 {
+		return up.doHTTPv2(w, body, sto)
 	}
 
-	for _, cap := range up.capabilities {
-		up.refs.Capabilities.Set(cap)
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// the pack is streamed with side-band awareness, so once the response has
+	// started errors are sent in-band and only logged here
+	if err := protocol.NewUploadPack(sto).ServeV0(w, body, true); err != nil {
+		up.log.Info(up.logPrefix, "ERR:", err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	up.addCleanup(func() { cancel() }) // cancel when we are finished consuming integers
+	return up
+}
+
+// doHTTPv2 serves a single protocol v2 command, HTTP is stateless so
+// every command the client sends comes in its own request.
+func (up *UploadPack) doHTTPv2(w http.ResponseWriter, body io.Reader, sto storer.Storer) UploadPacker {
+	up.log.Debug(up.logPrefix, "fn: doHTTPv2...")
 
-	up.uResp, err = up.sess.UploadPack(ctx, up.uReq)
+	cmd, err := protocol.ReadCommand(body)
 	if err != nil {
-		return up.withErr(ErrUploadPack.F(err))
+		return up.withErr(ErrUploadPackRequest.F(err))
+	}
+	if cmd == nil {
+		return up // nothing was asked for
 	}
 
-	// buffer the upload pack response
-	buf := new(bytes.Buffer)
-	up.uResp.Encode(buf) // this doesn't work with the go-git sideband muxer
+	up.log.Info(up.logPrefix, "serving the protocol v2 command:", cmd.Name)
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
 
-	// re-write out the pack data with side-band awareness
-	enc := pktline.NewEncoder(w, pktline.WithSideband64kMuxer).WithSidebandCapability(pktline.Sideband64k)
-	enc.Write(buf.Bytes()[:8]) // already encoded...
-	enc.WriteString(fmt.Sprintf("%04x\x01", 1+4+len(buf.Bytes()[8:])))
-	enc.Write(buf.Bytes()[8:])
-	enc.Flush()
+	// the response has started, so errors are sent in-band and only logged here
+	if err := protocol.NewUploadPack(sto).ServeV2(w, cmd); err != nil {
+		up.log.Info(up.logPrefix, "ERR:", err)
+	}
 
 	return up
 }
 
+// requestBody returns the body of the request, git gzips the upload-pack requests that are
+// larger than a kilobyte
+func requestBody(r *http.Request) (io.Reader, error) {
+	switch r.Header.Get("Content-Encoding") {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r.Body)
+	}
+	return r.Body, nil
+}
+
 // Cleanup takes any functions that were collected and runs them. This is for
 // deferred processes
 func (up *UploadPack) Cleanup() {
@@ -431,40 +512,3 @@ func (up *UploadPack) addCleanup(fn func()) {
 	up.log.Debug(up.logPrefix, "fn: addCleanup...")
 	up.cleanup = append(up.cleanup, fn)
 }
-
-// encOpts returns the encoding options, the hookdata and any errors
-// from the receive-pack upload and will be used for the (pre|post)-receive pack hook
-func encOpts(r io.Reader) ([]pktline.EncoderOption, *cfg.ReceivePackHookData, error) {
-	var oldHash, newHash, refName string
-	var encOpts = make([]pktline.EncoderOption, 0, 1)
-	var hookData = &cfg.ReceivePackHookData{Refs: make([]cfg.ReceivePackData, 0)}
-	var skip = false
-
-	scn := pktline.NewScanner(r)
-	for scn.Scan() {
-		// looking for something like: a6a63a... 6684c0... refs/heads/master\0 report-status side-band-64k push-options agent=git/2.20.1
-		refCapSplit := strings.Split(scn.Text(), "\x00")
-		if len(refCapSplit) == 2 {
-			_, err := fmt.Sscan(refCapSplit[0], &oldHash, &newHash, &refName)
-			if err != nil {
-				return nil, nil, ErrPackScanAdvRefs.F(err)
-			}
-			hookData.Refs = append(hookData.Refs, cfg.ReceivePackData{OldHash: oldHash, NewHash: newHash, RefName: refName})
-		}
-		if !skip {
-			if len(refCapSplit) > 1 {
-				idx := strings.Index(refCapSplit[1], "side-band")
-				if idx > -1 {
-					if refCapSplit[1][idx+9:][:4] == "-64k" {
-						encOpts = append(encOpts, pktline.WithSideband64kMuxer)
-					} else {
-						encOpts = append(encOpts, pktline.WithSidebandMuxer)
-					}
-				}
-			}
-			skip = true
-		}
-	}
-
-	return encOpts, hookData, nil
-}
@@ -0,0 +1,209 @@
+package cfghttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.xa4b.com/git/cfg"
+	"gopkg.xa4b.com/git/pktline"
+)
+
+var (
+	_ GitServer          = &GoGitServer{}
+	_ HookGitServer      = &GoGitServer{}
+	_ LimitGitServer     = &GoGitServer{}
+	_ ReplicaGitServer   = &GoGitServer{}
+	_ MirrorGitServer    = &GoGitServer{}
+	_ CreateGitServer    = &GoGitServer{}
+	_ NamespaceGitServer = &GoGitServer{}
+)
+
+// configServer returns a server of a repository named config with a commit on master
+func configServer(t *testing.T) (*GoGitServer, string) {
+	t.Helper()
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := LoadGoGit(map[string]*git.Repository{"config": repo}, "file:///")
+	h, err := gs.Commit(context.Background(), nil, "config", cfg.Commit{
+		RefName: "refs/heads/master",
+		Files:   []cfg.CommitFile{{Path: "configuration.toml", Content: []byte("a = 1\n")}},
+		Message: "commit",
+		Author:  object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1e9, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gs, h
+}
+
+// postGzip posts the pkt-lines to the upload-pack of config gzipped, the same as git does
+// for the requests that are larger than a kilobyte
+func postGzip(t *testing.T, url string, header http.Header, lines func(*pktline.Encoder)) *bytes.Buffer {
+	t.Helper()
+	body := new(bytes.Buffer)
+	zw := gzip.NewWriter(body)
+	lines(pktline.NewEncoder(zw))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url+"/config/git-upload-pack", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	out := new(bytes.Buffer)
+	out.ReadFrom(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("have: %d %q want: %d", resp.StatusCode, out, http.StatusOK)
+	}
+	return out
+}
+
+// haves returns the have lines of n commits that the server doesn't have
+func haves(enc *pktline.Encoder, from, n int) {
+	for i := from; i < from+n; i++ {
+		enc.EncodeString(fmt.Sprintf("have %s\n", plumbing.ComputeHash(plumbing.CommitObject, []byte(fmt.Sprint(i)))))
+	}
+}
+
+func TestUploadPackGzipV2(t *testing.T) {
+	gs, h := configServer(t)
+	srv := httptest.NewServer(NewServer(gs))
+	defer srv.Close()
+
+	header := http.Header{"Git-Protocol": []string{"version=2"}}
+	out := postGzip(t, srv.URL, header, func(enc *pktline.Encoder) {
+		enc.EncodeString("command=fetch\n")
+		enc.Delim()
+		enc.EncodeString("want " + h + "\n")
+		haves(enc, 0, 80)
+		enc.Flush()
+	})
+
+	// none of the haves are known, so the server asks for more
+	scn := pktline.NewScanner(out)
+	var lines []string
+	for scn.Scan() {
+		lines = append(lines, scn.Text())
+	}
+	if len(lines) < 2 || lines[0] != "acknowledgments\n" || lines[1] != "NAK\n" {
+		t.Fatalf("have: %q want: acknowledgments and NAK", lines)
+	}
+}
+
+func TestUploadPackGzipV0(t *testing.T) {
+	gs, h := configServer(t)
+	srv := httptest.NewServer(NewServer(gs))
+	defer srv.Close()
+
+	// each round of a stateless fetch is its own request, with the haves of the rounds
+	// before it, and the last one ends with done instead of a flush
+	for _, n := range []int{16, 48, 80} {
+		done := n == 80
+		out := postGzip(t, srv.URL, http.Header{}, func(enc *pktline.Encoder) {
+			enc.EncodeString("want " + h + " side-band-64k\n")
+			enc.Flush()
+			haves(enc, 0, n)
+			if done {
+				enc.EncodeString("done\n")
+			} else {
+				enc.Flush()
+			}
+		})
+
+		scn := pktline.NewScanner(out)
+		if !scn.Scan() || scn.Text() != "NAK\n" {
+			t.Fatalf("have: %q want: NAK after %d haves", out, n)
+		}
+		if hasPack := bytes.Contains(out.Bytes(), []byte("PACK")); hasPack != done {
+			t.Fatalf("have: %q want: a packfile %t after %d haves", out, done, n)
+		}
+	}
+}
+
+func TestPostReceiveCommits(t *testing.T) {
+	gs, h := configServer(t)
+	commits := make(map[string][]string)
+	gs.WithPostReceiveHook(func(_ io.Writer, data *cfg.PostReceivePackHookData) {
+		for _, ref := range data.Refs {
+			cs, err := ref.Commits()
+			if err != nil {
+				t.Error(err)
+			}
+			for _, c := range cs {
+				commits[ref.RefName] = append(commits[ref.RefName], c.Hash.String())
+			}
+		}
+	})
+
+	srv := httptest.NewServer(NewServer(gs))
+	defer srv.Close()
+
+	fs := memfs.New()
+	repo, err := git.Clone(memory.NewStorage(), fs, &git.CloneOptions{URL: srv.URL + "/config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.WriteFile(fs, "configuration.toml", []byte("a = 13\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add("configuration.toml"); err != nil {
+		t.Fatal(err)
+	}
+	sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1e9, 0)}
+	c, err := wt.Commit("v13", &git.CommitOptions{Author: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v13", c, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// master, a new branch and a tag all at the new commit, in one push
+	err = repo.Push(&git.PushOptions{RefSpecs: []config.RefSpec{
+		"refs/heads/master:refs/heads/master",
+		"refs/heads/master:refs/heads/release",
+		"refs/tags/v13:refs/tags/v13",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{c.String()}
+	for _, refName := range []string{"refs/heads/master", "refs/heads/release", "refs/tags/v13"} {
+		if !reflect.DeepEqual(commits[refName], want) {
+			t.Fatalf("have: %v want: %s with %v, not %s", commits[refName], refName, want, h)
+		}
+	}
+}
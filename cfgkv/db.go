@@ -0,0 +1,511 @@
+// Package cfgkv keeps git repositories in a single file, an embedded key-value database,
+// so that each instance keeps all of its configuration history in one durable file:
+//
+//	db, err := cfgkv.Open("/var/lib/config.db")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer db.Close()
+//
+//	repos, err := db.Repositories()
+//	gs := cfghttp.LoadGoGit(repos, "file:///")
+//
+// The file is a log of batches of writes. A batch is written and synced to disk before
+// it is used, so an update to the refs of a push either happens in full or not at all,
+// even when the process stops in the middle of it. The log is compacted when most of it
+// is old values. A file is used by one process at a time.
+package cfgkv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// magic is at the start of the file
+const magic = "cfgkv\x00\x00\x01"
+
+// the ops of a batch
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+// batchHeader is the size of the checksum and the length before each batch
+const batchHeader = 8
+
+// compactSize is the size the file has to be before it is compacted, which is done when
+// more than half of it is old values
+const compactSize = 4 << 20
+
+// maxCompactBatch is about how large the batches written by a compaction are
+const maxCompactBatch = 1 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// DB is a database file, it is safe for concurrent use
+type DB struct {
+	path string
+
+	mu     sync.RWMutex
+	f      *os.File
+	end    int64 // where the next batch is written
+	ix     *offsets
+	closed bool
+}
+
+// Open opens the database file at path, it is made when it doesn't exist
+func Open(path string) (*DB, error) {
+	os.Remove(path + ".compact") // what is left of a compaction that didn't finish
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, ErrOpen.F(path, err)
+	}
+	db := &DB{path: path, f: f, ix: newOffsets()}
+	if err := db.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load reads the batches of the file into the index. A batch that wasn't all written,
+// because the process stopped in the middle of writing it, is cut off the end of the file.
+func (db *DB) load() error {
+	fi, err := db.f.Stat()
+	if err != nil {
+		return ErrOpen.F(db.path, err)
+	}
+	if fi.Size() == 0 {
+		if _, err := db.f.WriteAt([]byte(magic), 0); err != nil {
+			return ErrOpen.F(db.path, err)
+		}
+		db.end = int64(len(magic))
+		return ErrOpen.F(db.path, db.f.Sync())
+	}
+
+	head := make([]byte, len(magic))
+	if _, err := db.f.ReadAt(head, 0); err != nil || string(head) != magic {
+		return ErrNotDB.F(db.path)
+	}
+
+	off := int64(len(magic))
+	r := bufio.NewReader(io.NewSectionReader(db.f, off, fi.Size()-off))
+	for {
+		body, err := readBatch(r, fi.Size()-off)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// the tail is torn, everything before it was synced
+			if err := db.f.Truncate(off); err != nil {
+				return ErrOpen.F(db.path, err)
+			}
+			if err := db.f.Sync(); err != nil {
+				return ErrOpen.F(db.path, err)
+			}
+			break
+		}
+		if err := db.ix.apply(body, off+batchHeader); err != nil {
+			return ErrCorrupt.F(db.path, off, err)
+		}
+		off += batchHeader + int64(len(body))
+	}
+	db.end = off
+	return nil
+}
+
+// Close closes the file of the database
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	return db.f.Close()
+}
+
+// Compact writes the current values to a new file that takes the place of the old one
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.compact()
+}
+
+// get returns the value of the key in the bucket
+func (db *DB) get(bucket, key string) ([]byte, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, false, ErrClosed
+	}
+	return db.read(bucket, key)
+}
+
+// read returns the value of the key in the bucket, the lock is held
+func (db *DB) read(bucket, key string) ([]byte, bool, error) {
+	e, ok := db.ix.buckets[bucket][key]
+	if !ok {
+		return nil, false, nil
+	}
+	v := make([]byte, e.n)
+	if _, err := db.f.ReadAt(v, e.off); err != nil {
+		return nil, false, ErrRead.F(db.path, err)
+	}
+	return v, true, nil
+}
+
+// size returns the size of the value of the key in the bucket
+func (db *DB) size(bucket, key string) (int, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	e, ok := db.ix.buckets[bucket][key]
+	return e.n, ok
+}
+
+// keys returns the keys of the bucket in order
+func (db *DB) keys(bucket string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	keys := make([]string, 0, len(db.ix.buckets[bucket]))
+	for k := range db.ix.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// each calls fn with the keys and values of the bucket in order
+func (db *DB) each(bucket string, fn func(key string, value []byte) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	keys := make([]string, 0, len(db.ix.buckets[bucket]))
+	for k := range db.ix.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, _, err := db.read(bucket, k)
+		if err != nil {
+			return err
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update calls fn with a transaction, and writes what it puts and deletes as one batch when
+// it returns nil. Nothing else is written while fn runs, so it can check values before it
+// changes them.
+func (db *DB) update(fn func(tx *tx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	t := &tx{db: db}
+	if err := fn(t); err != nil {
+		return err
+	}
+	if len(t.ops) == 0 {
+		return nil
+	}
+
+	body := encodeBatch(t.ops)
+	if err := db.write(db.f, db.end, body); err != nil {
+		db.f.Truncate(db.end) // so a part of it isn't read back
+		return ErrWrite.F(db.path, err)
+	}
+	if err := db.f.Sync(); err != nil {
+		db.f.Truncate(db.end)
+		return ErrWrite.F(db.path, err)
+	}
+	if err := db.ix.apply(body, db.end+batchHeader); err != nil {
+		return ErrCorrupt.F(db.path, db.end, err)
+	}
+	db.end += batchHeader + int64(len(body))
+
+	if db.end > compactSize && db.ix.live < db.end/2 {
+		db.compact() // the batch is written, a compaction that fails is tried after the next one
+	}
+	return nil
+}
+
+// write writes the batch body to f at off, after its checksum and length
+func (db *DB) write(f *os.File, off int64, body []byte) error {
+	b := make([]byte, batchHeader, batchHeader+len(body))
+	binary.LittleEndian.PutUint32(b[0:4], crc32.Checksum(body, crcTable))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(body)))
+	_, err := f.WriteAt(append(b, body...), off)
+	return err
+}
+
+// compact writes the current values to a new file that is moved over the old one once it
+// is synced, the lock is held
+func (db *DB) compact() error {
+	tmp, err := os.OpenFile(db.path+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return ErrCompact.F(db.path, err)
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return ErrCompact.F(db.path, err)
+	}
+	if _, err := tmp.WriteAt([]byte(magic), 0); err != nil {
+		return fail(err)
+	}
+
+	buckets := make([]string, 0, len(db.ix.buckets))
+	for b := range db.ix.buckets {
+		buckets = append(buckets, b)
+	}
+	sort.Strings(buckets)
+
+	ix, end := newOffsets(), int64(len(magic))
+	var ops []op
+	var size int
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		body := encodeBatch(ops)
+		if err := db.write(tmp, end, body); err != nil {
+			return err
+		}
+		if err := ix.apply(body, end+batchHeader); err != nil {
+			return err
+		}
+		end += batchHeader + int64(len(body))
+		ops, size = ops[:0], 0
+		return nil
+	}
+	for _, b := range buckets {
+		for k := range db.ix.buckets[b] {
+			v, _, err := db.read(b, k)
+			if err != nil {
+				return fail(err)
+			}
+			ops = append(ops, op{kind: opPut, bucket: b, key: k, value: v})
+			if size += len(v); size > maxCompactBatch {
+				if err := flush(); err != nil {
+					return fail(err)
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp.Name(), db.path); err != nil {
+		return fail(err)
+	}
+	syncDir(filepath.Dir(db.path))
+
+	// the new file is kept open, it is the one at the path now
+	db.f.Close()
+	db.f, db.end, db.ix = tmp, end, ix
+	return nil
+}
+
+// syncDir syncs the directory, so a file that was moved into it stays there
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// readBatch reads the body of the next batch, which is no more than max bytes from the end
+// of the file. io.EOF is returned when there are no more.
+func readBatch(r io.Reader, max int64) ([]byte, error) {
+	head := make([]byte, batchHeader)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	n := int64(binary.LittleEndian.Uint32(head[4:8]))
+	if n > max-batchHeader {
+		return nil, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(head[0:4]) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return body, nil
+}
+
+// op is a put or a delete of a batch
+type op struct {
+	kind   byte
+	bucket string
+	key    string
+	value  []byte
+}
+
+// encodeBatch returns the body of a batch of the ops
+func encodeBatch(ops []op) []byte {
+	var b []byte
+	b = appendUvarint(b, uint64(len(ops)))
+	for _, o := range ops {
+		b = append(b, o.kind)
+		b = appendUvarint(b, uint64(len(o.bucket)))
+		b = append(b, o.bucket...)
+		b = appendUvarint(b, uint64(len(o.key)))
+		b = append(b, o.key...)
+		if o.kind == opPut {
+			b = appendUvarint(b, uint64(len(o.value)))
+			b = append(b, o.value...)
+		}
+	}
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// entry is where a value is in the file
+type entry struct {
+	off int64
+	n   int
+}
+
+// offsets has where the values of each bucket are in the file
+type offsets struct {
+	buckets map[string]map[string]entry
+	live    int64 // the size of the values
+}
+
+func newOffsets() *offsets {
+	return &offsets{buckets: make(map[string]map[string]entry)}
+}
+
+// apply adds the ops of the batch body, which is at off in the file, to the index
+func (ix *offsets) apply(body []byte, off int64) error {
+	var pos int
+	next := func() (int, error) {
+		v, n := binary.Uvarint(body[pos:])
+		if n <= 0 || v > uint64(len(body)-pos-n) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		pos += n
+		return int(v), nil
+	}
+	str := func() (string, error) {
+		n, err := next()
+		if err != nil {
+			return "", err
+		}
+		s := string(body[pos : pos+n])
+		pos += n
+		return s, nil
+	}
+
+	count, err := next()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		if pos >= len(body) {
+			return io.ErrUnexpectedEOF
+		}
+		kind := body[pos]
+		pos++
+		bucket, err := str()
+		if err != nil {
+			return err
+		}
+		key, err := str()
+		if err != nil {
+			return err
+		}
+
+		b := ix.buckets[bucket]
+		if old, ok := b[key]; ok {
+			ix.live -= int64(old.n)
+			delete(b, key)
+		}
+		switch kind {
+		case opPut:
+			n, err := next()
+			if err != nil {
+				return err
+			}
+			if b == nil {
+				b = make(map[string]entry)
+				ix.buckets[bucket] = b
+			}
+			b[key] = entry{off: off + int64(pos), n: n}
+			ix.live += int64(n)
+			pos += n
+		case opDelete:
+			if len(b) == 0 {
+				delete(ix.buckets, bucket)
+			}
+		default:
+			return ErrOp.F(kind)
+		}
+	}
+	return nil
+}
+
+// tx is the puts and deletes of an update
+type tx struct {
+	db  *DB
+	ops []op
+}
+
+// get returns the value of the key in the bucket, with the puts and deletes of the
+// transaction
+func (t *tx) get(bucket, key string) ([]byte, bool, error) {
+	for i := len(t.ops) - 1; i >= 0; i-- {
+		if o := t.ops[i]; o.bucket == bucket && o.key == key {
+			return o.value, o.kind == opPut, nil
+		}
+	}
+	return t.db.read(bucket, key)
+}
+
+// has reports if the bucket has the key, with the puts and deletes of the transaction
+func (t *tx) has(bucket, key string) bool {
+	for i := len(t.ops) - 1; i >= 0; i-- {
+		if o := t.ops[i]; o.bucket == bucket && o.key == key {
+			return o.kind == opPut
+		}
+	}
+	_, ok := t.db.ix.buckets[bucket][key]
+	return ok
+}
+
+// put sets the value of the key in the bucket
+func (t *tx) put(bucket, key string, value []byte) {
+	t.ops = append(t.ops, op{kind: opPut, bucket: bucket, key: key, value: value})
+}
+
+// delete removes the key from the bucket
+func (t *tx) delete(bucket, key string) {
+	t.ops = append(t.ops, op{kind: opDelete, bucket: bucket, key: key})
+}
@@ -0,0 +1,221 @@
+package cfgkv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+
+	"gopkg.xa4b.com/git/cfg"
+)
+
+func tempDB(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cfgkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "config.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestDB(t *testing.T) {
+	path, cleanup := tempDB(t)
+	defer cleanup()
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key, value string) {
+		err := db.update(func(tx *tx) error {
+			tx.put("b", key, []byte(value))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("a", "1")
+	put("b", "2")
+	put("a", "3")
+	db.update(func(tx *tx) error {
+		tx.delete("b", "b")
+		return nil
+	})
+	db.Close()
+	if _, _, err := db.get("b", "a"); err != ErrClosed {
+		t.Fatalf("have: %v want: %v", err, ErrClosed)
+	}
+
+	// a batch that wasn't all written is cut off
+	fi, _ := os.Stat(path)
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{1, 2, 3, 4, 200, 0, 0, 0, 9})
+	f.Close()
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat(path); after.Size() != fi.Size() {
+		t.Fatalf("have: %d want: %d bytes after the torn tail", after.Size(), fi.Size())
+	}
+	if v, ok, err := db.get("b", "a"); err != nil || !ok || string(v) != "3" {
+		t.Fatalf("have: %q %v %v want: 3", v, ok, err)
+	}
+	if _, ok, _ := db.get("b", "b"); ok {
+		t.Fatal("have: b want: it deleted")
+	}
+
+	// the old values are gone after a compaction, the current ones are kept
+	for i := 0; i < 100; i++ {
+		put("c", strings.Repeat("x", i))
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	put("d", "4")
+	db.Close()
+	if after, _ := os.Stat(path); after.Size() >= fi.Size()+100*50 {
+		t.Fatalf("have: %d bytes want: the file compacted", after.Size())
+	}
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if keys := db.keys("b"); strings.Join(keys, ",") != "a,c,d" {
+		t.Fatalf("have: %v want: [a c d]", keys)
+	}
+	if v, _, _ := db.get("b", "c"); len(v) != 99 {
+		t.Fatalf("have: %d want: 99 bytes", len(v))
+	}
+
+	if err := ioutil.WriteFile(path+".other", []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path + ".other"); err == nil || !strings.Contains(err.Error(), "not a cfgkv database") {
+		t.Fatalf("have: %v want: %v", err, ErrNotDB)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	path, cleanup := tempDB(t)
+	defer cleanup()
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Storage(""); err == nil {
+		t.Fatalf("have: %v want: %v", err, ErrName)
+	}
+
+	fs := memfs.New()
+	sto, err := db.Storage("team/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := git.Init(sto, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, _ := repo.Worktree()
+	sig := &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+	commit := func(name, contents string) plumbing.Hash {
+		if err := util.WriteFile(fs, name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wt.Add(name)
+		h, err := wt.Commit("commit "+name, &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	h1 := commit("a.toml", "a = 1\n")
+
+	// the objects of a packfile are written together
+	bundle := new(bytes.Buffer)
+	sfs := memfs.New()
+	srcRepo, _ := git.Init(memory.NewStorage(), sfs)
+	swt, _ := srcRepo.Worktree()
+	util.WriteFile(sfs, "b.toml", []byte("b = 1\n"), 0644)
+	swt.Add("b.toml")
+	h2, err := swt.Commit("commit b.toml", &git.CommitOptions{Author: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcRepo.Storer.SetReference(plumbing.NewHashReference("refs/heads/dev", h2))
+	srcRepo.Storer.RemoveReference("refs/heads/master")
+	if err := cfg.WriteBundle(bundle, srcRepo.Storer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.ReadBundle(bundle, sto); err != nil {
+		t.Fatal(err)
+	}
+
+	// a ref that moved can't be moved from where it was
+	old := plumbing.NewHashReference("refs/heads/master", h1)
+	if err := sto.CheckAndSetReference(plumbing.NewHashReference("refs/heads/master", h2), plumbing.NewHashReference("refs/heads/master", h2)); err != storage.ErrReferenceHasChanged {
+		t.Fatalf("have: %v want: %v", err, storage.ErrReferenceHasChanged)
+	}
+	if err := sto.CheckAndSetReference(plumbing.NewHashReference("refs/heads/master", h1), old); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// everything is there when it is opened again
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	repos, err := db.Repositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, ok := repos["team/config"]
+	if !ok || len(repos) != 1 {
+		t.Fatalf("have: %v want: team/config", repos)
+	}
+	if head, err := repo.Head(); err != nil || head.Hash() != h1 {
+		t.Fatalf("have: %v %v want: HEAD at %s", head, err, h1)
+	}
+	var v struct{ A, B int }
+	if err := cfg.Load(repo, "refs/heads/master", "a.toml", &v); err != nil || v.A != 1 {
+		t.Fatalf("have: %+v %v want: a.toml from master", v, err)
+	}
+	if err := cfg.Load(repo, "refs/heads/dev", "b.toml", &v); err != nil || v.B != 1 {
+		t.Fatalf("have: %+v %v want: b.toml from dev", v, err)
+	}
+	if c, err := repo.Config(); err != nil || c.Core.IsBare {
+		t.Fatalf("have: %v want: the config of a repository with a worktree", err)
+	}
+	if idx, err := repo.Storer.Index(); err != nil || len(idx.Entries) != 1 {
+		t.Fatalf("have: %v %v want: the index of a.toml", idx, err)
+	}
+
+	// a repository that isn't in the database is made
+	made, err := db.Repository("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := made.Head(); err != plumbing.ErrReferenceNotFound {
+		t.Fatalf("have: %v want: an empty repository", err)
+	}
+	if names := db.Names(); strings.Join(names, ",") != "other,team/config" {
+		t.Fatalf("have: %v want: [other team/config]", names)
+	}
+}
@@ -0,0 +1,473 @@
+package cfgkv
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+// repositories is the bucket with the names of the repositories
+const repositories = "repositories"
+
+// the keys of the meta bucket of a repository
+const (
+	keyConfig  = "config"
+	keyIndex   = "index"
+	keyShallow = "shallow"
+)
+
+// objectTypes are the types an object can be stored as
+var objectTypes = []plumbing.ObjectType{plumbing.CommitObject, plumbing.TreeObject, plumbing.BlobObject, plumbing.TagObject}
+
+// Names returns the names of the repositories in the database in order
+func (db *DB) Names() []string {
+	return db.keys(repositories)
+}
+
+// Storage returns the storage of the repository with the name, an empty one is made when
+// it isn't in the database
+func (db *DB) Storage(name string) (*Storage, error) {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return nil, ErrName.F(name)
+	}
+	err := db.update(func(tx *tx) error {
+		if !tx.has(repositories, name) {
+			tx.put(repositories, name, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{db: db, prefix: "repo\x00" + name + "\x00"}, nil
+}
+
+// Repository opens the repository with the name, an empty bare one is made when it isn't in
+// the database. It can be the Init of a cfg.CreateOnPush.
+func (db *DB) Repository(name string) (*git.Repository, error) {
+	sto, err := db.Storage(name)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := git.Open(sto, nil)
+	if err == git.ErrRepositoryNotExists {
+		return git.Init(sto, nil)
+	}
+	return repo, err
+}
+
+// Repositories opens all of the repositories in the database, by name
+func (db *DB) Repositories() (map[string]*git.Repository, error) {
+	repos := make(map[string]*git.Repository)
+	for _, name := range db.Names() {
+		repo, err := db.Repository(name)
+		if err != nil {
+			return nil, err
+		}
+		repos[name] = repo
+	}
+	return repos, nil
+}
+
+// Storage is the go-git storage of a repository in the database. Each write is synced to
+// disk before it returns, and objects that are written together, such as the ones of a
+// packfile or a transaction, are written as one batch.
+type Storage struct {
+	db     *DB
+	prefix string // of the buckets of the repository
+}
+
+var (
+	_ storage.Storer        = (*Storage)(nil)
+	_ storer.Transactioner  = (*Storage)(nil)
+	_ storer.PackfileWriter = (*Storage)(nil)
+)
+
+func (s *Storage) objects() string { return s.prefix + "objects" }
+func (s *Storage) refs() string    { return s.prefix + "refs" }
+func (s *Storage) meta() string    { return s.prefix + "meta" }
+
+// objectKey is the key of an object, its type is part of it so the objects of a type can
+// be listed without reading them
+func objectKey(t plumbing.ObjectType, h plumbing.Hash) string {
+	return string(append([]byte{byte(t)}, h[:]...))
+}
+
+// NewEncodedObject returns a new object for the storage
+func (s *Storage) NewEncodedObject() plumbing.EncodedObject {
+	return &plumbing.MemoryObject{}
+}
+
+// SetEncodedObject writes the object
+func (s *Storage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	if err := s.setObjects(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return obj.Hash(), nil
+}
+
+// setObjects writes the objects as one batch, the ones the storage has already are skipped
+func (s *Storage) setObjects(objs ...plumbing.EncodedObject) error {
+	type kv struct {
+		key   string
+		value []byte
+	}
+	values := make([]kv, 0, len(objs))
+	for _, obj := range objs {
+		switch obj.Type() {
+		case plumbing.OFSDeltaObject, plumbing.REFDeltaObject:
+			return plumbing.ErrInvalidType
+		}
+		r, err := obj.Reader()
+		if err != nil {
+			return err
+		}
+		v, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		values = append(values, kv{key: objectKey(obj.Type(), obj.Hash()), value: v})
+	}
+
+	return s.db.update(func(tx *tx) error {
+		for _, o := range values {
+			if !tx.has(s.objects(), o.key) {
+				tx.put(s.objects(), o.key, o.value)
+			}
+		}
+		return nil
+	})
+}
+
+// EncodedObject returns the object with the hash and the type, which can be any type
+func (s *Storage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	types := []plumbing.ObjectType{t}
+	if t == plumbing.AnyObject {
+		types = objectTypes
+	}
+	for _, t := range types {
+		v, ok, err := s.db.get(s.objects(), objectKey(t, h))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			obj := &plumbing.MemoryObject{}
+			obj.SetType(t)
+			obj.Write(v)
+			return obj, nil
+		}
+	}
+	return nil, plumbing.ErrObjectNotFound
+}
+
+// IterEncodedObjects returns the objects of the type, which can be any type
+func (s *Storage) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	var hashes []plumbing.Hash
+	for _, key := range s.db.keys(s.objects()) {
+		if t == plumbing.AnyObject || plumbing.ObjectType(key[0]) == t {
+			var h plumbing.Hash
+			copy(h[:], key[1:])
+			hashes = append(hashes, h)
+		}
+	}
+	return storer.NewEncodedObjectLookupIter(s, t, hashes), nil
+}
+
+// HasEncodedObject returns nil when the storage has the object
+func (s *Storage) HasEncodedObject(h plumbing.Hash) error {
+	if _, err := s.EncodedObjectSize(h); err != nil {
+		return err
+	}
+	return nil
+}
+
+// EncodedObjectSize returns the size of the object
+func (s *Storage) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	for _, t := range objectTypes {
+		if n, ok := s.db.size(s.objects(), objectKey(t, h)); ok {
+			return int64(n), nil
+		}
+	}
+	return 0, plumbing.ErrObjectNotFound
+}
+
+// Begin starts a transaction, its objects are written as one batch when it is committed
+func (s *Storage) Begin() storer.Transaction {
+	return &objectTx{Storage: s, objs: make(map[plumbing.Hash]plumbing.EncodedObject)}
+}
+
+// PackfileWriter returns a writer for a packfile, its objects are written as one batch when
+// it is closed
+func (s *Storage) PackfileWriter() (io.WriteCloser, error) {
+	f, err := ioutil.TempFile("", "cfgkv-pack-")
+	if err != nil {
+		return nil, ErrWrite.F(s.db.path, err)
+	}
+	return &packWriter{File: f, s: s}, nil
+}
+
+// SetReference writes the ref
+func (s *Storage) SetReference(ref *plumbing.Reference) error {
+	if ref == nil {
+		return nil
+	}
+	return s.db.update(func(tx *tx) error {
+		tx.put(s.refs(), ref.Name().String(), []byte(ref.Strings()[1]))
+		return nil
+	})
+}
+
+// CheckAndSetReference writes the ref new, when the ref is still at old. Nothing can write
+// the ref between the check and the write.
+func (s *Storage) CheckAndSetReference(new, old *plumbing.Reference) error {
+	if new == nil {
+		return nil
+	}
+	return s.db.update(func(tx *tx) error {
+		if old != nil {
+			v, ok, err := tx.get(s.refs(), new.Name().String())
+			if err != nil {
+				return err
+			}
+			if ok && plumbing.NewReferenceFromStrings(new.Name().String(), string(v)).Hash() != old.Hash() {
+				return storage.ErrReferenceHasChanged
+			}
+		}
+		tx.put(s.refs(), new.Name().String(), []byte(new.Strings()[1]))
+		return nil
+	})
+}
+
+// Reference returns the ref with the name
+func (s *Storage) Reference(n plumbing.ReferenceName) (*plumbing.Reference, error) {
+	v, ok, err := s.db.get(s.refs(), n.String())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, plumbing.ErrReferenceNotFound
+	}
+	return plumbing.NewReferenceFromStrings(n.String(), string(v)), nil
+}
+
+// IterReferences returns all of the refs
+func (s *Storage) IterReferences() (storer.ReferenceIter, error) {
+	var refs []*plumbing.Reference
+	err := s.db.each(s.refs(), func(name string, v []byte) error {
+		refs = append(refs, plumbing.NewReferenceFromStrings(name, string(v)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return storer.NewReferenceSliceIter(refs), nil
+}
+
+// RemoveReference removes the ref with the name
+func (s *Storage) RemoveReference(n plumbing.ReferenceName) error {
+	return s.db.update(func(tx *tx) error {
+		if tx.has(s.refs(), n.String()) {
+			tx.delete(s.refs(), n.String())
+		}
+		return nil
+	})
+}
+
+// CountLooseRefs returns the number of refs, they are all loose
+func (s *Storage) CountLooseRefs() (int, error) {
+	return len(s.db.keys(s.refs())), nil
+}
+
+// PackRefs does nothing, the refs aren't in files
+func (s *Storage) PackRefs() error { return nil }
+
+// SetShallow writes the shallow commits
+func (s *Storage) SetShallow(commits []plumbing.Hash) error {
+	v := make([]byte, 0, len(commits)*len(plumbing.ZeroHash))
+	for _, h := range commits {
+		v = append(v, h[:]...)
+	}
+	return s.db.update(func(tx *tx) error {
+		tx.put(s.meta(), keyShallow, v)
+		return nil
+	})
+}
+
+// Shallow returns the shallow commits
+func (s *Storage) Shallow() ([]plumbing.Hash, error) {
+	v, _, err := s.db.get(s.meta(), keyShallow)
+	if err != nil {
+		return nil, err
+	}
+	var commits []plumbing.Hash
+	for len(v) >= len(plumbing.ZeroHash) {
+		var h plumbing.Hash
+		v = v[copy(h[:], v):]
+		commits = append(commits, h)
+	}
+	return commits, nil
+}
+
+// SetIndex writes the index
+func (s *Storage) SetIndex(idx *index.Index) error {
+	b := new(bytes.Buffer)
+	if err := index.NewEncoder(b).Encode(idx); err != nil {
+		return err
+	}
+	return s.db.update(func(tx *tx) error {
+		tx.put(s.meta(), keyIndex, b.Bytes())
+		return nil
+	})
+}
+
+// Index returns the index, an empty one when it wasn't written
+func (s *Storage) Index() (*index.Index, error) {
+	v, ok, err := s.db.get(s.meta(), keyIndex)
+	if err != nil {
+		return nil, err
+	}
+	idx := &index.Index{Version: 2}
+	if !ok {
+		return idx, nil
+	}
+	if err := index.NewDecoder(bytes.NewReader(v)).Decode(idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// SetConfig writes the config
+func (s *Storage) SetConfig(c *config.Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	b, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.db.update(func(tx *tx) error {
+		tx.put(s.meta(), keyConfig, b)
+		return nil
+	})
+}
+
+// Config returns the config, an empty one when it wasn't written
+func (s *Storage) Config() (*config.Config, error) {
+	v, ok, err := s.db.get(s.meta(), keyConfig)
+	if err != nil {
+		return nil, err
+	}
+	c := config.NewConfig()
+	if !ok {
+		return c, nil
+	}
+	if err := c.Unmarshal(v); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Module returns the storage of a submodule of the repository
+func (s *Storage) Module(name string) (storage.Storer, error) {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return nil, ErrName.F(name)
+	}
+	return &Storage{db: s.db, prefix: s.prefix + "module\x00" + name + "\x00"}, nil
+}
+
+// objectTx keeps the objects of a transaction until it is committed
+type objectTx struct {
+	*Storage
+	objs map[plumbing.Hash]plumbing.EncodedObject
+}
+
+// SetEncodedObject keeps the object for the commit
+func (t *objectTx) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	switch obj.Type() {
+	case plumbing.OFSDeltaObject, plumbing.REFDeltaObject:
+		return plumbing.ZeroHash, plumbing.ErrInvalidType
+	}
+	h := obj.Hash()
+	t.objs[h] = obj
+	return h, nil
+}
+
+// EncodedObject returns the object from the transaction, or else the storage
+func (t *objectTx) EncodedObject(typ plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	if obj, ok := t.objs[h]; ok && (typ == plumbing.AnyObject || obj.Type() == typ) {
+		return obj, nil
+	}
+	return t.Storage.EncodedObject(typ, h)
+}
+
+// HasEncodedObject returns nil when the transaction or the storage has the object
+func (t *objectTx) HasEncodedObject(h plumbing.Hash) error {
+	if _, ok := t.objs[h]; ok {
+		return nil
+	}
+	return t.Storage.HasEncodedObject(h)
+}
+
+// EncodedObjectSize returns the size of the object from the transaction, or else the storage
+func (t *objectTx) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	if obj, ok := t.objs[h]; ok {
+		return obj.Size(), nil
+	}
+	return t.Storage.EncodedObjectSize(h)
+}
+
+// Commit writes the objects of the transaction as one batch
+func (t *objectTx) Commit() error {
+	objs := make([]plumbing.EncodedObject, 0, len(t.objs))
+	for _, obj := range t.objs {
+		objs = append(objs, obj)
+	}
+	t.objs = make(map[plumbing.Hash]plumbing.EncodedObject)
+	return t.setObjects(objs...)
+}
+
+// Rollback throws away the objects of the transaction
+func (t *objectTx) Rollback() error {
+	t.objs = make(map[plumbing.Hash]plumbing.EncodedObject)
+	return nil
+}
+
+// packWriter keeps a packfile in a temporary file until it is closed, then its objects are
+// written to the storage as one batch
+type packWriter struct {
+	*os.File
+	s *Storage
+}
+
+// Close writes the objects of the packfile to the storage
+func (w *packWriter) Close() error {
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+
+	if fi, err := w.File.Stat(); err != nil || fi.Size() == 0 {
+		return err // nothing was written
+	}
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tx := w.s.Begin().(*objectTx)
+	p, err := packfile.NewParserWithStorage(packfile.NewScanner(w.File), tx)
+	if err != nil {
+		return err
+	}
+	if _, err := p.Parse(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,122 @@
+package cfgreplicate
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/revlist"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.xa4b.com/git/pktline"
+)
+
+// push sets the refs of the repository on the peer to where they are in sto. A ref that
+// isn't in sto is deleted from the peer. The refs are only moved on the peer when they are
+// still where it advertised them, so a push that races with another one fails and is
+// tried again.
+func (r *Replicator) push(ctx context.Context, p *peer, repoName string, sto storer.Storer, refNames []string) error {
+	url := p.url(repoName)
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return ErrPush.F(repoName, p.Name, err)
+	}
+	cli, err := client.NewClient(endpoint)
+	if err != nil {
+		return ErrPush.F(repoName, p.Name, err)
+	}
+	sess, err := cli.NewReceivePackSession(endpoint, p.Auth)
+	if err != nil {
+		return ErrPush.F(repoName, p.Name, err)
+	}
+	defer sess.Close()
+
+	adv, err := sess.AdvertisedReferences()
+	if err != nil {
+		return ErrPush.F(repoName, p.Name, err)
+	}
+	remote, err := adv.AllReferences()
+	if err != nil {
+		return ErrPush.F(repoName, p.Name, err)
+	}
+
+	req := packp.NewReferenceUpdateRequestFromCapabilities(adv.Capabilities)
+	var wants []plumbing.Hash
+	for _, refName := range refNames {
+		name := plumbing.ReferenceName(refName)
+		cmd := &packp.Command{Name: name}
+		if ref, err := sto.Reference(name); err == nil {
+			cmd.New = ref.Hash()
+		} else if err != plumbing.ErrReferenceNotFound {
+			return ErrPush.F(repoName, p.Name, err)
+		}
+		if ref, ok := remote[name]; ok {
+			cmd.Old = ref.Hash()
+		}
+
+		switch {
+		case cmd.Old == cmd.New:
+			continue // the peer has it already
+		case cmd.New.IsZero():
+			if !adv.Capabilities.Supports(capability.DeleteRefs) {
+				return ErrNoDeletes.F(repoName, p.Name)
+			}
+			req.Capabilities.Set(capability.DeleteRefs)
+		default:
+			wants = append(wants, cmd.New)
+		}
+		req.Commands = append(req.Commands, cmd)
+	}
+	if len(req.Commands) == 0 {
+		return nil
+	}
+
+	switch {
+	case adv.Capabilities.Supports(capability.Sideband64k):
+		req.Capabilities.Set(capability.Sideband64k)
+	case adv.Capabilities.Supports(capability.Sideband):
+		req.Capabilities.Set(capability.Sideband)
+	}
+
+	// go-git has no push-options, but they go right after the commands and before the
+	// pack, so they are written at the start of the packfile stream
+	body := new(bytes.Buffer)
+	if adv.Capabilities.Supports(capability.PushOptions) {
+		req.Capabilities.Set(capability.PushOptions)
+		enc := pktline.NewEncoder(body)
+		enc.EncodeString(MarkerOption + "=" + r.name)
+		enc.Flush()
+	}
+
+	if len(wants) > 0 {
+		// the objects of the refs that the peer has are left out of the pack
+		var haves []plumbing.Hash
+		for _, ref := range remote {
+			if ref.Type() == plumbing.HashReference && sto.HasEncodedObject(ref.Hash()) == nil {
+				haves = append(haves, ref.Hash())
+			}
+		}
+		objs, err := revlist.Objects(sto, wants, haves)
+		if err != nil {
+			return ErrPush.F(repoName, p.Name, err)
+		}
+		if _, err := packfile.NewEncoder(body, sto, false).Encode(objs, 10); err != nil {
+			return ErrPush.F(repoName, p.Name, err)
+		}
+	}
+	req.Packfile = ioutil.NopCloser(body)
+
+	report, err := sess.ReceivePack(ctx, req)
+	if err == nil && report != nil {
+		err = report.Error()
+	}
+	if err != nil {
+		return ErrPush.F(repoName, p.Name, err)
+	}
+	return nil
+}
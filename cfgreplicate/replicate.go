@@ -0,0 +1,360 @@
+// Package cfgreplicate pushes the refs that are accepted by one instance on to the other
+// instances (peers) of the same configuration, over the smart HTTP or SSH protocol:
+//
+//	r, err := cfgreplicate.New("east", []cfgreplicate.Peer{
+//		{URL: "https://west.example.com/git"},
+//		{URL: "ssh://git@north.example.com:2222", Auth: sshAuth},
+//	})
+//	// ...
+//	defer r.Close()
+//	cfghttp.NewServer(gs, cfghttp.WithReplicator(r))
+//
+// Each peer has its own queue, so a peer that is down doesn't hold up the others, and a
+// failed push is retried with a backoff. A replicated push carries the MarkerOption
+// push-option, which the replicator of the peer skips, so every instance lists all of the
+// others as its peers and a push is never sent around in a loop.
+package cfgreplicate /* import "gopkg.xa4b.com/git/cfgreplicate" */
+
+import (
+	"context"
+	logg "log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// MarkerOption is the push-option that a replicated push is sent with, its value is the
+// name of the instance that it came from. The peers need to allow push-options for it to
+// be sent, a peer that doesn't is pushed to without it.
+const MarkerOption = "replicated-from"
+
+// the defaults of a Replicator
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 5 * time.Minute
+	DefaultTimeout    = time.Minute
+)
+
+// Peer is another instance to replicate to. The name of the repository is added to the
+// end of the URL, so a push to the repository "config" with the URL https://host/git goes
+// to https://host/git/config. The name is what the status uses, it defaults to the URL.
+type Peer struct {
+	Name string
+	URL  string
+	Auth transport.AuthMethod
+}
+
+// PeerStatus is how replication to a peer is doing. The pending refs are waiting to be sent,
+// and the failures are the attempts that failed in a row since the last push that worked.
+type PeerStatus struct {
+	Name     string
+	Pending  int
+	Failures int
+
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   error
+	NextAttempt time.Time
+}
+
+// Option provides functional options for a Replicator
+type Option func(*Replicator)
+
+// WithBackoff sets how long to wait before a failed push is tried again, the wait doubles
+// with each failure from min up to max
+func WithBackoff(min, max time.Duration) Option {
+	return func(r *Replicator) {
+		r.minBackoff, r.maxBackoff = min, max
+	}
+}
+
+// WithRetries gives up on the refs of a peer after the pushes to it fail the number of
+// times in a row, zero or less keeps trying. The status keeps the error it gave up on.
+func WithRetries(n int) Option {
+	return func(r *Replicator) {
+		r.retries = n
+	}
+}
+
+// WithTimeout sets how long a single push to a peer can take, zero or less is no limit
+func WithTimeout(d time.Duration) Option {
+	return func(r *Replicator) {
+		r.timeout = d
+	}
+}
+
+// WithLogger adds a logger to the replicator. If *log.Logger is used then both debug and
+// info logs will be displayed. Wrap a *log.Logger in DebugLogger or InfoLogger to display
+// just the logs for one level.
+func WithLogger(logger ...interface{}) Option {
+	return func(r *Replicator) {
+		for _, l := range logger {
+			switch v := l.(type) {
+			case DebugLogger:
+				r.log.debug = v
+			case InfoLogger:
+				r.log.info = v
+			case *logg.Logger:
+				r.log.debug, r.log.info = v, v
+			default:
+				logg.Printf("invalid logger %T passed", v)
+			}
+		}
+	}
+}
+
+// Replicator sends the refs that are updated on this instance to its peers, it is a
+// cfg.Replicator for the servers of cfghttp and cfgssh
+type Replicator struct {
+	name  string
+	peers []*peer
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	retries    int
+	timeout    time.Duration
+	log        log
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a replicator for the instance with the name that pushes to the peers. Each
+// peer is sent to from its own goroutine until the replicator is closed.
+func New(name string, peers []Peer, opts ...Option) (*Replicator, error) {
+	if len(peers) == 0 {
+		return nil, ErrNoPeers
+	}
+
+	r := &Replicator{
+		name:       name,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		timeout:    DefaultTimeout,
+	}
+	for _, optFn := range opts {
+		optFn(r)
+	}
+
+	for _, p := range peers {
+		if _, err := transport.NewEndpoint(p.url("repo")); err != nil {
+			return nil, ErrBadPeer.F(p.URL, err)
+		}
+		if p.Name == "" {
+			p.Name = p.URL
+		}
+		r.peers = append(r.peers, &peer{
+			Peer:    p,
+			pending: make(map[string]*pending),
+			wake:    make(chan struct{}, 1),
+			status:  PeerStatus{Name: p.Name},
+		})
+	}
+
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	for _, p := range r.peers {
+		r.wg.Add(1)
+		go r.run(p)
+	}
+	return r, nil
+}
+
+// Replicate queues the refs of the repository to be pushed to every peer. A push that
+// carries the MarkerOption was replicated from another instance, so it isn't sent on. The
+// refs are pushed as they are at the time they are sent, so a ref that changes again
+// before then is only pushed once.
+func (r *Replicator) Replicate(repoName string, sto storer.Storer, refs []cfg.ReceivePackData, pushOptions cfg.PushOptions) {
+	if from, ok := pushOptions.Get(MarkerOption); ok {
+		r.log.Debug("replicate: skip", repoName, "replicated from", from)
+		return
+	}
+	for _, p := range r.peers {
+		p.add(repoName, sto, refs)
+	}
+}
+
+// Status returns how replication is doing for each peer, in the order they were given
+func (r *Replicator) Status() []PeerStatus {
+	var out []PeerStatus
+	for _, p := range r.peers {
+		p.mu.Lock()
+		status := p.status
+		for _, pend := range p.pending {
+			status.Pending += len(pend.refs)
+		}
+		p.mu.Unlock()
+		out = append(out, status)
+	}
+	return out
+}
+
+// Close stops sending to the peers and waits for the pushes in flight, the refs that
+// haven't been sent yet are dropped
+func (r *Replicator) Close() error {
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+// run sends the refs of the peer as they are queued, and tries again after a backoff
+// when a push fails
+func (r *Replicator) run(p *peer) {
+	defer r.wg.Done()
+
+	var next <-chan time.Time
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-next:
+		case <-p.wake:
+			if next != nil {
+				continue // the backoff isn't cut short by more refs
+			}
+		}
+
+		next = nil
+		if err := r.send(p); err != nil {
+			if wait := r.backoff(p, err); wait > 0 {
+				next = time.After(wait)
+			}
+		}
+	}
+}
+
+// send pushes everything that is pending for the peer, the repositories that fail are put
+// back to be sent again
+func (r *Replicator) send(p *peer) error {
+	p.mu.Lock()
+	pend := p.pending
+	p.pending = make(map[string]*pending)
+	p.mu.Unlock()
+
+	repoNames := make([]string, 0, len(pend))
+	for repoName := range pend {
+		repoNames = append(repoNames, repoName)
+	}
+	sort.Strings(repoNames)
+
+	var lastErr error
+	for _, repoName := range repoNames {
+		refNames := make([]string, 0, len(pend[repoName].refs))
+		for refName := range pend[repoName].refs {
+			refNames = append(refNames, refName)
+		}
+		sort.Strings(refNames)
+
+		p.mu.Lock()
+		p.status.LastAttempt = time.Now()
+		p.mu.Unlock()
+
+		ctx, cancel := r.ctx, context.CancelFunc(func() {})
+		if r.timeout > 0 {
+			ctx, cancel = context.WithTimeout(r.ctx, r.timeout)
+		}
+		err := r.push(ctx, p, repoName, pend[repoName].sto, refNames)
+		cancel()
+
+		if err != nil {
+			r.log.Info("replicate:", err)
+			lastErr = err
+			p.readd(repoName, pend[repoName])
+			continue
+		}
+		r.log.Debug("replicate: pushed", repoName, refNames, "to", p.Name)
+	}
+
+	if lastErr == nil {
+		p.mu.Lock()
+		p.status.LastSuccess, p.status.LastError = time.Now(), nil
+		p.status.Failures, p.status.NextAttempt = 0, time.Time{}
+		p.mu.Unlock()
+	}
+	return lastErr
+}
+
+// backoff records the failed attempt of the peer and returns how long to wait before the
+// next one, it is zero when the replicator gives up on what is pending
+func (r *Replicator) backoff(p *peer, err error) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.status.Failures++
+	p.status.LastError = err
+	if r.retries > 0 && p.status.Failures >= r.retries {
+		r.log.Info("replicate:", ErrGaveUp.F(p.Name, p.status.Failures, err))
+		p.status.LastError = ErrGaveUp.F(p.Name, p.status.Failures, err)
+		p.status.Failures, p.status.NextAttempt = 0, time.Time{}
+		p.pending = make(map[string]*pending)
+		return 0
+	}
+
+	wait := r.minBackoff
+	for i := 1; i < p.status.Failures && wait < r.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > r.maxBackoff {
+		wait = r.maxBackoff
+	}
+	p.status.NextAttempt = time.Now().Add(wait)
+	return wait
+}
+
+// peer is the queue of a single peer
+type peer struct {
+	Peer
+
+	mu      sync.Mutex
+	pending map[string]*pending // by repository name
+	status  PeerStatus
+	wake    chan struct{}
+}
+
+// pending is the refs of a repository that are waiting to be pushed
+type pending struct {
+	sto  storer.Storer
+	refs map[string]bool
+}
+
+// url returns where the repository is on the peer
+func (p Peer) url(repoName string) string {
+	return strings.TrimRight(p.URL, "/") + "/" + strings.TrimLeft(repoName, "/")
+}
+
+// add queues the refs of the repository and wakes up the sender
+func (p *peer) add(repoName string, sto storer.Storer, refs []cfg.ReceivePackData) {
+	p.mu.Lock()
+	pend, ok := p.pending[repoName]
+	if !ok {
+		pend = &pending{sto: sto, refs: make(map[string]bool)}
+		p.pending[repoName] = pend
+	}
+	for _, ref := range refs {
+		pend.refs[ref.RefName] = true
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default: // already woken up
+	}
+}
+
+// readd puts back the refs of a repository that failed to send, along with the ones that
+// were queued for it in the meantime
+func (p *peer) readd(repoName string, failed *pending) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pend, ok := p.pending[repoName]; ok {
+		for refName := range pend.refs {
+			failed.refs[refName] = true
+		}
+	}
+	p.pending[repoName] = failed
+}
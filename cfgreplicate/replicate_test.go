@@ -0,0 +1,169 @@
+package cfgreplicate
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.xa4b.com/git/cfg"
+	"gopkg.xa4b.com/git/cfghttp"
+)
+
+// recorder is a cfg.Replicator that keeps the push-options it is given
+type recorder struct {
+	mu      sync.Mutex
+	options []cfg.PushOptions
+}
+
+func (r *recorder) Replicate(_ string, _ storer.Storer, _ []cfg.ReceivePackData, pushOptions cfg.PushOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.options = append(r.options, pushOptions)
+}
+
+func TestReplicator(t *testing.T) {
+	sto := memory.NewStorage()
+	fs := memfs.New()
+	repo, err := git.Init(sto, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(name, contents string) plumbing.Hash {
+		if err := util.WriteFile(fs, name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wt.Add(name)
+		sig := &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+		h, err := wt.Commit("commit", &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	peerRepo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := new(recorder)
+	gs := cfghttp.LoadGoGit(map[string]*git.Repository{"config": peerRepo}, "file:///")
+	srv := httptest.NewServer(cfghttp.NewServer(gs, cfghttp.WithReplicator(rec)))
+	defer srv.Close()
+
+	r, err := New("east", []Peer{{Name: "west", URL: srv.URL}}, WithBackoff(10*time.Millisecond, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// the storages aren't safe to share, so the peer is only read after its replicator
+	// was called, and the local one is only written after the push is done
+	var pushes int
+	waitFor := func(refName string, want plumbing.Hash) {
+		t.Helper()
+		pushes++
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			rec.mu.Lock()
+			n := len(rec.options)
+			rec.mu.Unlock()
+			if status := r.Status()[0]; n == pushes && status.Pending == 0 && !status.LastSuccess.Before(status.LastAttempt) {
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("%s never got to %s: %+v", refName, want, r.Status())
+			}
+		}
+		ref, err := peerRepo.Storer.Reference(plumbing.ReferenceName(refName))
+		if !(err == plumbing.ErrReferenceNotFound && want.IsZero()) && !(err == nil && ref.Hash() == want) {
+			t.Fatalf("have: %v %v want: %s at %s", ref, err, refName, want)
+		}
+	}
+	replicate := func(refNames ...string) {
+		var refs []cfg.ReceivePackData
+		for _, refName := range refNames {
+			refs = append(refs, cfg.ReceivePackData{RefName: refName})
+		}
+		r.Replicate("config", sto, refs, nil)
+	}
+
+	h1 := commit("a.toml", "a = 1\n")
+	sto.SetReference(plumbing.NewHashReference("refs/heads/dev", h1))
+	replicate("refs/heads/master", "refs/heads/dev")
+	waitFor("refs/heads/master", h1)
+	if ref, err := peerRepo.Storer.Reference("refs/heads/dev"); err != nil || ref.Hash() != h1 {
+		t.Fatalf("have: %v %v want: refs/heads/dev at %s", ref, err, h1)
+	}
+
+	// only the new objects are sent on top of what the peer has
+	h2 := commit("b.toml", "b = 1\n")
+	replicate("refs/heads/master")
+	waitFor("refs/heads/master", h2)
+	if _, err := peerRepo.CommitObject(h2); err != nil {
+		t.Fatal(err)
+	}
+
+	sto.RemoveReference("refs/heads/dev")
+	replicate("refs/heads/dev")
+	waitFor("refs/heads/dev", plumbing.ZeroHash)
+
+	status := r.Status()
+	if len(status) != 1 || status[0].Name != "west" || status[0].LastError != nil || status[0].LastSuccess.IsZero() {
+		t.Fatalf("have: %+v want: west with no error", status)
+	}
+
+	// the peer is told where the push came from, and doesn't send it on
+	rec.mu.Lock()
+	options := rec.options
+	rec.mu.Unlock()
+	if len(options) != 3 {
+		t.Fatalf("have: %v want: 3 pushes", options)
+	}
+	for _, opts := range options {
+		if from, _ := opts.Get(MarkerOption); from != "east" {
+			t.Fatalf("have: %v want: %s=east", opts, MarkerOption)
+		}
+	}
+	r.Replicate("config", sto, []cfg.ReceivePackData{{RefName: "refs/heads/master"}}, options[0])
+	if status := r.Status(); status[0].Pending != 0 {
+		t.Fatalf("have: %d pending want: a replicated push to be skipped", status[0].Pending)
+	}
+
+	// a peer that is down is retried until the replicator gives up
+	down := httptest.NewServer(nil)
+	down.Close()
+	r2, err := New("east", []Peer{{URL: down.URL}}, WithBackoff(time.Millisecond, 2*time.Millisecond), WithRetries(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	r2.Replicate("config", sto, []cfg.ReceivePackData{{RefName: "refs/heads/master"}}, nil)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		status := r2.Status()[0]
+		if errors.Is(status.LastError, ErrGaveUp) {
+			if status.Pending != 0 || status.LastSuccess != (time.Time{}) {
+				t.Fatalf("have: %+v want: nothing pending and no success", status)
+			}
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("have: %+v want: %v", status, ErrGaveUp)
+		}
+	}
+
+	if _, err := New("east", nil); err != ErrNoPeers {
+		t.Fatalf("have: %v want: %v", err, ErrNoPeers)
+	}
+}
@@ -0,0 +1,53 @@
+package cfgssh
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// Channel is the ssh.Channel that is passed to the handlers. It carries
+// the environment that the client asked for before the command was run,
+// and a context that is done once the channel is closed.
+type Channel struct {
+	ssh.Channel
+
+	env    map[string]string
+	ctx    context.Context
+	pusher cfg.Pusher
+}
+
+// Pusher returns who is on the other end of the channel
+func (ch *Channel) Pusher() cfg.Pusher { return ch.pusher }
+
+// Context returns the context of the channel, it is done when the channel is
+// closed by either side or when the connection is lost.
+func (ch *Channel) Context() context.Context {
+	if ch.ctx == nil {
+		return context.Background()
+	}
+	return ch.ctx
+}
+
+// Getenv returns the value of the environment variable key that the client
+// requested for the session. An empty string is returned if it wasn't set.
+func (ch *Channel) Getenv(key string) string { return ch.env[key] }
+
+// getenv returns the value of the environment variable key if the channel
+// carries an environment, otherwise an empty string is returned.
+func getenv(rw ssh.Channel, key string) string {
+	if ch, ok := rw.(interface{ Getenv(string) string }); ok {
+		return ch.Getenv(key)
+	}
+	return ""
+}
+
+// channelContext returns the context of the channel if it carries one,
+// otherwise a context that is never done is returned.
+func channelContext(rw ssh.Channel) context.Context {
+	if ch, ok := rw.(interface{ Context() context.Context }); ok {
+		return ch.Context()
+	}
+	return context.Background()
+}
@@ -0,0 +1,9 @@
+package cfgssh
+
+import "gopkg.xa4b.com/git/cfg"
+
+// WithCreateOnPush makes a repository the first time it is pushed to, when its name isn't
+// in the registry and c authorizes the pusher, see cfg.CreateOnPush
+func (s *GoGitServer) WithCreateOnPush(c cfg.CreateOnPush) {
+	s.srv.CreateOnPush = &c
+}
@@ -3,6 +3,8 @@ package cfgssh
 import (
 	"errors"
 	"fmt"
+
+	"gopkg.xa4b.com/git/protocol"
 )
 
 // strErr is a simple type that will convert a string
@@ -56,7 +58,6 @@ func (e fmtErr) Unwrap() error { return errors.Unwrap(e.err) }
 
 // returns all of the errors
 const (
-	ErrSession        strErr = "%s session: %v"
 	ErrSessionAdvRefs strErr = "%s session advertised references: %v"
 
 	ErrAdvRefsEncode   strErr = "%s advertied references encode: %v"
@@ -67,8 +68,26 @@ const (
 	ErrRequestDecode  strErr = "%s request decode: %v"
 
 	ErrReceivePack strErr = "bad receive pack: %v"
+	ErrPushOptions strErr = "bad push-options: %v"
 	ErrUploadPack  strErr = "bad upload pack: %v"
 
-	ErrTransportEndpoint strErr = "repo [%s] endpoint invalid: %v"
-	ErrEmptyHookData     strErr = "empty receive-pack hook data"
+	ErrEmptyHookData strErr = "empty receive-pack hook data"
+
+	ErrRollbackDenied      strErr = "%s %s: not allowed: %v"
+	ErrRollbackUnsupported strErr = "%s %s: the git server can't roll back"
+)
+
+// the errors of the server that the transport is built on, see protocol.Server
+const (
+	ErrSession           = protocol.ErrSession
+	ErrTransportEndpoint = protocol.ErrEndpoint
+	ErrNamespace         = protocol.ErrRepoNamespace
+
+	ErrCommitRejected = protocol.ErrCommitRejected
+	ErrCommitStale    = protocol.ErrCommitStale
+	ErrCommitFailed   = protocol.ErrCommitFailed
+
+	ErrMirrorPush  = protocol.ErrMirrorPush
+	ErrNotMirror   = protocol.ErrNotMirror
+	ErrMirrorFetch = protocol.ErrMirrorFetch
 )
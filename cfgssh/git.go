@@ -1,6 +1,10 @@
 package cfgssh
 
 import (
+	"context"
+	"io"
+	"time"
+
 	"golang.org/x/crypto/ssh"
 	"gopkg.xa4b.com/git/cfg"
 )
@@ -15,6 +19,52 @@ type GitServer interface {
 	WithPostReceiveHook(cfg.PostReceivePackHookFunc)
 }
 
+// The optional interfaces below are what a GitServer implements for the server options
+// that need more than the GitServer interface, GoGitServer implements all of them. An
+// option is ignored when the GitServer doesn't implement its interface.
+
+// HookGitServer is a GitServer with the hooks that are passed a context, the per-ref
+// pre-receive hooks and the hook timeouts
+type HookGitServer interface {
+	WithPreReceiveHookContext(cfg.PreReceivePackHookContextFunc)
+	WithPreReceiveRefHook(cfg.PreReceivePackRefHookFunc)
+	WithPreReceiveRefHookContext(cfg.PreReceivePackRefHookContextFunc)
+	WithPostReceiveHookContext(cfg.PostReceivePackHookContextFunc)
+	WithHookTimeouts(pre, post time.Duration)
+}
+
+// LimitGitServer is a GitServer that limits the push-options and the packfile of a push
+type LimitGitServer interface {
+	WithPushOptionsLimit(count, size int)
+	WithPackLimits(maxSize, spillSize int64)
+}
+
+// ReplicaGitServer is a GitServer that sends the refs that each push updates to a replicator
+type ReplicaGitServer interface {
+	WithReplicator(cfg.Replicator)
+}
+
+// MirrorGitServer is a GitServer that serves read-only mirrors of upstream repositories
+type MirrorGitServer interface {
+	WithMirror(repoName string, m cfg.Mirror)
+}
+
+// CreateGitServer is a GitServer that makes a repository the first time it is pushed to
+type CreateGitServer interface {
+	WithCreateOnPush(cfg.CreateOnPush)
+}
+
+// NamespaceGitServer is a GitServer that serves the requests from git namespaces
+type NamespaceGitServer interface {
+	WithNamespace(cfg.NamespaceFunc)
+}
+
+// RollbackGitServer is a GitServer that rolls refs back with a new commit, for the commands
+// of WithRollbackCommands
+type RollbackGitServer interface {
+	Rollback(ctx context.Context, w io.Writer, repoName string, r cfg.Rollback) (string, error)
+}
+
 // ReceivePacker returns SSH requests for 'receive-pack'
 type ReceivePacker interface {
 	DoSSH(ssh.Channel) ReceivePacker
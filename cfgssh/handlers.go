@@ -1,7 +1,13 @@
 package cfgssh
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
 	"golang.org/x/crypto/ssh"
+	"gopkg.xa4b.com/git/cfg"
 )
 
 // ReceivePackHandler handles SSH calls to 'receive-pack'
@@ -32,8 +38,76 @@ func (s *Server) UploadPackHandler(repoName string, rw ssh.Channel) {
 	ExitCode(rw, 0)
 }
 
+// RollbackHandler handles SSH calls to 'rollback', which rolls a ref back to an earlier
+// commit. The arguments are: <repo> <ref> <commit> [reason...]
+//
+// The calls are rejected unless the server has WithRollbackCommands and it authorizes them.
+func (s *Server) RollbackHandler(args string, rw ssh.Channel) {
+	s.rollback("rollback", args, rw)
+}
+
+// RevertHandler handles SSH calls to 'revert', which reverts a single commit of a ref.
+// The arguments are: <repo> <ref> <commit> [reason...]
+func (s *Server) RevertHandler(args string, rw ssh.Channel) {
+	s.rollback("revert", args, rw)
+}
+
+// rollback does a rollback or a revert for the SSH command cmd, the hash of the new
+// commit is written back on success
+func (s *Server) rollback(cmd, args string, rw ssh.Channel) {
+	fields := strings.Fields(args)
+	if len(fields) < 3 {
+		fmt.Fprintf(rw.Stderr(), "usage: %s <repo> <ref> <commit> [reason...]\n", cmd)
+		ExitCode(rw, 1)
+		return
+	}
+
+	repoName := strings.TrimLeft(strings.Trim(fields[0], "'"), "/")
+	if err := s.allowRollback(channelContext(rw), repoName, channelPusher(rw)); err != nil {
+		s.log.Info(s.logPrefix, cmd, "denied:", err)
+		fmt.Fprintln(rw.Stderr(), ErrRollbackDenied.F(cmd, repoName, err))
+		ExitCode(rw, 1)
+		return
+	}
+
+	refName := fields[1]
+	if !strings.HasPrefix(refName, "refs/") {
+		refName = "refs/heads/" + refName
+	}
+	r := cfg.Rollback{
+		RefName: refName,
+		Target:  fields[2],
+		Revert:  cmd == "revert",
+		Reason:  strings.Join(fields[3:], " "),
+		Pusher:  channelPusher(rw),
+	}
+
+	gs, ok := s.git.(RollbackGitServer)
+	if !ok {
+		fmt.Fprintln(rw.Stderr(), ErrRollbackUnsupported.F(cmd, repoName))
+		ExitCode(rw, 1)
+		return
+	}
+	h, err := gs.Rollback(channelContext(rw), rw, repoName, r)
+	if err != nil {
+		fmt.Fprintln(rw.Stderr(), err)
+		ExitCode(rw, 1)
+		return
+	}
+	fmt.Fprintln(rw, h)
+	ExitCode(rw, 0)
+}
+
+// allowRollback returns nil when the pusher can roll back the repository
+func (s *Server) allowRollback(ctx context.Context, repoName string, p cfg.Pusher) error {
+	if s.authorizeRollback == nil {
+		return errors.New("no authorization")
+	}
+	return s.authorizeRollback(ctx, repoName, p)
+}
+
 // ExitCode sends a specific exit status back to the SSH channel. If no code is
 // sent then the channel closes with a error code of -1
 func ExitCode(rw ssh.Channel, code uint32) {
-	rw.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(0)}))
+	rw.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{code}))
 }
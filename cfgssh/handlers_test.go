@@ -0,0 +1,183 @@
+package cfgssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+var (
+	_ GitServer          = &GoGitServer{}
+	_ HookGitServer      = &GoGitServer{}
+	_ LimitGitServer     = &GoGitServer{}
+	_ ReplicaGitServer   = &GoGitServer{}
+	_ MirrorGitServer    = &GoGitServer{}
+	_ CreateGitServer    = &GoGitServer{}
+	_ NamespaceGitServer = &GoGitServer{}
+	_ RollbackGitServer  = &GoGitServer{}
+)
+
+// serve runs a server of gs on a local port until it is closed, every user can connect
+// with any password
+func serve(t *testing.T, gs GitServer, opts ...ServerOption) (addr string, stop func()) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+		return nil, nil
+	}}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := NewServer(gs, opts...)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(ssh.NewServerConn(conn, config))
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// run runs the command on the server at addr as the user, and returns what it wrote
+func run(t *testing.T, addr, user, cmd string) (stdout, stderr string, err error) {
+	t.Helper()
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password("")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	var out, errOut bytes.Buffer
+	sess.Stdout, sess.Stderr = &out, &errOut
+	err = sess.Run(cmd)
+	return out.String(), errOut.String(), err
+}
+
+func TestRollbackHandler(t *testing.T) {
+	ctx := context.Background()
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := LoadGoGit(map[string]*git.Repository{"config": repo}, "file:///")
+
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1e9, 0)}
+	commit := func(oldHash, content string) string {
+		t.Helper()
+		h, err := gs.Commit(ctx, nil, "config", cfg.Commit{
+			RefName: "refs/heads/master",
+			OldHash: oldHash,
+			Files:   []cfg.CommitFile{{Path: "configuration.toml", Content: []byte(content)}},
+			Message: "commit",
+			Author:  sig,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	c1 := commit("", "a = 1\n")
+	c2 := commit(c1, "a = 2\n")
+	cmd := "rollback config master " + c1 + " a is too high"
+
+	head := func() string {
+		t.Helper()
+		ref, err := repo.Reference(plumbing.Master, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref.Hash().String()
+	}
+
+	// the commands are only served with WithRollbackCommands
+	addr, stop := serve(t, gs)
+	defer stop()
+	if _, _, err := run(t, addr, "ops", cmd); err == nil || head() != c2 {
+		t.Fatalf("have: %v at %s want: an error at %s", err, head(), c2)
+	}
+
+	// a git server with only the GitServer methods can't roll back, and the options that
+	// need more than those are ignored
+	allow := func(context.Context, string, cfg.Pusher) error { return nil }
+	addr, stop = serve(t, struct{ GitServer }{gs}, WithRollbackCommands(allow), WithNamespace(cfg.NamespaceFromUsername))
+	defer stop()
+	if _, stderr, err := run(t, addr, "ops", cmd); err == nil || !strings.Contains(stderr, "can't roll back") || head() != c2 {
+		t.Fatalf("have: %v %q at %s want: an error at %s", err, stderr, head(), c2)
+	}
+
+	addr, stop = serve(t, gs, WithRollbackCommands(func(_ context.Context, repoName string, p cfg.Pusher) error {
+		if repoName != "config" || p.Username != "ops" {
+			return errors.New("only ops can roll back")
+		}
+		return nil
+	}))
+	defer stop()
+
+	_, stderr, err := run(t, addr, "other", cmd)
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 || !strings.Contains(stderr, "only ops can roll back") {
+		t.Fatalf("have: %v %q want: exit status 1 and not allowed", err, stderr)
+	}
+	if head() != c2 {
+		t.Fatalf("have: %s want: %s", head(), c2)
+	}
+
+	stdout, stderr, err := run(t, addr, "ops", cmd)
+	if err != nil {
+		t.Fatalf("have: %v %q want: no error", err, stderr)
+	}
+	h := strings.TrimSpace(stdout)
+	if head() != h {
+		t.Fatalf("have: %s want: master at %s", head(), h)
+	}
+
+	c, err := repo.CommitObject(plumbing.NewHash(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Author.Name != "ops" || c.Author.Email != "ops@127.0.0.1" {
+		t.Fatalf("have: %s <%s> want: ops <ops@127.0.0.1>", c.Author.Name, c.Author.Email)
+	}
+	if !strings.Contains(c.Message, "a is too high") || len(c.ParentHashes) != 1 || c.ParentHashes[0].String() != c2 {
+		t.Fatalf("have: %q on %v want: the reason on %s", c.Message, c.ParentHashes, c2)
+	}
+}
@@ -1,7 +1,9 @@
 package cfgssh
 
 import (
+	"context"
 	"io"
+	"time"
 
 	"gopkg.xa4b.com/git/cfg"
 )
@@ -27,6 +29,40 @@ func WithPreReceiveHook(fn func(io.Writer, *cfg.PreReceivePackHookData) (string,
 	}
 }
 
+// WithPreReceiveHookContext adds a pre-receive hook to the handler the same as
+// WithPreReceiveHook, the hook is passed a context that is done when the client goes
+// away or when the hook runs out of time (see WithHookTimeouts).
+func WithPreReceiveHookContext(fn func(context.Context, io.Writer, *cfg.PreReceivePackHookData) (string, *cfg.ReceivePackHookError)) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(HookGitServer); ok {
+			gs.WithPreReceiveHookContext(fn)
+		}
+	}
+}
+
+// WithPreReceiveRefHook adds a pre-receive hook to the handler that accepts or rejects
+// each ref of a push on its own, refs without a decision in the result are accepted.
+// A rejected ref gets the first line of its reason in the report-status, and the
+// whole reason is sent to the client before it. It runs after WithPreReceiveHook.
+func WithPreReceiveRefHook(fn func(io.Writer, *cfg.PreReceivePackHookData) *cfg.PreReceivePackHookResult) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(HookGitServer); ok {
+			gs.WithPreReceiveRefHook(fn)
+		}
+	}
+}
+
+// WithPreReceiveRefHookContext adds a pre-receive hook to the handler the same as
+// WithPreReceiveRefHook, the hook is passed a context that is done when the client goes
+// away or when the hook runs out of time (see WithHookTimeouts).
+func WithPreReceiveRefHookContext(fn func(context.Context, io.Writer, *cfg.PreReceivePackHookData) *cfg.PreReceivePackHookResult) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(HookGitServer); ok {
+			gs.WithPreReceiveRefHookContext(fn)
+		}
+	}
+}
+
 // WithPostReceiveHook adds a post-recieve hook to the handler, sending nil to the handler will sucessfully execute the git commad
 // send a non nil error to reject the recieve. All writes the the writer will be
 // done with newlines, otherwise it may be cut off.
@@ -35,3 +71,104 @@ func WithPostReceiveHook(fn func(io.Writer, *cfg.PostReceivePackHookData)) Serve
 		s.git.WithPostReceiveHook(fn)
 	}
 }
+
+// WithPostReceiveHookContext adds a post-receive hook to the handler the same as
+// WithPostReceiveHook, the hook is passed a context that is done when the client goes
+// away or when the hook runs out of time (see WithHookTimeouts).
+func WithPostReceiveHookContext(fn func(context.Context, io.Writer, *cfg.PostReceivePackHookData)) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(HookGitServer); ok {
+			gs.WithPostReceiveHookContext(fn)
+		}
+	}
+}
+
+// WithHookTimeouts limits how long the pre-receive and post-receive hooks can each run
+// for, a limit of zero or less is not enforced. When a pre-receive hook runs out of time
+// every ref of the push is rejected with a message that says so. A post-receive hook that
+// runs out of time can't undo the push, the client is told that it timed out instead.
+// Either way the context of the hook is done, so it should stop what it is doing.
+func WithHookTimeouts(pre, post time.Duration) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(HookGitServer); ok {
+			gs.WithHookTimeouts(pre, post)
+		}
+	}
+}
+
+// WithPushOptionsLimit limits the number of push-options (git push -o) that a single
+// push can send, and the size in bytes of each one. A push that breaks either limit
+// has all of its refs rejected. A limit of zero or less is not enforced.
+func WithPushOptionsLimit(count, size int) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(LimitGitServer); ok {
+			gs.WithPushOptionsLimit(count, size)
+		}
+	}
+}
+
+// WithPackLimits limits the size in bytes of the packfile that a single push can send,
+// a push with a larger pack has all of its refs rejected. A max size of zero or less is
+// not enforced. Packs larger than spillSize are spooled to a temporary file while they
+// are received, so memory use stays bounded no matter the size of the push.
+func WithPackLimits(maxSize, spillSize int64) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(LimitGitServer); ok {
+			gs.WithPackLimits(maxSize, spillSize)
+		}
+	}
+}
+
+// WithReplicator sends the refs that each push updates on to other instances with the
+// replicator r (see the cfgreplicate package), after the refs are updated.
+func WithReplicator(r cfg.Replicator) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(ReplicaGitServer); ok {
+			gs.WithReplicator(r)
+		}
+	}
+}
+
+// WithMirror makes the repository a read-only mirror of the upstream m, pushes to it are
+// rejected with the URL of the upstream. Call RunMirrors on the GoGitServer to keep the
+// mirrors up to date.
+func WithMirror(repoName string, m cfg.Mirror) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(MirrorGitServer); ok {
+			gs.WithMirror(repoName, m)
+		}
+	}
+}
+
+// WithCreateOnPush makes a repository the first time it is pushed to, when its name isn't
+// in the registry and c authorizes the pusher. Without it a push to an unknown name fails.
+func WithCreateOnPush(c cfg.CreateOnPush) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(CreateGitServer); ok {
+			gs.WithCreateOnPush(c)
+		}
+	}
+}
+
+// WithNamespace serves each request from a git namespace of a repository that fn picks,
+// such as cfg.NamespaceFromRepoName or cfg.NamespaceFromUsername. A fetch only sees the
+// refs of the namespace, without the refs/namespaces/<name>/ prefix, and a push only
+// changes them. The objects are shared, so tenants with mostly the same configuration
+// can share one repository.
+func WithNamespace(fn cfg.NamespaceFunc) ServerOption {
+	return func(s *Server) {
+		if gs, ok := s.git.(NamespaceGitServer); ok {
+			gs.WithNamespace(fn)
+		}
+	}
+}
+
+// WithRollbackCommands adds the 'rollback' and 'revert' commands (see RollbackHandler),
+// which make a commit on a ref without a push. Without it they aren't served. Each call is
+// made only after authorize returns nil for the repository and who is connected. The
+// GitServer has to be a RollbackGitServer, otherwise the commands fail.
+func WithRollbackCommands(authorize func(ctx context.Context, repoName string, p cfg.Pusher) error) ServerOption {
+	return func(s *Server) {
+		s.authorizeRollback = authorize
+	}
+}
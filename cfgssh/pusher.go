@@ -0,0 +1,55 @@
+package cfgssh
+
+import (
+	"golang.org/x/crypto/ssh"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// The ssh.Permissions extensions that describe who is pushing. They are set
+// by the auth callbacks of the ssh.ServerConfig, PublicKeyPermissions sets them
+// for public keys. A username extension is used instead of the SSH user name,
+// since every user usually logs in as the same user (i.e. git).
+const (
+	ExtUsername       = "x-git-username"
+	ExtAuthMethod     = "x-git-auth-method"
+	ExtKeyFingerprint = "x-git-key-fingerprint"
+)
+
+// PublicKeyPermissions returns the permissions for a user that was authenticated
+// with the public key, for the ssh.ServerConfig PublicKeyCallback to return. An
+// empty username keeps the SSH user name.
+func PublicKeyPermissions(username string, key ssh.PublicKey) *ssh.Permissions {
+	perms := &ssh.Permissions{Extensions: map[string]string{
+		ExtAuthMethod:     "publickey",
+		ExtKeyFingerprint: ssh.FingerprintSHA256(key),
+	}}
+	if username != "" {
+		perms.Extensions[ExtUsername] = username
+	}
+	return perms
+}
+
+// newPusher returns who is pushing over the connection c. The SSH user name is
+// used unless the auth callback set the username extension, note that with
+// NoClientAuth the SSH user name is whatever the client sent.
+func newPusher(c *ssh.ServerConn) cfg.Pusher {
+	p := cfg.Pusher{Username: c.User(), RemoteAddr: c.RemoteAddr().String()}
+	if c.Permissions == nil {
+		return p
+	}
+
+	ext := c.Permissions.Extensions
+	if ext[ExtUsername] != "" {
+		p.Username = ext[ExtUsername]
+	}
+	p.AuthMethod, p.KeyFingerprint = ext[ExtAuthMethod], ext[ExtKeyFingerprint]
+	return p
+}
+
+// channelPusher returns who is pushing if the channel carries it
+func channelPusher(rw ssh.Channel) cfg.Pusher {
+	if ch, ok := rw.(interface{ Pusher() cfg.Pusher }); ok {
+		return ch.Pusher()
+	}
+	return cfg.Pusher{}
+}
@@ -1,6 +1,7 @@
 package cfgssh /* import "gopkg.xa4b.com/git/cfgssh" */
 
 import (
+	"context"
 	"fmt"
 	logg "log"
 	"os"
@@ -8,13 +9,18 @@ import (
 	"strings"
 
 	"golang.org/x/crypto/ssh"
+	"gopkg.xa4b.com/git/cfg"
 	"gopkg.xa4b.com/git/pktline"
 )
 
 // Server holds the handlers for requests
 // that the git client can make via SSH
 type Server struct {
-	git GitServer
+	git    GitServer
+	pusher cfg.Pusher
+
+	// authorizeRollback is set by WithRollbackCommands
+	authorizeRollback func(ctx context.Context, repoName string, p cfg.Pusher) error
 
 	logPrefix string
 	log       log
@@ -28,7 +34,7 @@ func NewServer(gs GitServer, opts ...ServerOption) func(*ssh.ServerConn, <-chan
 			return err
 		}
 
-		s := &Server{git: gs}
+		s := &Server{git: gs, pusher: newPusher(c)}
 		for _, optFn := range opts {
 			optFn(s)
 		}
@@ -36,6 +42,10 @@ func NewServer(gs GitServer, opts ...ServerOption) func(*ssh.ServerConn, <-chan
 		mux := NewMux()
 		mux.HandlerFunc("git-receive-pack", HandlerFunc(s.ReceivePackHandler))
 		mux.HandlerFunc("git-upload-pack", HandlerFunc(s.UploadPackHandler))
+		if s.authorizeRollback != nil {
+			mux.HandlerFunc("rollback", HandlerFunc(s.RollbackHandler))
+			mux.HandlerFunc("revert", HandlerFunc(s.RevertHandler))
+		}
 
 		s.ServeSSH(ch, r, mux)
 
@@ -68,15 +78,35 @@ func (s *Server) ServeSSH(chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request,
 		}
 		defer conn.Close()
 
+		env := make(map[string]string)
 		for req := range reqs {
-			if t := req.Type; t != "exec" {
+			switch t := req.Type; t {
+			case "env":
+				kv := struct{ Name, Value string }{}
+				if err := ssh.Unmarshal(req.Payload, &kv); err != nil {
+					s.log.Infof("%s env unmarshal error: %v", s.logPrefix, err)
+					continue
+				}
+				env[kv.Name] = kv.Value
+				if req.WantReply {
+					req.Reply(true, nil)
+				}
+				continue
+			case "exec":
+			default:
 				s.log.Debugf("unknown request type: %s", t)
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
 				continue
 			}
 
 			data := struct{ Payload string }{}
 			if err := ssh.Unmarshal(req.Payload, &data); err != nil {
 				s.log.Info(s.logPrefix, "payload unmarshal error: %v", err)
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
 				continue
 			}
 
@@ -88,13 +118,33 @@ func (s *Server) ServeSSH(chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request,
 
 			repoName := strings.TrimLeft(strings.Trim(cmd[1], "'"), "/")
 
+			// clients such as go-git wait for the exec to be accepted before they send anything
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+
+			// the rest of the requests are drained until the channel closes,
+			// which ends the context of the command
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func(reqs <-chan *ssh.Request) {
+				for req := range reqs {
+					if req.WantReply {
+						req.Reply(false, nil)
+					}
+				}
+				cancel()
+			}(reqs)
+
+			channel := &Channel{Channel: conn, env: env, ctx: ctx, pusher: s.pusher}
+
 			if handler, ok := mux.Handlers[cmd[0]]; ok {
-				handler(repoName, conn)
+				handler(repoName, channel)
 				return
 			}
 
 			if mux.NotFoundHandler != nil {
-				mux.NotFoundHandler(repoName, conn)
+				mux.NotFoundHandler(repoName, channel)
 				return
 			}
 
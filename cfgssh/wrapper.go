@@ -3,51 +3,53 @@ package cfgssh
 // This file wraps around the go-git library to create a GitServer interface
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"io"
 	logg "log"
-	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
 	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
-	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
 	"gopkg.xa4b.com/git/cfg"
-	"gopkg.xa4b.com/git/pktline"
+	"gopkg.xa4b.com/git/protocol"
 )
 
 // LoadGoGit loads a mapping of git repositories (go-git) to a repository endpoint
 func LoadGoGit(m map[string]*git.Repository, endpoint string) *GoGitServer {
-	ml := make(server.MapLoader)
-	for k, v := range m {
-		ml[endpoint+k] = v.Storer
-	}
+	return LoadRegistry(cfg.NewMapRegistry(m), endpoint)
+}
 
+// LoadRegistry loads the git repositories (go-git) of the registry to a repository endpoint.
+// Repositories that are added to the registry, or removed from it, are served right away.
+func LoadRegistry(reg cfg.Registry, endpoint string) *GoGitServer {
 	caps := []capability.Capability{
 		capability.Sideband,
 		capability.Sideband64k,
 		capability.PushOptions,
+		capability.Atomic,
 	}
 
-	return &GoGitServer{repos: m, transport: server.NewServer(ml), endpoint: endpoint, capabilities: caps, log: log{}}
+	return &GoGitServer{
+		srv: protocol.NewServer(reg, endpoint), capabilities: caps, log: log{},
+		maxPushOptions:    protocol.DefaultMaxPushOptions,
+		maxPushOptionSize: protocol.DefaultMaxPushOptionSize,
+	}
 }
 
 // GoGitServer wraps concepts for go-git into a GitServer SSH interface
 type GoGitServer struct {
-	repos     map[string]*git.Repository
-	transport transport.Transport
-	endpoint  string
+	srv *protocol.Server // the repositories, the hooks and what is done after a push
 
 	capabilities []capability.Capability
 	log          log
 
-	preReceiveHookFn  cfg.PreReceivePackHookFunc
-	postReceiveHookfn cfg.PostReceivePackHookFunc
+	maxPushOptions    int
+	maxPushOptionSize int
 }
 
 // WithLogger takes in logger/s to display debug and info logs for the GoGitServer object
@@ -64,31 +66,105 @@ func (s *GoGitServer) WithLogger(logger ...interface{}) {
 			logg.Printf("invalid logger %T passed", v)
 		}
 	}
+	s.srv.Log = s.log.Info
 }
 
 // WithPreReceiveHook sets the pre-receive hook for receive-pack requests
 func (s *GoGitServer) WithPreReceiveHook(fn cfg.PreReceivePackHookFunc) {
-	s.preReceiveHookFn = fn
+	s.srv.PreReceiveHook = nil
+	if fn != nil {
+		s.srv.PreReceiveHook = func(_ context.Context, w io.Writer, data *cfg.PreReceivePackHookData) (string, *cfg.ReceivePackHookError) {
+			return fn(w, data)
+		}
+	}
+}
+
+// WithPreReceiveHookContext sets the pre-receive hook for receive-pack requests, the
+// hook is passed a context that ends with the request or when the hook times out
+func (s *GoGitServer) WithPreReceiveHookContext(fn cfg.PreReceivePackHookContextFunc) {
+	s.srv.PreReceiveHook = fn
+}
+
+// WithPreReceiveRefHook sets the pre-receive hook that accepts or rejects each
+// ref of a receive-pack request on its own
+func (s *GoGitServer) WithPreReceiveRefHook(fn cfg.PreReceivePackRefHookFunc) {
+	s.srv.PreReceiveRefHook = nil
+	if fn != nil {
+		s.srv.PreReceiveRefHook = func(_ context.Context, w io.Writer, data *cfg.PreReceivePackHookData) *cfg.PreReceivePackHookResult {
+			return fn(w, data)
+		}
+	}
+}
+
+// WithPreReceiveRefHookContext sets the pre-receive hook that accepts or rejects each
+// ref of a receive-pack request on its own, the hook is passed a context that ends
+// with the request or when the hook times out
+func (s *GoGitServer) WithPreReceiveRefHookContext(fn cfg.PreReceivePackRefHookContextFunc) {
+	s.srv.PreReceiveRefHook = fn
 }
 
 // WithPostReceiveHook sets the post-receive hook for receive-pack requests
 func (s *GoGitServer) WithPostReceiveHook(fn cfg.PostReceivePackHookFunc) {
-	s.postReceiveHookfn = fn
+	s.srv.PostReceiveHook = nil
+	if fn != nil {
+		s.srv.PostReceiveHook = func(_ context.Context, w io.Writer, data *cfg.PostReceivePackHookData) {
+			fn(w, data)
+		}
+	}
+}
+
+// WithPostReceiveHookContext sets the post-receive hook for receive-pack requests, the
+// hook is passed a context that ends with the request or when the hook times out
+func (s *GoGitServer) WithPostReceiveHookContext(fn cfg.PostReceivePackHookContextFunc) {
+	s.srv.PostReceiveHook = fn
+}
+
+// WithHookTimeouts sets how long the pre-receive and post-receive hooks can each run
+// for, zero or less is no limit. A pre-receive hook that runs out of time rejects the push.
+func (s *GoGitServer) WithHookTimeouts(pre, post time.Duration) {
+	s.srv.PreReceiveTimeout, s.srv.PostReceiveTimeout = pre, post
+}
+
+// WithPushOptionsLimit sets the maximum number of push-options and the maximum
+// size of each push-option that a single push can send. Zero or less is unlimited.
+func (s *GoGitServer) WithPushOptionsLimit(count, size int) {
+	s.maxPushOptions, s.maxPushOptionSize = count, size
 }
 
+// WithPackLimits sets the maximum size of the packfile that a single push can send,
+// zero or less is unlimited. Packs that are larger than the spill size are written to a
+// temporary file while they are received, instead of being held in memory.
+func (s *GoGitServer) WithPackLimits(maxSize, spillSize int64) {
+	s.srv.MaxPackSize, s.srv.PackSpillSize = maxSize, spillSize
+}
+
+// WithReplicator sets the replicator that the refs updated by each push are sent to
+func (s *GoGitServer) WithReplicator(r cfg.Replicator) {
+	s.srv.Replicator = r
+}
+
+// Subscribe returns a subscription to the changes of the files that match the path glob
+// on the ref of the repository, an empty ref name is every ref. The repository name is the
+// same one the hooks are given. The events of a repository arrive in the order the pushes
+// were made, and a slow subscriber doesn't hold up a push. Close the subscription when done.
+func (s *GoGitServer) Subscribe(repoName, refName, glob string) *cfg.Subscription {
+	return s.srv.Subscribe(repoName, refName, glob)
+}
+
+// Registry returns the registry of the repositories that are served, so they can be
+// added, removed and renamed while the server runs
+func (s *GoGitServer) Registry() cfg.Registry { return s.srv.Registry }
+
 // ReceivePack holds all of the data needed to handle the git interface for
 // receive-pack requests through SSH
 type ReceivePack struct {
 	*GoGitServer
 
 	repoName string
-	encOpts  []pktline.EncoderOption
 	cleanup  []func()
 
-	sess  transport.ReceivePackSession
-	refs  *packp.AdvRefs
-	rReq  *packp.ReferenceUpdateRequest
-	rStat *packp.ReportStatus
+	sess transport.ReceivePackSession
+	refs *packp.AdvRefs
 
 	logPrefix string
 	err       error
@@ -114,12 +190,24 @@ func (rp *ReceivePack) DoSSH(rw ssh.Channel) ReceivePacker {
 		return rp
 	}
 
-	endpoint, err := transport.NewEndpoint(rp.endpoint + rp.repoName)
+	// a push to a namespace only sees and changes the refs of the namespace
+	repoName, ns, err := rp.srv.Namespace(rp.repoName, channelPusher(rw))
+	if err != nil {
+		return rp.withErr(ErrSession.F(rp.repoName, err))
+	}
+
+	endpoint, err := transport.NewEndpoint(rp.srv.Endpoint + repoName)
 	if err != nil {
-		return rp.withErr(ErrTransportEndpoint.F(rp.repoName, err))
+		return rp.withErr(ErrTransportEndpoint.F(repoName, err))
 	}
 
-	if rp.sess, err = rp.transport.NewReceivePackSession(endpoint, nil); err != nil {
+	// a repository that the push can make is advertised without refs
+	sto, err := rp.srv.ReceivePackStorer(channelContext(rw), repoName, ns, channelPusher(rw))
+	if err != nil {
+		return rp.withErr(ErrSession.F(rp.repoName, err))
+	}
+
+	if rp.sess, err = rp.srv.Sessions(sto).NewReceivePackSession(endpoint, nil); err != nil {
 		return rp.withErr(ErrSession.F(rp.repoName, err))
 	}
 
@@ -135,72 +223,23 @@ func (rp *ReceivePack) DoSSH(rw ssh.Channel) ReceivePacker {
 		return rp.withErr(err)
 	}
 
-	rp.rReq = packp.NewReferenceUpdateRequest()
-	rp.rReq.Progress = rw
-
-	buf := new(bytes.Buffer)
-	if err = rp.rReq.Decode(io.TeeReader(rw, buf)); err != nil {
+	// the commands and push-options are read up front, the packfile is
+	// left on the channel so it can be streamed into the repository
+	req, err := protocol.ReadReceiveRequest(rw, rp.maxPushOptions, rp.maxPushOptionSize)
+	switch {
+	case errors.Is(err, protocol.ErrPushOptionsCount), errors.Is(err, protocol.ErrPushOptionSize):
+		rp.log.Info(rp.logPrefix, "rejected:", err)
+		req.Report(rw, req.Reject(nil, err))
+		return rp // done
+	case err != nil:
 		return rp.withErr(ErrRequestDecode.F("receive-pack", err))
 	}
 
-	var hookData *cfg.ReceivePackHookData
-	// TODO(njones): add push-option support
-	rp.encOpts, hookData, err = encOpts(strings.NewReader(buf.String()))
-	if err != nil {
-		return rp.withErr(err) // pre-wrapped error
-	}
-	hookData.RepoName = rp.repoName
-
-	// the git pre-receive-hook function
-	if rp.preReceiveHookFn != nil {
-		rp.log.Debug(rp.logPrefix, "fn: (preHookFn)...")
-		buf := new(bytes.Buffer)
-		if hookData == nil {
-			return rp.withErr(ErrEmptyHookData.F(err))
-		}
-		refBranch, err := rp.preReceiveHookFn(buf, &cfg.PreReceivePackHookData{*hookData})
-		if err != nil {
-			enc := pktline.NewEncoder(rw, rp.encOpts...).WithSidebandCapability(pktline.Sideband64k)
-			scn := bufio.NewScanner(buf)
-			for scn.Scan() {
-				enc.Sideband.EncodeProgress(scn.Text() + "\n")
-			}
-			enc.EncodeString("unpack ok\n")
-			enc.EncodeString(fmt.Sprintf("ng %s %s\n", refBranch, err))
-			enc.Sideband.Flush()
-			enc.Flush()
-
-			return rp // the request is rejected so stop
-		}
-	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	rp.addCleanup(func() { cancel() })
-
-	if rp.rStat, err = rp.sess.ReceivePack(ctx, rp.rReq); err != nil {
-		return rp.withErr(ErrReceivePack.F(err))
-	}
-
-	if rp.postReceiveHookfn != nil {
-		if hookData == nil {
-			return rp.withErr(ErrEmptyHookData.F(err))
-		}
-		pr, pw := io.Pipe()
-		go func() {
-			rp.postReceiveHookfn(pw, &cfg.PostReceivePackHookData{*hookData, make(map[string]string)})
-			pw.Close()
-		}()
-		enc := pktline.NewEncoder(rw, rp.encOpts...).WithSidebandCapability(pktline.Sideband64k)
-		scn := bufio.NewScanner(pr)
-		for scn.Scan() {
-			enc.Sideband.EncodeProgress(scn.Text() + "\n")
-		}
+	// the hooks run with a context that ends with the SSH channel, so
+	// they can stop when the client goes away
+	if err := rp.srv.Push(channelContext(rw), rw, rp.repoName, channelPusher(rw), req); err != nil {
+		return rp.withErr(err)
 	}
-
-	enc := pktline.NewEncoder(rw, rp.encOpts...).WithSidebandCapability(pktline.Sideband64k)
-	pktline.ReportStatus(enc, rp.rStat)
-	enc.Flush()
-
 	return rp
 }
 
@@ -238,10 +277,8 @@ type UploadPack struct {
 	*GoGitServer
 	repoName string
 
-	sess  transport.UploadPackSession
-	refs  *packp.AdvRefs
-	uReq  *packp.UploadPackRequest
-	uResp *packp.UploadPackResponse
+	sess transport.UploadPackSession
+	refs *packp.AdvRefs
 
 	cleanup []func()
 
@@ -265,58 +302,74 @@ func (up *UploadPack) DoSSH(rw ssh.Channel) UploadPacker {
 		return up
 	}
 
-	endpoint, err := transport.NewEndpoint(up.endpoint + up.repoName)
+	// a fetch from a namespace only sees the refs of the namespace
+	repoName, ns, err := up.srv.Namespace(up.repoName, channelPusher(rw))
 	if err != nil {
-		return up.withErr(ErrTransportEndpoint.F(up.repoName, err))
+		return up.withErr(ErrSession.F("upload-pack", err))
 	}
-
-	if up.sess, err = up.transport.NewUploadPackSession(endpoint, nil); err != nil {
+	sto, err := up.srv.NamespaceStorer(repoName, ns)
+	if err != nil {
 		return up.withErr(ErrSession.F("upload-pack", err))
 	}
 
-	up.uReq = packp.NewUploadPackRequest()
+	if protocol.Version(getenv(rw, "GIT_PROTOCOL")) == protocol.V2 {
+		return up.doSSHv2(rw, sto)
+	}
+
+	endpoint, err := transport.NewEndpoint(up.srv.Endpoint + repoName)
+	if err != nil {
+		return up.withErr(ErrTransportEndpoint.F(repoName, err))
+	}
+
+	if up.sess, err = up.srv.Sessions(sto).NewUploadPackSession(endpoint, nil); err != nil {
+		return up.withErr(ErrSession.F("upload-pack", err))
+	}
 
 	if up.refs, err = up.sess.AdvertisedReferences(); err != nil {
 		return up.withErr(ErrSessionAdvRefs.F("upload-pack", err))
 	}
 
-	for _, cap := range up.capabilities {
-		up.refs.Capabilities.Set(cap)
+	pack := protocol.NewUploadPack(sto)
+	if err := pack.SetCapabilities(up.refs.Capabilities); err != nil {
+		return up.withErr(ErrAdvRefsEncode.F("upload-pack", err))
 	}
 
 	if err := up.refs.Encode(rw); err != nil {
 		return up.withErr(ErrAdvRefsEncode.F("upload-pack", err))
 	}
 
-	up.uReq = packp.NewUploadPackRequest()
-	err = up.uReq.Decode(rw)
-	if err != nil {
-		return up.withErr(ErrPackDecode.F(err))
+	// the pack is streamed with side-band awareness
+	if err := pack.ServeV0(rw, rw, false); err != nil {
+		return up.withErr(ErrUploadPack.F(err))
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	up.addCleanup(func() { cancel() }) // cancel when we are finished consuming integers
+	return up
+}
 
-	up.uResp, err = up.sess.UploadPack(ctx, up.uReq)
-	if err != nil {
-		return up.withErr(ErrUploadPack.F(err))
-	}
+// doSSHv2 sends the protocol v2 capability advertisement, then serves each
+// command the client sends until it ends the session.
+func (up *UploadPack) doSSHv2(rw ssh.Channel, sto storer.Storer) UploadPacker {
+	up.log.Debug(up.logPrefix, "fn: doSSHv2...")
 
-	// buffer the upload pack response
-	buf := new(bytes.Buffer)
-	err = up.uResp.Encode(buf) // this doesn't work with the go-git sideband muxer
-	if err != nil {
-		return up.withErr(ErrResponseEncode.F("upload-pack", err))
+	v2 := protocol.NewUploadPack(sto)
+	if err := v2.AdvertiseV2(rw); err != nil {
+		return up.withErr(ErrAdvRefsEncode.F("upload-pack", err))
 	}
 
-	// re-write out the pack data with side-band awareness
-	enc := pktline.NewEncoder(rw, pktline.WithSideband64kMuxer).WithSidebandCapability(pktline.Sideband64k)
-	enc.Write(buf.Bytes()[:8]) // already encoded...
-	enc.WriteString(fmt.Sprintf("%04x\x01", 1+4+len(buf.Bytes()[8:])))
-	enc.Write(buf.Bytes()[8:])
-	enc.Flush()
+	for {
+		cmd, err := protocol.ReadCommand(rw)
+		if err != nil {
+			return up.withErr(ErrRequestDecode.F("upload-pack", err))
+		}
+		if cmd == nil {
+			return up // the client is done
+		}
 
-	return up
+		up.log.Info(up.logPrefix, "serving the protocol v2 command:", cmd.Name)
+		if err := v2.ServeV2(rw, cmd); err != nil {
+			return up.withErr(ErrUploadPack.F(err))
+		}
+	}
 }
 
 // Cleanup takes any functions that were collected and runs them. This is for
@@ -349,40 +402,3 @@ func (up *UploadPack) addCleanup(fn func()) {
 	up.log.Debug(up.logPrefix, "fn: addCleanup...")
 	up.cleanup = append(up.cleanup, fn)
 }
-
-// encOpts returns the encoding options, the hookdata and any errors
-// from the receive-pack upload and will be used for the (pre|post)-receive pack hook
-func encOpts(r io.Reader) ([]pktline.EncoderOption, *cfg.ReceivePackHookData, error) {
-	var oldHash, newHash, refName string
-	var encOpts = make([]pktline.EncoderOption, 0, 1)
-	var hookData = &cfg.ReceivePackHookData{Refs: make([]cfg.ReceivePackData, 0)}
-	var skip = false
-
-	scn := pktline.NewScanner(r)
-	for scn.Scan() {
-		// looking for something like: a6a63a... 6684c0... refs/heads/master\0 report-status side-band-64k push-options agent=git/2.20.1
-		refCapSplit := strings.Split(scn.Text(), "\x00")
-		if len(refCapSplit) == 2 {
-			_, err := fmt.Sscan(refCapSplit[0], &oldHash, &newHash, &refName)
-			if err != nil {
-				return nil, nil, ErrPackScanAdvRefs.F(err)
-			}
-			hookData.Refs = append(hookData.Refs, cfg.ReceivePackData{OldHash: oldHash, NewHash: newHash, RefName: refName})
-		}
-		if !skip {
-			if len(refCapSplit) > 1 {
-				idx := strings.Index(refCapSplit[1], "side-band")
-				if idx > -1 {
-					if refCapSplit[1][idx+9:][:4] == "-64k" {
-						encOpts = append(encOpts, pktline.WithSideband64kMuxer)
-					} else {
-						encOpts = append(encOpts, pktline.WithSidebandMuxer)
-					}
-				}
-			}
-			skip = true
-		}
-	}
-
-	return encOpts, hookData, nil
-}
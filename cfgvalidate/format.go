@@ -0,0 +1,189 @@
+package cfgvalidate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	toml "github.com/pelletier/go-toml"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Format is the format of a configuration file
+type Format string
+
+// The formats that can be validated
+const (
+	TOML Format = "toml"
+	YAML Format = "yaml"
+	JSON Format = "json"
+)
+
+// formatOf returns the format from the extension of the file name
+func formatOf(name string) Format {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".toml":
+		return TOML
+	case ".yaml", ".yml":
+		return YAML
+	case ".json":
+		return JSON
+	}
+	return ""
+}
+
+// document is a parsed configuration file, the value is what the schema validates
+// and line returns the line of the key path in the file
+type document struct {
+	value interface{}
+	line  func(keys []string) int
+}
+
+var (
+	reTOMLErr = regexp.MustCompile(`^\((\d+), \d+\): (.*)$`)
+	reYAMLErr = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+)
+
+// parse parses the file data in the format. A syntax error is returned as
+// a violation with the line it is on.
+func parse(format Format, name string, data []byte) (*document, *Violation) {
+	switch format {
+	case TOML:
+		tree, err := toml.LoadBytes(data)
+		if err != nil {
+			v := &Violation{File: name, Message: err.Error()}
+			if m := reTOMLErr.FindStringSubmatch(err.Error()); m != nil {
+				v.Line, _ = strconv.Atoi(m[1])
+				v.Message = m[2]
+			}
+			return nil, v
+		}
+		return &document{value: tree.ToMap(), line: func(keys []string) int { return tomlLine(tree, keys) }}, nil
+
+	case JSON:
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			vltn := &Violation{File: name, Message: err.Error()}
+			if serr, ok := err.(*json.SyntaxError); ok {
+				vltn.Line = 1 + bytes.Count(data[:serr.Offset], []byte("\n"))
+			}
+			return nil, vltn
+		}
+
+		// JSON is read as YAML as well for the lines of the keys, when it can't be
+		// (i.e. it is indented with tabs) the violations are without lines
+		doc := &document{value: v, line: func([]string) int { return 0 }}
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err == nil {
+			doc.line = func(keys []string) int { return yamlLine(&node, keys) }
+		}
+		return doc, nil
+
+	case YAML:
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			v := &Violation{File: name, Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+			if m := reYAMLErr.FindStringSubmatch(err.Error()); m != nil {
+				v.Line, _ = strconv.Atoi(m[1])
+				v.Message = m[2]
+			}
+			return nil, v
+		}
+		var v interface{}
+		if err := node.Decode(&v); err != nil {
+			return nil, &Violation{File: name, Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+		}
+		return &document{value: jsonValue(v), line: func(keys []string) int { return yamlLine(&node, keys) }}, nil
+	}
+	return nil, &Violation{File: name, Message: ErrBadFormat.F(format, name).Error()}
+}
+
+// tomlLine returns the line of the deepest key of the path that is in the tree
+func tomlLine(tree *toml.Tree, keys []string) int {
+	var line int
+	var cur interface{} = tree
+	for _, key := range keys {
+		switch t := cur.(type) {
+		case *toml.Tree:
+			if pos := t.GetPositionPath([]string{key}); !pos.Invalid() {
+				line = pos.Line
+			}
+			cur = t.GetPath([]string{key})
+		case []*toml.Tree:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(t) {
+				return line
+			}
+			if pos := t[i].Position(); !pos.Invalid() {
+				line = pos.Line
+			}
+			cur = t[i]
+		default:
+			return line
+		}
+	}
+	return line
+}
+
+// yamlLine returns the line of the deepest key of the path that is in the node
+func yamlLine(node *yaml.Node, keys []string) int {
+	var line int
+	for _, key := range keys {
+		for node.Kind == yaml.DocumentNode || node.Kind == yaml.AliasNode {
+			if node.Kind == yaml.AliasNode {
+				node = node.Alias
+				continue
+			}
+			if len(node.Content) == 0 {
+				return line
+			}
+			node = node.Content[0]
+		}
+
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					line, next = node.Content[i].Line, node.Content[i+1]
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+				next = node.Content[i]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+	return line
+}
+
+// jsonValue makes the maps that YAML decodes with keys that are not
+// strings into ones that can be written as JSON for the schema
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range t {
+			t[k] = jsonValue(vv)
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, vv := range t {
+			m[fmt.Sprint(k)] = jsonValue(vv)
+		}
+		return m
+	case []interface{}:
+		for i, vv := range t {
+			t[i] = jsonValue(vv)
+		}
+	}
+	return v
+}
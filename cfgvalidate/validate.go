@@ -0,0 +1,285 @@
+// Package cfgvalidate checks the TOML, YAML and JSON configuration files of a push, and
+// can be used as a pre-receive hook on the HTTP and SSH servers:
+//
+//	v, err := cfgvalidate.New(
+//		cfgvalidate.Rule{Glob: "**/*.toml", Schema: "schema/config.json"},
+//		cfgvalidate.Rule{Glob: "deploy/*.yml"},
+//	)
+//	// ...
+//	cfghttp.NewServer(repos, cfghttp.WithPreReceiveRefHookContext(v.PreReceiveRefHook))
+//
+// Each problem is reported to the pusher with the file, line and key that it is about.
+package cfgvalidate /* import "gopkg.xa4b.com/git/cfgvalidate" */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// Rule maps the files that match the path glob to their format, and to an optional JSON
+// Schema that they must follow. The glob is matched with cfg.MatchPath, so a '**' matches
+// any number of directories. When the format is empty it comes from the extension of the
+// file. The schema is the path of a JSON document in the repository, it is read from the
+// same commit as the files, so a push can change both at once.
+type Rule struct {
+	Glob   string
+	Format Format
+	Schema string
+}
+
+// Violation is a single problem with a configuration file. The line and key are empty
+// when the problem isn't about a single place in the file.
+type Violation struct {
+	File    string
+	Line    int
+	Key     string
+	Message string
+}
+
+// String returns the violation as: <file>:<line>: <key>: <message>
+func (v Violation) String() string {
+	s := v.File
+	if v.Line > 0 {
+		s += ":" + strconv.Itoa(v.Line)
+	}
+	if v.Key != "" {
+		s += ": " + v.Key
+	}
+	return s + ": " + v.Message
+}
+
+// Validator checks configuration files with a list of rules, the first rule that matches
+// a file is the one that is used. Files that don't match a rule are not checked.
+type Validator struct {
+	rules []Rule
+}
+
+// New returns a validator for the rules
+func New(rules ...Rule) (*Validator, error) {
+	for _, rule := range rules {
+		for _, part := range strings.Split(rule.Glob, "/") {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, ErrBadGlob.F(rule.Glob, err)
+			}
+		}
+		switch rule.Format {
+		case "", TOML, YAML, JSON:
+		default:
+			return nil, ErrBadFormat.F(rule.Format, rule.Glob)
+		}
+	}
+	return &Validator{rules: rules}, nil
+}
+
+// PreReceiveRefHook is a cfg.PreReceivePackRefHookContextFunc that checks the files that
+// the new commits of each ref add or change. When a schema changes, every file that uses
+// it is checked. A ref with problems is rejected, and the problems are written to w.
+func (v *Validator) PreReceiveRefHook(ctx context.Context, w io.Writer, data *cfg.PreReceivePackHookData) *cfg.PreReceivePackHookResult {
+	result := &cfg.PreReceivePackHookResult{}
+	for _, ref := range data.Refs {
+		if ctx.Err() != nil {
+			return result
+		}
+
+		vs, err := v.validateRef(ref)
+		if err != nil {
+			result.Reject(ref, err.Error())
+			continue
+		}
+		if len(vs) == 0 {
+			continue
+		}
+
+		for _, vltn := range vs {
+			fmt.Fprintln(w, vltn)
+		}
+		problems := "problems"
+		if len(vs) == 1 {
+			problems = "problem"
+		}
+		result.Reject(ref, fmt.Sprintf("invalid configuration, %d %s", len(vs), problems))
+	}
+	return result
+}
+
+// validateRef checks the files that the push changes on the ref, at the newest commit
+func (v *Validator) validateRef(ref cfg.ReceivePackData) ([]Violation, error) {
+	changes, err := ref.Changes()
+	if err != nil {
+		return nil, ErrReadChanges.F(ref.RefName, err)
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	var paths []string
+	var all bool
+	for _, change := range changes {
+		for _, file := range change.Files {
+			if v.isSchema(file.Path) {
+				all = true
+			}
+			if _, ok := v.rule(file.Path); ok && file.Action != cfg.FileDelete {
+				paths = append(paths, file.Path)
+			}
+		}
+	}
+	switch {
+	case all:
+		return v.Validate(changes[0].Commit)
+	case len(paths) == 0:
+		return nil, nil
+	}
+	return v.Validate(changes[0].Commit, paths...)
+}
+
+// Validate checks the files of the commit at the paths, or all of the files that match
+// a rule when there are no paths. A path that isn't in the commit is skipped.
+func (v *Validator) Validate(commit *object.Commit, paths ...string) ([]Violation, error) {
+	if len(paths) == 0 {
+		files, err := commit.Files()
+		if err != nil {
+			return nil, ErrReadFile.F(commit.Hash, err)
+		}
+		err = files.ForEach(func(f *object.File) error {
+			if _, ok := v.rule(f.Name); ok {
+				paths = append(paths, f.Name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, ErrReadFile.F(commit.Hash, err)
+		}
+	}
+	sort.Strings(paths)
+
+	s := schemas{commit: commit, loaded: make(map[string]*schema)}
+	var vs []Violation
+	for i, name := range paths {
+		if i > 0 && paths[i-1] == name {
+			continue
+		}
+		rule, ok := v.rule(name)
+		if !ok {
+			continue
+		}
+
+		file, err := commit.File(name)
+		if err == object.ErrFileNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, ErrReadFile.F(name, err)
+		}
+		data, err := file.Contents()
+		if err != nil {
+			return nil, ErrReadFile.F(name, err)
+		}
+
+		format := rule.Format
+		if format == "" {
+			format = formatOf(name)
+		}
+		doc, vltn := parse(format, name, []byte(data))
+		if vltn != nil {
+			vs = append(vs, *vltn)
+			continue
+		}
+		if rule.Schema != "" {
+			vs = append(vs, s.validate(rule.Schema, name, doc)...)
+		}
+	}
+	return vs, nil
+}
+
+// rule returns the first rule that matches the file name
+func (v *Validator) rule(name string) (Rule, bool) {
+	for _, rule := range v.rules {
+		if cfg.MatchPath(rule.Glob, name) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// isSchema returns if the file name is the schema of a rule
+func (v *Validator) isSchema(name string) bool {
+	for _, rule := range v.rules {
+		if rule.Schema == name {
+			return true
+		}
+	}
+	return false
+}
+
+// schema is a JSON Schema read from a commit, or the violation of why it couldn't be
+type schema struct {
+	*gojsonschema.Schema
+	err error
+}
+
+// schemas are the JSON Schemas of a commit, each is read once
+type schemas struct {
+	commit *object.Commit
+	loaded map[string]*schema
+}
+
+// validate checks the document of the file name against the schema at the path
+func (s schemas) validate(schemaPath, name string, doc *document) []Violation {
+	sch, ok := s.loaded[schemaPath]
+	if !ok {
+		sch = &schema{}
+		sch.Schema, sch.err = s.load(schemaPath)
+		s.loaded[schemaPath] = sch
+	}
+	if sch.err != nil {
+		return []Violation{{File: name, Message: sch.err.Error()}}
+	}
+
+	res, err := sch.Validate(gojsonschema.NewGoLoader(doc.value))
+	if err != nil {
+		return []Violation{{File: name, Message: ErrSchema.F(schemaPath, err).Error()}}
+	}
+
+	var vs []Violation
+	for _, e := range res.Errors() {
+		// the context is "(root)" followed by the keys, joined with a separator that a key can't have
+		keys := strings.Split(e.Context().String("\x00"), "\x00")[1:]
+		if prop, ok := e.Details()["property"].(string); ok && e.Type() == "additional_property_not_allowed" {
+			keys = append(keys, prop)
+		}
+		vs = append(vs, Violation{
+			File:    name,
+			Line:    doc.line(keys),
+			Key:     strings.Join(keys, "."),
+			Message: e.Description(),
+		})
+	}
+	return vs
+}
+
+// load reads the schema at the path from the commit
+func (s schemas) load(schemaPath string) (*gojsonschema.Schema, error) {
+	file, err := s.commit.File(schemaPath)
+	if err != nil {
+		return nil, ErrSchema.F(schemaPath, err)
+	}
+	data, err := file.Contents()
+	if err != nil {
+		return nil, ErrSchema.F(schemaPath, err)
+	}
+	sch, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(data))
+	if err != nil {
+		return nil, ErrSchema.F(schemaPath, err)
+	}
+	return sch, nil
+}
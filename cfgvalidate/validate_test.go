@@ -0,0 +1,183 @@
+package cfgvalidate
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"server": {
+			"type": "object",
+			"properties": {"port": {"type": "integer"}},
+			"additionalProperties": false
+		}
+	}
+}`
+
+// testCommits commits each set of files on top of the last one, and returns
+// the storage and the commits
+func testCommits(t *testing.T, sets ...map[string]string) (*memory.Storage, []*object.Commit) {
+	sto := memory.NewStorage()
+	fs := memfs.New()
+	repo, err := git.Init(sto, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var commits []*object.Commit
+	for _, files := range sets {
+		for name, contents := range files {
+			if err := util.WriteFile(fs, name, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			wt.Add(name)
+		}
+		sig := &object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+		h, err := wt.Commit("commit", &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit, err := repo.CommitObject(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = append(commits, commit)
+	}
+	return sto, commits
+}
+
+func TestValidate(t *testing.T) {
+	_, commits := testCommits(t, map[string]string{
+		"schema.json":           testSchema,
+		"config.toml":           "[server]\nport = 80\n",
+		"bad/syntax.toml":       "[server]\nport = = 80\n",
+		"bad/type.toml":         "[server]\nport = \"80\"\n",
+		"app/config.yml":        "# app\nserver:\n  port: 80\n  host: x\n",
+		"app/nested/config.yml": "server:\n  port: [\n",
+		"app/config.json":       "{\n  \"server\": {\n    \"port\": 8.5\n  }\n}\n",
+		"app/broken.json":       "{\n  \"server\": {\n    \"port\": 80,\n  }\n}\n",
+		"readme.md":             "# not checked",
+	})
+
+	v, err := New(
+		Rule{Glob: "*.toml", Schema: "schema.json"},
+		Rule{Glob: "bad/*.toml", Schema: "schema.json"},
+		Rule{Glob: "app/**/*.yml", Schema: "schema.json"},
+		Rule{Glob: "app/*.json", Format: JSON, Schema: "schema.json"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := v.Validate(commits[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"app/broken.json:4: invalid character '}' looking for beginning of object key string",
+		"app/config.json:3: server.port: Invalid type. Expected: integer, given: number",
+		"app/config.yml:4: server.host: Additional property host is not allowed",
+		"app/nested/config.yml:2: did not find expected node content",
+		"bad/syntax.toml:2: ",
+		"bad/type.toml:2: server.port: Invalid type. Expected: integer, given: string",
+	}
+	if len(have) != len(want) {
+		t.Fatalf("have: %v want: %v", have, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(have[i].String(), want[i]) {
+			t.Errorf("have: %q want: %q", have[i], want[i])
+		}
+	}
+
+	have, err = v.Validate(commits[0], "config.toml", "missing.toml", "readme.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != 0 {
+		t.Fatalf("have: %v want: none", have)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Rule{Glob: "a/[/*.toml"}); err == nil {
+		t.Fatal("want an error for a bad glob")
+	}
+	if _, err := New(Rule{Glob: "*.ini", Format: "ini"}); err == nil {
+		t.Fatal("want an error for an unknown format")
+	}
+}
+
+func TestPreReceiveRefHook(t *testing.T) {
+	sto, commits := testCommits(t,
+		map[string]string{"schema.json": testSchema, "a.toml": "[server]\nport = 80\n", "b.toml": "[server]\nport = \"x\"\n"},
+		map[string]string{"a.toml": "[server]\nport = 81\n"},
+		map[string]string{"a.toml": "[server]\nport = \"81\"\n"},
+		map[string]string{"schema.json": strings.Replace(testSchema, "integer", "boolean", 1)},
+	)
+	sto.SetReference(plumbing.NewHashReference("refs/heads/master", commits[0].Hash))
+
+	v, err := New(Rule{Glob: "*.toml", Schema: "schema.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		commit  *object.Commit
+		want    []string
+		wantRej bool
+	}{
+		// b.toml is wrong, but it isn't changed by the push
+		{name: "valid", commit: commits[1]},
+		{name: "invalid", commit: commits[2], wantRej: true, want: []string{
+			"a.toml:2: server.port: Invalid type. Expected: integer, given: string",
+		}},
+		{name: "schema changed", commit: commits[3], wantRej: true, want: []string{
+			"a.toml:2: server.port: Invalid type. Expected: boolean, given: string",
+			"b.toml:2: server.port: Invalid type. Expected: boolean, given: string",
+		}},
+	}
+
+	for _, test := range tests {
+		func(commit *object.Commit, want []string, wantRej bool) {
+			t.Run(test.name, func(t *testing.T) {
+				ref := cfg.ReceivePackData{OldHash: commits[0].Hash.String(), NewHash: commit.Hash.String(), RefName: "refs/heads/master"}
+				data := &cfg.PreReceivePackHookData{}
+				data.Refs = cfg.WithStorer([]cfg.ReceivePackData{ref}, sto)
+
+				w := new(bytes.Buffer)
+				result := v.PreReceiveRefHook(context.Background(), w, data)
+				if _, rej := result.Rejected(ref.RefName); rej != wantRej {
+					t.Fatalf("have: %t want: %t", rej, wantRej)
+				}
+
+				var have []string
+				if w.Len() > 0 {
+					have = strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n")
+				}
+				if !reflect.DeepEqual(have, want) {
+					t.Fatalf("have: %q want: %q", have, want)
+				}
+			})
+		}(test.commit, test.want, test.wantRej)
+	}
+}
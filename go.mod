@@ -4,6 +4,10 @@ go 1.13
 
 require (
 	github.com/go-chi/chi v4.0.2+incompatible
+	github.com/pelletier/go-toml v1.9.5
+	github.com/xeipuuv/gojsonschema v1.2.0
 	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
+	gopkg.in/src-d/go-billy.v4 v4.3.2
 	gopkg.in/src-d/go-git.v4 v4.13.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -90,6 +90,18 @@ func (enc *Encoder) Flush() {
 	flush(enc.w)
 }
 
+// Delim sends 0001 to the underlining writer, it separates the
+// sections of a protocol v2 message
+func (enc *Encoder) Delim() {
+	enc.w.Write([]byte("0001"))
+}
+
+// ResponseEnd sends 0002 to the underlining writer, it marks the end
+// of a protocol v2 response for stateless connections
+func (enc *Encoder) ResponseEnd() {
+	enc.w.Write([]byte("0002"))
+}
+
 // flush writes the 0000 packets to the writer
 func flush(w io.Writer) error {
 	_, err := w.Write([]byte("0000"))
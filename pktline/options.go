@@ -11,13 +11,13 @@ type ScannerOption func(*Scanner)
 // WithSidebandMuxer adds the Sideband muxer to the encoder that older
 // clients can use
 func WithSidebandMuxer(enc *Encoder) {
-	enc.Sideband = newSidebandEncoder(enc.w, 999)
+	enc.Sideband = newSidebandEncoder(enc.w, 996) // 1000 bytes including the length and channel
 }
 
 // WithSideband64kMuxer adds the Sideband64k muxer to the encoder that
 // newer clients can use
 func WithSideband64kMuxer(enc *Encoder) {
-	enc.Sideband = newSidebandEncoder(enc.w, 65519)
+	enc.Sideband = newSidebandEncoder(enc.w, MaxLength)
 }
 
 // WithSidebandDemuxer adds the Sideband demuxer to the scanner that
@@ -6,6 +6,20 @@ import (
 	"strconv"
 )
 
+// PacketType describes the kind of pkt-line that was last scanned
+type PacketType int
+
+// The special packets are zero length pkt-lines that carry meaning
+// without any data. Flush ends a message, Delim separates the sections
+// of a protocol v2 message and ResponseEnd marks the end of a stateless
+// protocol v2 response.
+const (
+	PacketData PacketType = iota
+	PacketFlush
+	PacketDelim
+	PacketResponseEnd
+)
+
 // Scanner is the object that allows scanning of pktline data
 type Scanner struct {
 	r io.Reader
@@ -14,6 +28,7 @@ type Scanner struct {
 
 	Sideband ScanSideband
 
+	pktType PacketType
 	canScan bool
 	scanErr error
 }
@@ -27,7 +42,9 @@ func NewScanner(r io.Reader, opts ...ScannerOption) *Scanner {
 	return scn
 }
 
-// Scan is true while there are items to scan
+// Scan is true while there are items to scan. A delim-pkt or
+// response-end-pkt is scanned as an empty line, use Type() to
+// tell them apart from data.
 func (scn *Scanner) Scan() bool {
 	if scn.canScan == false {
 		return false
@@ -40,7 +57,7 @@ func (scn *Scanner) Scan() bool {
 		return scn.canScan
 	}
 
-	scn.b, scn.canScan, scn.scanErr = scan(scn.w, scn.r)
+	scn.b, scn.pktType, scn.canScan, scn.scanErr = scan(scn.w, scn.r)
 	return scn.canScan
 }
 
@@ -60,40 +77,52 @@ func (scn *Scanner) Text() string {
 	return string(scn.b)
 }
 
+// Type returns the kind of packet that was last scanned
+func (scn *Scanner) Type() PacketType {
+	return scn.pktType
+}
+
 // Err returns any errors that occurred while scanning
 func (scn *Scanner) Err() error {
 	return scn.scanErr
 }
 
-// scan scans a pktline according to the spec
-func scan(w io.Writer, r io.Reader) (b []byte, ok bool, err error) {
+// scan scans a pktline according to the spec. Reaching the end of the
+// reader on a line boundary stops the scan without an error.
+func scan(w io.Writer, r io.Reader) (b []byte, t PacketType, ok bool, err error) {
 	var lnlenStr [4]byte
-	r.Read(lnlenStr[:])
-
-	lnlen, _ := strconv.ParseUint(string(lnlenStr[:]), 16, 16) // we check for 0 on the next line
+	_, err = io.ReadFull(r, lnlenStr[:])
+	switch {
+	case err == io.EOF:
+		return nil, PacketFlush, false, nil
+	case err == io.ErrUnexpectedEOF:
+		return nil, PacketData, false, ErrScanTooShort
+	case err != nil:
+		return nil, PacketData, false, err
+	}
 
-	// check if we have 0's to stop scanning
-	if lnlen == 0 {
-		if bytes.Equal(lnlenStr[:], []byte("0000")) {
-			return nil, false, nil
-		}
-		err = ErrScanInvalidLineLength
-		return
+	lnlen, _ := strconv.ParseUint(string(lnlenStr[:]), 16, 16) // we check for special lengths on the next lines
+
+	switch {
+	case bytes.Equal(lnlenStr[:], []byte("0000")):
+		return nil, PacketFlush, false, nil // 0's stop scanning
+	case bytes.Equal(lnlenStr[:], []byte("0001")):
+		return []byte{}, PacketDelim, true, nil
+	case bytes.Equal(lnlenStr[:], []byte("0002")):
+		return []byte{}, PacketResponseEnd, true, nil
+	case lnlen < 4:
+		return nil, PacketData, false, ErrScanInvalidLineLength
 	}
 
 	lnlen -= 4 // account for the len bytes
 
-	var n int
 	b = make([]byte, lnlen)
-	n, err = r.Read(b)
-	if err != nil {
-		return
-	}
-	if uint64(n) != lnlen {
-		err = ErrScanTooShort
-		return
+	if _, err = io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrScanTooShort
+		}
+		return nil, PacketData, false, err
 	}
 
-	ok = true
-	return
+	return b, PacketData, true, nil
 }
@@ -70,6 +70,88 @@ func TestNewScanner(t *testing.T) {
 	}
 }
 
+func TestNewScannerV2(t *testing.T) {
+	type wantPacket struct {
+		kind PacketType
+		text string
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		want    []wantPacket
+		wantErr error
+	}{
+		{
+			// https://github.com/git/git/blob/master/Documentation/technical/protocol-v2.txt
+			name: "command with delim",
+			data: "0014command=ls-refs\n0001000csymrefs\n0000",
+			want: []wantPacket{
+				{PacketData, "command=ls-refs\n"},
+				{PacketDelim, ""},
+				{PacketData, "symrefs\n"},
+			},
+		},
+		{
+			name: "response end",
+			data: "000aready\n0002",
+			want: []wantPacket{
+				{PacketData, "ready\n"},
+				{PacketResponseEnd, ""},
+			},
+		},
+		{
+			name: "end of data without flush",
+			data: "000aready\n",
+			want: []wantPacket{
+				{PacketData, "ready\n"},
+			},
+		},
+		{
+			name:    "reserved line length",
+			data:    "0003",
+			want:    []wantPacket{},
+			wantErr: ErrScanInvalidLineLength,
+		},
+		{
+			name:    "short line",
+			data:    "000aread",
+			want:    []wantPacket{},
+			wantErr: ErrScanTooShort,
+		},
+	}
+
+	for _, test := range tests {
+		func(data io.Reader, want []wantPacket, wantErr error) {
+			t.Run(test.name, func(t *testing.T) {
+				scn := NewScanner(data)
+				var lenHave int
+				for scn.Scan() {
+					lenHave++
+					if lenHave > len(want) {
+						t.Log("too many scanlines")
+						t.Fatalf("have: %d want: %d", lenHave, len(want))
+					}
+					if have := scn.Type(); have != want[lenHave-1].kind {
+						t.Fatalf("have: %d want: %d", have, want[lenHave-1].kind)
+					}
+					if have := scn.Text(); have != want[lenHave-1].text {
+						t.Fatalf("have: %q want: %q", have, want[lenHave-1].text)
+					}
+				}
+				if lenHave != len(want) {
+					t.Log("not enough scanlines")
+					t.Fatalf("have: %d want: %d", lenHave, len(want))
+				}
+				haveErr := scn.Err()
+				if haveErr != wantErr {
+					t.Fatalf("have: %q want: %q", haveErr, wantErr)
+				}
+			})
+		}(strings.NewReader(test.data), test.want, test.wantErr)
+	}
+}
+
 func TestNewSidebandScanner(t *testing.T) {
 	type wantStrings struct{ kind, value string }
 
@@ -1,6 +1,7 @@
 package pktline
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -115,6 +116,14 @@ func (enc *SidebandEncoder) Data(c SidebandChannel, b []byte) (err error) {
 	return encode(enc.w, enc.maxLnLen, append([]byte{byte(c)}, b...))
 }
 
+// Writer returns a buffered writer that muxes everything written to it onto
+// the channel c. Writes are gathered into packets as large as the sideband
+// line length allows, so a whole packfile can be streamed through it. Flush
+// must be called once everything has been written.
+func (enc *SidebandEncoder) Writer(c SidebandChannel) *bufio.Writer {
+	return bufio.NewWriterSize(&sidebandWriter{enc: enc, c: c}, enc.maxLnLen-1)
+}
+
 // EncodeString takes a string to encode for the following:
 // If 'side-band' or 'side-band-64k' capabilities have been specified by
 // the client, the server will send the packfile data multiplexed.
@@ -175,10 +184,13 @@ func newSidebandScanner(w io.Writer, r io.Reader) *SidebandScanner {
 func (scn *SidebandScanner) Scan() bool {
 	scn.progressText, scn.errorText = "", "" // clear out data
 
-	scn.b, scn.canScan, scn.scanErr = scan(scn.w, scn.r)
+	scn.b, _, scn.canScan, scn.scanErr = scan(scn.w, scn.r)
 	if !scn.canScan || scn.scanErr != nil {
 		return false
 	}
+	if len(scn.b) == 0 {
+		return true // a delim or response-end packet has no channel
+	}
 
 	var c byte
 	var sendToWriter bool
@@ -214,3 +226,24 @@ func (scn *SidebandScanner) Packfile() []byte { return scn.b }
 func (scn *SidebandScanner) ProgressText() string { return scn.progressText }
 
 func (scn *SidebandScanner) ErrorText() string { return scn.errorText }
+
+// sidebandWriter splits writes into sideband data packets for a single channel
+type sidebandWriter struct {
+	enc *SidebandEncoder
+	c   SidebandChannel
+}
+
+func (sw *sidebandWriter) Write(b []byte) (n int, err error) {
+	max := sw.enc.maxLnLen - 1 // leave room for the channel byte
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		if err = sw.enc.Data(sw.c, chunk); err != nil {
+			return n, err
+		}
+		n, b = n+len(chunk), b[len(chunk):]
+	}
+	return n, nil
+}
@@ -253,6 +253,58 @@ func TestSidebandSkipEncodeProgress(t *testing.T) {
 	}
 }
 
+func TestSidebandWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     EncoderOption
+		data    []byte
+		want    []int
+		wantErr error
+	}{
+		{"sideband one packet", WithSidebandMuxer, make([]byte, 995), []int{1000}, nil},
+		{"sideband split packets", WithSidebandMuxer, make([]byte, 2000), []int{1000, 1000, 15}, nil},
+		{"sideband64k split packets", WithSideband64kMuxer, make([]byte, 70000), []int{65520, 4490}, nil},
+		{"sideband buffered packet", WithSidebandMuxer, bytes.Repeat([]byte{'a'}, 500), []int{505}, nil},
+	}
+
+	for _, test := range tests {
+		func(opt EncoderOption, data []byte, want []int, wantErr error) {
+			t.Run(test.name, func(t *testing.T) {
+				buf := new(bytes.Buffer)
+				enc := NewEncoder(buf, opt)
+				sbw := enc.Sideband.(*SidebandEncoder).Writer(SidebandPackfile)
+				n, haveErr := sbw.Write(data)
+				if haveErr == nil {
+					haveErr = sbw.Flush()
+				}
+				if haveErr != wantErr {
+					t.Fatalf("have: %v want: %v", haveErr, wantErr)
+				}
+				if n != len(data) {
+					t.Fatalf("have: %d want: %d", n, len(data))
+				}
+				scn := NewScanner(buf)
+				var lenHave int
+				for scn.Scan() {
+					lenHave++
+					if lenHave > len(want) {
+						t.Fatalf("have: %d want: %d", lenHave, len(want))
+					}
+					if have := len(scn.Bytes()) + 4; have != want[lenHave-1] {
+						t.Fatalf("have: %d want: %d", have, want[lenHave-1])
+					}
+					if have := scn.Bytes()[0]; have != byte(SidebandPackfile) {
+						t.Fatalf("have: %d want: %d", have, SidebandPackfile)
+					}
+				}
+				if lenHave != len(want) {
+					t.Fatalf("have: %d want: %d", lenHave, len(want))
+				}
+			})
+		}(test.opt, test.data, test.want, test.wantErr)
+	}
+}
+
 func TestSidebandNoEncode(t *testing.T) {
 	data := "hello world"
 	wantErr := ErrSidebandNotImplemented
@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// ExportBundle writes the repository to w as a git bundle, see cfg.WriteBundle
+func (s *Server) ExportBundle(w io.Writer, repoName string) error {
+	repo, ok := s.Registry.Lookup(repoName)
+	if !ok {
+		return cfg.ErrRepoNotFound.F(repoName)
+	}
+	return cfg.WriteBundle(w, repo.Storer)
+}
+
+// ImportBundle reads the git bundle r into the repository and returns the refs that moved,
+// see cfg.ReadBundle. A repository that doesn't exist is made in memory and added to the
+// registry. The refs that moved are sent to the subscriptions, the replicator and the
+// post-receive hook the same as a push, but the pre-receive hooks aren't asked. What the
+// hook writes goes to w, which can be nil.
+func (s *Server) ImportBundle(ctx context.Context, w io.Writer, repoName string, r io.Reader) ([]cfg.ReceivePackData, error) {
+	if m, ok := s.Mirror(repoName); ok {
+		return nil, ErrMirrorPush.F(m.URL)
+	}
+	if w == nil {
+		w = ioutil.Discard
+	}
+
+	repo, ok := s.Registry.Lookup(repoName)
+	if !ok {
+		var err error
+		if repo, err = cfg.InitMemory(repoName); err != nil {
+			return nil, err
+		}
+	}
+	refs, err := cfg.ReadBundle(r, repo.Storer)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// added once it is read, so a half read repository isn't served
+		if err := s.Registry.Add(repoName, repo); err != nil {
+			return nil, err
+		}
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	s.info("bundle:", repoName, "moved", len(refs), "refs")
+
+	sto := repo.Storer
+	refs = cfg.WithStorer(refs, sto)
+	s.updated(ctx, w, sto, &cfg.ReceivePackHookData{
+		RepoName: repoName,
+		Refs:     refs,
+		Pusher:   cfg.Pusher{Username: "bundle"},
+	})
+	return refs, nil
+}
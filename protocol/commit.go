@@ -0,0 +1,380 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// Commit writes the commit c into a quarantine and returns a request with the command that
+// points the ref at it, so it can go through the hooks and UpdateReferences the same as a
+// push. The files that c doesn't change are kept as they are in the commit of the old hash.
+func (rp *ReceivePack) Commit(c *cfg.Commit) (*ReceiveRequest, *Quarantine, error) {
+	old := plumbing.ZeroHash
+	if c.OldHash != "" {
+		if !isHash(c.OldHash) {
+			return nil, nil, ErrInvalidObjectID.F("commit", c.OldHash)
+		}
+		old = plumbing.NewHash(c.OldHash)
+	}
+
+	q, err := NewQuarantine(rp.sto)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := writeCommit(q, old, c)
+	if err != nil {
+		q.Close()
+		return nil, nil, ErrCommit.F(c.RefName, err)
+	}
+
+	req := &ReceiveRequest{
+		Commands:     []*packp.Command{{Name: plumbing.ReferenceName(c.RefName), Old: old, New: h}},
+		Capabilities: capability.NewList(),
+		PushOptions:  c.PushOptions,
+	}
+	rp.quarantine = q
+	return req, q, nil
+}
+
+// writeCommit writes the objects of the commit c on top of the parent into sto, the author
+// and the committer are dated now when c doesn't have a time for them
+func writeCommit(sto storer.EncodedObjectStorer, parent plumbing.Hash, c *cfg.Commit) (plumbing.Hash, error) {
+	if c.Author.Name == "" || c.Author.Email == "" {
+		return plumbing.ZeroHash, ErrCommitAuthor
+	}
+
+	root := &treeDir{}
+	var parents []plumbing.Hash
+	if !parent.IsZero() {
+		commit, err := object.GetCommit(sto, parent)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		walker := object.NewTreeWalker(tree, true, nil)
+		defer walker.Close()
+		for {
+			name, entry, err := walker.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			if entry.Mode != filemode.Dir {
+				root.set(name, entry)
+			}
+		}
+		parents = append(parents, parent)
+	}
+
+	for _, f := range c.Files {
+		name := strings.Trim(path.Clean("/"+f.Path), "/")
+		if name == "" {
+			return plumbing.ZeroHash, ErrCommitPath.F(f.Path)
+		}
+		if f.Delete {
+			if !root.remove(name) {
+				return plumbing.ZeroHash, ErrCommitPath.F(f.Path)
+			}
+			continue
+		}
+
+		obj := sto.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		w, err := obj.Writer()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if _, err := w.Write(f.Content); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		w.Close()
+		h, err := sto.SetEncodedObject(obj)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		mode := filemode.Regular
+		if entry, ok := root.get(name); ok && entry.Mode == filemode.Executable {
+			mode = entry.Mode // an executable stays one
+		}
+		if !root.set(name, object.TreeEntry{Mode: mode, Hash: h}) {
+			return plumbing.ZeroHash, ErrCommitPath.F(f.Path)
+		}
+	}
+
+	tree, err := root.write(sto)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	now := time.Now()
+	author, committer := c.Author, c.Committer
+	if committer.Name == "" && committer.Email == "" {
+		committer = author
+	}
+	if author.When.IsZero() {
+		author.When = now
+	}
+	if committer.When.IsZero() {
+		committer.When = now
+	}
+	commit := &object.Commit{
+		Author:       author,
+		Committer:    committer,
+		Message:      c.Message,
+		TreeHash:     tree,
+		ParentHashes: parents,
+	}
+	obj := sto.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return sto.SetEncodedObject(obj)
+}
+
+// treeDir is a directory of a tree that is being built
+type treeDir struct {
+	files map[string]object.TreeEntry
+	dirs  map[string]*treeDir
+}
+
+// dir returns the directory at the parts of a path, it is added when create is set
+func (d *treeDir) dir(parts []string, create bool) *treeDir {
+	for _, part := range parts {
+		if _, ok := d.files[part]; ok {
+			return nil // a file is in the way
+		}
+		next, ok := d.dirs[part]
+		if !ok {
+			if !create {
+				return nil
+			}
+			if d.dirs == nil {
+				d.dirs = make(map[string]*treeDir)
+			}
+			next = &treeDir{}
+			d.dirs[part] = next
+		}
+		d = next
+	}
+	return d
+}
+
+// get returns the file at the path
+func (d *treeDir) get(name string) (object.TreeEntry, bool) {
+	parts := strings.Split(name, "/")
+	if dir := d.dir(parts[:len(parts)-1], false); dir != nil {
+		entry, ok := dir.files[parts[len(parts)-1]]
+		return entry, ok
+	}
+	return object.TreeEntry{}, false
+}
+
+// set adds or replaces the file at the path, it fails when the path is a directory
+// or a file is in the way of one of its directories
+func (d *treeDir) set(name string, entry object.TreeEntry) bool {
+	parts := strings.Split(name, "/")
+	dir := d.dir(parts[:len(parts)-1], true)
+	base := parts[len(parts)-1]
+	if dir == nil || dir.dirs[base] != nil {
+		return false
+	}
+	if dir.files == nil {
+		dir.files = make(map[string]object.TreeEntry)
+	}
+	entry.Name = base
+	dir.files[base] = entry
+	return true
+}
+
+// remove removes the file at the path, and the directories it leaves empty
+func (d *treeDir) remove(name string) bool {
+	parts := strings.Split(name, "/")
+	if len(parts) == 1 {
+		_, ok := d.files[name]
+		delete(d.files, name)
+		return ok
+	}
+	next, ok := d.dirs[parts[0]]
+	if !ok || !next.remove(strings.Join(parts[1:], "/")) {
+		return false
+	}
+	if len(next.files) == 0 && len(next.dirs) == 0 {
+		delete(d.dirs, parts[0])
+	}
+	return true
+}
+
+// write writes the trees of the directory and its subdirectories into sto
+func (d *treeDir) write(sto storer.EncodedObjectStorer) (plumbing.Hash, error) {
+	tree := &object.Tree{}
+	for _, entry := range d.files {
+		tree.Entries = append(tree.Entries, entry)
+	}
+	for name, dir := range d.dirs {
+		h, err := dir.write(sto)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: h})
+	}
+
+	// git sorts the entries of a tree as if the directories end with a slash
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool { return sortName(tree.Entries[i]) < sortName(tree.Entries[j]) })
+
+	obj := sto.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return sto.SetEncodedObject(obj)
+}
+
+// Commit makes the commit c on a ref of the repository as if it was pushed: the pre-receive
+// hooks can reject it, the subscriptions are sent its changes and the post-receive hook runs
+// after it. What the hooks write goes to w, which can be nil. The hash of the new commit is
+// returned. When the ref has moved on from the old hash of c the error is ErrCommitStale, and
+// when a pre-receive hook rejects it the error is ErrCommitRejected. The commit is made in
+// the namespace of the pusher of c when the server has namespaces, the same as a push.
+func (s *Server) Commit(ctx context.Context, w io.Writer, repoName string, c cfg.Commit) (string, error) {
+	if w == nil {
+		w = ioutil.Discard
+	}
+
+	repoName, ns, err := s.Namespace(repoName, c.Pusher)
+	if err != nil {
+		return "", err
+	}
+	if m, ok := s.Mirror(repoName); ok {
+		return "", ErrCommitRejected.F(c.RefName, ErrMirrorPush.F(m.URL))
+	}
+
+	sto, err := s.NamespaceStorer(repoName, ns)
+	if err != nil {
+		return "", ErrSession.F("commit", err)
+	}
+
+	// the commit is kept in a quarantine until the hooks accept it, the same as a pack
+	rpack := NewReceivePack(sto, s.MaxPackSize, s.PackSpillSize)
+	req, quarantine, err := rpack.Commit(&c)
+	if err != nil {
+		return "", err
+	}
+	defer quarantine.Close()
+
+	repo, err := quarantine.Repository()
+	if err != nil {
+		s.info("commit:", "ERR:", err) // the hooks can still run without it
+	}
+
+	hookData := &cfg.ReceivePackHookData{
+		RepoName:    repoName,
+		Namespace:   ns,
+		Refs:        cfg.WithStorer(req.Refs(), quarantine),
+		PushOptions: req.PushOptions,
+		Pusher:      c.Pusher,
+	}
+
+	// the pre-receive hooks write to a buffer, so a hook that is left running
+	// after it times out can't write to w after Commit has returned
+	if s.PreReceiveHook != nil {
+		buf := new(bytes.Buffer)
+		var hookErr *cfg.ReceivePackHookError
+		if err := RunHook(ctx, "pre-receive", s.PreReceiveTimeout, func(ctx context.Context) {
+			_, hookErr = s.PreReceiveHook(ctx, buf, &cfg.PreReceivePackHookData{ReceivePackHookData: *hookData, Repository: repo})
+		}); err != nil {
+			return "", err
+		}
+		io.Copy(w, buf)
+		if hookErr != nil {
+			return "", ErrCommitRejected.F(c.RefName, strings.TrimRight(hookErr.String(), "\x00"))
+		}
+	}
+
+	var result *cfg.PreReceivePackHookResult
+	if s.PreReceiveRefHook != nil {
+		buf := new(bytes.Buffer)
+		if err := RunHook(ctx, "pre-receive", s.PreReceiveTimeout, func(ctx context.Context) {
+			result = s.PreReceiveRefHook(ctx, buf, &cfg.PreReceivePackHookData{ReceivePackHookData: *hookData, Repository: repo})
+		}); err != nil {
+			return "", err
+		}
+		io.Copy(w, buf)
+		if reason, ok := result.Rejected(c.RefName); ok {
+			if reason == "" {
+				reason = ErrHookDeclined.Error()
+			}
+			return "", ErrCommitRejected.F(c.RefName, reason)
+		}
+	}
+
+	rStat := rpack.UpdateReferences(req, result)
+	if err := rStat.Error(); err != nil {
+		for _, cs := range rStat.CommandStatuses {
+			if cs.Status == ErrStaleReference.Error() {
+				return "", ErrCommitStale.F(c.RefName, c.OldHash)
+			}
+		}
+		return "", ErrCommitFailed.F(c.RefName, err)
+	}
+	s.info("commit:", "committed", req.Commands[0].New, "to", c.RefName, "of", repoName)
+
+	postData := *hookData
+	postData.Refs = Updated(hookData.Refs, rStat)
+	s.updated(ctx, w, sto, &postData)
+
+	return req.Commands[0].New.String(), nil
+}
+
+// Rollback undoes changes to a ref of the repository with a new commit, see cfg.Rollback.
+// The commit is made with Commit, so it goes through the hooks and the post-receive hook
+// runs after it the same as it would for a push, in the namespace of the pusher of r.
+func (s *Server) Rollback(ctx context.Context, w io.Writer, repoName string, r cfg.Rollback) (string, error) {
+	repo, ns, err := s.Namespace(repoName, r.Pusher)
+	if err != nil {
+		return "", err
+	}
+	sto, err := s.NamespaceStorer(repo, ns)
+	if err != nil {
+		return "", ErrSession.F("rollback", err)
+	}
+
+	head := r.OldHash
+	if head == "" {
+		ref, err := sto.Reference(plumbing.ReferenceName(r.RefName))
+		if err != nil {
+			return "", cfg.ErrRollback.F(r.RefName, err)
+		}
+		head = ref.Hash().String()
+	}
+
+	c, err := r.Commit(sto, head)
+	if err != nil {
+		return "", err
+	}
+	return s.Commit(ctx, w, repoName, *c)
+}
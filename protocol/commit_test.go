@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+func TestCommit(t *testing.T) {
+	sto, hashes := testRepository(t, "configuration.toml", "a = 1\n", "a = 2\n")
+	sig := object.Signature{Name: "app", Email: "app@example.com", When: time.Unix(2e9, 0)}
+
+	commit := func(c cfg.Commit) (plumbing.Hash, string) {
+		t.Helper()
+		c.Author = sig
+		rpack := NewReceivePack(sto, 0, 0)
+		req, q, err := rpack.Commit(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+		rs := rpack.UpdateReferences(req, nil)
+		return req.Commands[0].New, rs.CommandStatuses[0].Status
+	}
+
+	files := func(h plumbing.Hash) map[string]string {
+		t.Helper()
+		c, err := object.GetCommit(sto, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iter, err := c.Files()
+		if err != nil {
+			t.Fatal(err)
+		}
+		have := make(map[string]string)
+		iter.ForEach(func(f *object.File) error {
+			have[f.Name], _ = f.Contents()
+			return nil
+		})
+		return have
+	}
+
+	assertFiles := func(have, want map[string]string) {
+		t.Helper()
+		if len(have) != len(want) {
+			t.Fatalf("have: %v want: %v", have, want)
+		}
+		for k, v := range want {
+			if have[k] != v {
+				t.Fatalf("have: %v want: %v", have, want)
+			}
+		}
+	}
+
+	// an update on top of master, that keeps the files it doesn't touch
+	h1, status := commit(cfg.Commit{
+		RefName: "refs/heads/master", OldHash: hashes[1].String(), Message: "seed",
+		Files: []cfg.CommitFile{{Path: "a/b/c.toml", Content: []byte("c = 1\n")}, {Path: "/a.b", Content: []byte("x")}},
+	})
+	if status != "ok" {
+		t.Fatalf("have: %s want: ok", status)
+	}
+	assertFiles(files(h1), map[string]string{"configuration.toml": "a = 2\n", "a/b/c.toml": "c = 1\n", "a.b": "x"})
+	c1, _ := object.GetCommit(sto, h1)
+	if len(c1.ParentHashes) != 1 || c1.ParentHashes[0] != hashes[1] || c1.Committer.Name != "app" {
+		t.Fatalf("have: %v %v want: the parent %v and the author as the committer", c1.ParentHashes, c1.Committer, hashes[1])
+	}
+
+	// a delete removes the directories it empties
+	h2, status := commit(cfg.Commit{
+		RefName: "refs/heads/master", OldHash: h1.String(),
+		Files: []cfg.CommitFile{{Path: "a/b/c.toml", Delete: true}},
+	})
+	if status != "ok" {
+		t.Fatalf("have: %s want: ok", status)
+	}
+	assertFiles(files(h2), map[string]string{"configuration.toml": "a = 2\n", "a.b": "x"})
+	if c2, _ := object.GetCommit(sto, h2); c2.TreeHash == hashes[1] {
+		t.Fatal("want a new tree")
+	}
+
+	// master has moved on from h1
+	_, status = commit(cfg.Commit{
+		RefName: "refs/heads/master", OldHash: h1.String(),
+		Files: []cfg.CommitFile{{Path: "configuration.toml", Content: []byte("a = 3\n")}},
+	})
+	if status != ErrStaleReference.Error() {
+		t.Fatalf("have: %s want: %s", status, ErrStaleReference)
+	}
+	if ref, _ := sto.Reference("refs/heads/master"); ref.Hash() != h2 {
+		t.Fatalf("have: %s want: %s", ref.Hash(), h2)
+	}
+
+	// a new ref starts with no files
+	h3, status := commit(cfg.Commit{
+		RefName: "refs/heads/new",
+		Files:   []cfg.CommitFile{{Path: "new.toml", Content: []byte("n = 1\n")}},
+	})
+	if status != "ok" {
+		t.Fatalf("have: %s want: ok", status)
+	}
+	assertFiles(files(h3), map[string]string{"new.toml": "n = 1\n"})
+
+	// a create can't overwrite a ref
+	if _, status = commit(cfg.Commit{RefName: "refs/heads/new"}); status != ErrUpdateReference.Error() {
+		t.Fatalf("have: %s want: %s", status, ErrUpdateReference)
+	}
+
+	bad := []cfg.CommitFile{
+		{Path: "missing.toml", Delete: true},
+		{Path: "configuration.toml/x", Content: []byte("x")},
+		{Path: "/", Content: []byte("x")},
+	}
+	for _, f := range bad {
+		c := cfg.Commit{RefName: "refs/heads/master", OldHash: h2.String(), Files: []cfg.CommitFile{f}, Author: sig}
+		if _, _, err := NewReceivePack(sto, 0, 0).Commit(&c); !errors.Is(err, ErrCommit) {
+			t.Fatalf("%s have: %v want: %v", f.Path, err, ErrCommit)
+		}
+	}
+
+	// the old hash has to be a full object id
+	for _, oldHash := range []string{"master", h2.String()[:7], h2.String() + "0", "z" + h2.String()[1:]} {
+		c := cfg.Commit{RefName: "refs/heads/master", OldHash: oldHash, Author: sig}
+		if _, _, err := NewReceivePack(sto, 0, 0).Commit(&c); !errors.Is(err, ErrInvalidObjectID) {
+			t.Fatalf("%s have: %v want: %v", oldHash, err, ErrInvalidObjectID)
+		}
+	}
+
+	// the author needs a name and an email
+	for _, author := range []object.Signature{{Name: "app"}, {Email: "app@example.com"}} {
+		c := cfg.Commit{RefName: "refs/heads/master", OldHash: h2.String(), Author: author}
+		if _, _, err := NewReceivePack(sto, 0, 0).Commit(&c); !errors.Is(err, ErrCommit) || !strings.Contains(err.Error(), ErrCommitAuthor.Error()) {
+			t.Fatalf("%v have: %v want: %v", author, err, ErrCommitAuthor)
+		}
+	}
+}
+
+func TestCommitWhen(t *testing.T) {
+	sto, hashes := testRepository(t, "configuration.toml", "a = 1\n")
+	before := time.Now().Add(-time.Second)
+
+	// without a time the author and the committer are dated now, not 1970
+	c := cfg.Commit{
+		RefName: "refs/heads/master", OldHash: hashes[0].String(),
+		Files:     []cfg.CommitFile{{Path: "configuration.toml", Content: []byte("a = 2\n")}},
+		Author:    object.Signature{Name: "app", Email: "app@example.com"},
+		Committer: object.Signature{Name: "ci", Email: "ci@example.com"},
+	}
+	req, q, err := NewReceivePack(sto, 0, 0).Commit(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	commit, err := object.GetCommit(q, req.Commands[0].New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Author.When.Before(before) || commit.Committer.When.Before(before) {
+		t.Fatalf("have: %v %v want: after %v", commit.Author.When, commit.Committer.When, before)
+	}
+	if commit.Committer.Name != "ci" {
+		t.Fatalf("have: %s want: ci", commit.Committer.Name)
+	}
+}
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"context"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// CreateRepo makes the repository for the pusher when it doesn't exist yet and the server
+// makes repositories on push, see CreateOnPush. It is made once, even by pushes at the same
+// time.
+func (s *Server) CreateRepo(ctx context.Context, repoName string, pusher cfg.Pusher) error {
+	if s.CreateOnPush == nil {
+		return nil
+	}
+	if _, ok := s.Registry.Lookup(repoName); ok {
+		return nil
+	}
+
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+	if _, ok := s.Registry.Lookup(repoName); ok {
+		return nil
+	}
+	if _, err := s.CreateOnPush.Create(ctx, s.Registry, repoName, pusher); err != nil {
+		return err
+	}
+	s.info("create-on-push:", repoName, "was made for", pusher.Username)
+	return nil
+}
+
+// ReceivePackStorer returns the storage that the refs of a receive-pack by the pusher are
+// advertised from. A repository that isn't in the registry, but that the pusher can make on
+// push, is advertised without refs, it is only made by CreateRepo once the push has
+// commands. The error is ErrCreateDenied of cfg when the pusher can't make it.
+func (s *Server) ReceivePackStorer(ctx context.Context, repoName, ns string, pusher cfg.Pusher) (storer.Storer, error) {
+	if _, ok := s.Registry.Lookup(repoName); !ok && s.CreateOnPush != nil {
+		if err := s.CreateOnPush.Allow(ctx, repoName, pusher); err != nil {
+			return nil, err
+		}
+		return memory.NewStorage(), nil
+	}
+	return s.NamespaceStorer(repoName, ns)
+}
@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// all provided errors
+const (
+	ErrUnknownCommand  strErr = "unknown command %q"
+	ErrUnexpectedLine  strErr = "%s: unexpected line %q"
+	ErrInvalidObjectID strErr = "%s: invalid object id %q"
+	ErrNotOurRef       strErr = "upload-pack: not our ref %s"
+	ErrCommandScan     strErr = "command scan: %v"
+	ErrPackEncode      strErr = "pack encode: %v"
+	ErrRevList         strErr = "rev-list: %v"
+	ErrListRefs        strErr = "ls-refs: %v"
+	ErrNegotiation     strErr = "upload-pack: the negotiation ended before the client was done"
+
+	ErrInvalidDeepen    strErr = "upload-pack: invalid deepen request %q"
+	ErrDeepenConflict   strErr = "upload-pack: deepen and deepen-since (or deepen-not) cannot be used together"
+	ErrNoShallowCommits strErr = "upload-pack: no commits selected for shallow requests"
+	ErrInvalidFilter    strErr = "upload-pack: invalid filter-spec %q"
+
+	ErrPushOptionsScan  strErr = "push-options scan: %v"
+	ErrPushOptionsCount strErr = "too many push-options, the limit is %d"
+	ErrPushOptionSize   strErr = "push-option is too long, the limit is %d bytes"
+
+	ErrCapabilities    strErr = "%s: bad capabilities: %v"
+	ErrInvalidCommand  strErr = "receive-pack: invalid command %q"
+	ErrPackRead        strErr = "pack read: %v"
+	ErrPackWrite       strErr = "pack write: %v"
+	ErrPackTooLarge    strErr = "pack exceeds the maximum size of %d bytes"
+	ErrUpdateReference strErr = "failed to update ref"
+	ErrStaleReference  strErr = "stale info"
+	ErrAtomicPush      strErr = "atomic push failed for %s: %v"
+	ErrHookDeclined    strErr = "pre-receive hook declined"
+	ErrQuarantine      strErr = "quarantine: %v"
+	ErrReadOnly        strErr = "the repository is read-only in the pre-receive hook"
+	ErrCommit          strErr = "commit to %s: %v"
+	ErrCommitPath      strErr = "bad path %q"
+	ErrCommitAuthor    strErr = "the author needs a name and an email"
+	ErrNamespace       strErr = "namespace %s: %v"
+
+	ErrSession       strErr = "%s session: %v"
+	ErrEndpoint      strErr = "repo [%s] endpoint invalid: %v"
+	ErrRepoNamespace strErr = "repo [%s] namespace: %v"
+
+	ErrCommitRejected strErr = "commit to %s rejected: %s"
+	ErrCommitStale    strErr = "commit to %s: the ref is not at %s anymore"
+	ErrCommitFailed   strErr = "commit to %s failed: %v"
+
+	ErrMirrorPush  strErr = "read-only mirror, push to %s instead"
+	ErrNotMirror   strErr = "%s is not a mirror"
+	ErrMirrorFetch strErr = "mirror %s from %s: %v"
+
+	ErrHookTimeout  strErr = "%s hook timed out after %v"
+	ErrHookCanceled strErr = "%s hook canceled: %v"
+	ErrHookPanic    strErr = "%s hook failed: %v"
+)
+
+// strErr provides an error wrapper for strings with an option to
+// provide formatting values. It is used for error constants that
+// have built-in formatting directives. So we can provide a base
+// string constant that can be comparable by type or 'sentinel' value.
+type strErr string
+
+func (e strErr) Error() string { return string(e) }
+
+// F captures the values for an error string formatting. This is a
+// separate method so an error can be matched with its base
+// formatting directives.
+func (e strErr) F(v ...interface{}) error {
+	var hasErr, hasNil bool
+	for _, vv := range v {
+		switch err := vv.(type) {
+		case error:
+			if err == nil {
+				return nil
+			}
+			hasErr = true
+		case nil:
+			hasNil = true
+		}
+	}
+
+	// if there is no error object, and we have a nil, then the err is nil
+	// otherwise we have some nil item, but a valid err, so pass the err along
+	if hasNil && !hasErr {
+		return nil
+	}
+
+	return fmtErr{err: fmt.Errorf("%w", e), v: v}
+}
+
+// fmtErr is for errors that will be formatted. It hold the
+// formatting values in a field so they can be added when the
+// error is stringfied. Otherwise the underlining error without
+// formatting can be matched.
+type fmtErr struct {
+	err error
+	v   []interface{}
+}
+
+func (e fmtErr) Error() string { return fmt.Sprintf(e.err.Error(), e.v...) }
+
+// Unwrap is a method to help unwrap errors to the base error for go1.13
+func (e fmtErr) Unwrap() error { return errors.Unwrap(e.err) }
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+)
+
+// Filter is the partial clone capability that go-git doesn't know about. The client
+// sends a filter-spec to leave objects out of the pack, and later fetches the missing
+// objects by their object id, which needs allow-reachable-sha1-in-want.
+const Filter capability.Capability = "filter"
+
+// objectFilter is the filter-spec of a partial clone. Blobs that are as large as the
+// blob limit, and trees and blobs that are as deep as the tree depth, are left out
+// of the pack. A limit or depth below zero is not used.
+type objectFilter struct {
+	blobLimit int64
+	treeDepth int
+}
+
+// parseFilter parses the filter-specs: blob:none, blob:limit=<n>[kmg] and tree:<depth>
+func parseFilter(spec string) (*objectFilter, error) {
+	f := &objectFilter{blobLimit: -1, treeDepth: -1}
+
+	switch {
+	case spec == "blob:none":
+		f.blobLimit = 0
+	case strings.HasPrefix(spec, "blob:limit="):
+		n, err := parseSize(strings.TrimPrefix(spec, "blob:limit="))
+		if err != nil {
+			return nil, ErrInvalidFilter.F(spec)
+		}
+		f.blobLimit = n
+	case strings.HasPrefix(spec, "tree:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(spec, "tree:"))
+		if err != nil || n < 0 {
+			return nil, ErrInvalidFilter.F(spec)
+		}
+		f.treeDepth = n
+	default:
+		return nil, ErrInvalidFilter.F(spec)
+	}
+
+	return f, nil
+}
+
+// parseSize parses a size in bytes that can have a k, m or g unit
+func parseSize(s string) (int64, error) {
+	var unit int64 = 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		unit, s = 1<<10, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		unit, s = 1<<20, strings.TrimSuffix(s, "m")
+	case strings.HasSuffix(s, "g"):
+		unit, s = 1<<30, strings.TrimSuffix(s, "g")
+	}
+	n, err := strconv.ParseUint(s, 10, 63)
+	return int64(n) * unit, err
+}
+
+// omitTree returns true when a tree at depth, the root tree of a commit is at
+// zero, is left out of the pack
+func (f *objectFilter) omitTree(depth int) bool {
+	return f != nil && f.treeDepth >= 0 && depth >= f.treeDepth
+}
+
+// omitBlob returns true when a blob of size at depth is left out of the pack
+func (f *objectFilter) omitBlob(depth int, size int64) bool {
+	if f == nil {
+		return false
+	}
+	return (f.treeDepth >= 0 && depth >= f.treeDepth) || (f.blobLimit >= 0 && size >= f.blobLimit)
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    *objectFilter
+		wantErr error
+	}{
+		{"blob none", "blob:none", &objectFilter{blobLimit: 0, treeDepth: -1}, nil},
+		{"blob limit", "blob:limit=512", &objectFilter{blobLimit: 512, treeDepth: -1}, nil},
+		{"blob limit with a unit", "blob:limit=2k", &objectFilter{blobLimit: 2048, treeDepth: -1}, nil},
+		{"tree depth", "tree:1", &objectFilter{blobLimit: -1, treeDepth: 1}, nil},
+		{"bad limit", "blob:limit=-1", nil, ErrInvalidFilter},
+		{"unknown", "sparse:oid=1234", nil, ErrInvalidFilter},
+	}
+
+	for _, test := range tests {
+		func(spec string, want *objectFilter, wantErr error) {
+			t.Run(test.name, func(t *testing.T) {
+				have, haveErr := parseFilter(spec)
+				if haveErr != wantErr && !errors.Is(haveErr, wantErr) {
+					t.Fatalf("have: %v want: %v", haveErr, wantErr)
+				}
+				if !reflect.DeepEqual(have, want) {
+					t.Fatalf("have: %+v want: %+v", have, want)
+				}
+			})
+		}(test.spec, test.want, test.wantErr)
+	}
+}
+
+func TestReachableFilter(t *testing.T) {
+	sto, hashes := testRepository(t, "configuration.toml", "a = 1\n", "a = 12345\n")
+
+	tests := []struct {
+		name      string
+		spec      string
+		wantTypes map[plumbing.ObjectType]int
+	}{
+		{
+			name:      "no filter",
+			wantTypes: map[plumbing.ObjectType]int{plumbing.CommitObject: 2, plumbing.TreeObject: 2, plumbing.BlobObject: 2},
+		},
+		{
+			name:      "blob none",
+			spec:      "blob:none",
+			wantTypes: map[plumbing.ObjectType]int{plumbing.CommitObject: 2, plumbing.TreeObject: 2},
+		},
+		{
+			name:      "blob limit",
+			spec:      "blob:limit=10",
+			wantTypes: map[plumbing.ObjectType]int{plumbing.CommitObject: 2, plumbing.TreeObject: 2, plumbing.BlobObject: 1},
+		},
+		{
+			name:      "tree depth",
+			spec:      "tree:0",
+			wantTypes: map[plumbing.ObjectType]int{plumbing.CommitObject: 2},
+		},
+	}
+
+	for _, test := range tests {
+		func(spec string, wantTypes map[plumbing.ObjectType]int) {
+			t.Run(test.name, func(t *testing.T) {
+				var filter *objectFilter
+				if spec != "" {
+					var err error
+					if filter, err = parseFilter(spec); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				up := NewUploadPack(sto)
+				objs, err := up.reachable([]plumbing.Hash{hashes[1]}, nil, filter, make(map[plumbing.Hash]bool))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				haveTypes := make(map[plumbing.ObjectType]int)
+				for _, h := range objs {
+					obj, err := sto.EncodedObject(plumbing.AnyObject, h)
+					if err != nil {
+						t.Fatal(err)
+					}
+					haveTypes[obj.Type()]++
+				}
+				if !reflect.DeepEqual(haveTypes, wantTypes) {
+					t.Fatalf("have: %v want: %v", haveTypes, wantTypes)
+				}
+			})
+		}(test.spec, test.wantTypes)
+	}
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"context"
+	"time"
+)
+
+// RunHook calls fn with a context that is done when ctx is, or when timeout has passed
+// if it is more than zero. It returns once fn does, or as soon as that context is done:
+// ErrHookTimeout when the timeout ran out and ErrHookCanceled when ctx ended first. In
+// both cases fn is left running, so it should return once it sees its context is done.
+// A panic in fn is returned as ErrHookPanic. The name of the hook is used for the errors.
+func RunHook(ctx context.Context, name string, timeout time.Duration, fn func(context.Context)) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if rvr := recover(); rvr != nil {
+				done <- ErrHookPanic.F(name, rvr)
+			}
+		}()
+		fn(ctx)
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded && timeout > 0 {
+			return ErrHookTimeout.F(name, timeout)
+		}
+		return ErrHookCanceled.F(name, ctx.Err())
+	}
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunHook(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// a hook that is stuck until the test is over
+	release := make(chan struct{})
+	defer close(release)
+	stuck := func(context.Context) { <-release }
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		timeout time.Duration
+		fn      func(context.Context)
+		wantErr error
+	}{
+		{"finished", context.Background(), time.Second, func(context.Context) {}, nil},
+		{"no timeout", context.Background(), 0, func(context.Context) {}, nil},
+		{"timed out", context.Background(), 10 * time.Millisecond, stuck, ErrHookTimeout},
+		{"canceled", canceled, time.Second, stuck, ErrHookCanceled},
+		{"panic", context.Background(), time.Second, func(context.Context) { panic("oops") }, ErrHookPanic},
+	}
+
+	for _, test := range tests {
+		func(ctx context.Context, timeout time.Duration, fn func(context.Context), wantErr error) {
+			t.Run(test.name, func(t *testing.T) {
+				haveErr := RunHook(ctx, "pre-receive", timeout, fn)
+				if haveErr != wantErr && !errors.Is(haveErr, wantErr) {
+					t.Fatalf("have: %v want: %v", haveErr, wantErr)
+				}
+			})
+		}(test.ctx, test.timeout, test.fn, test.wantErr)
+	}
+}
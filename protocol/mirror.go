@@ -0,0 +1,182 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// SetMirror makes the repository a read-only mirror of the upstream m, pushes and commits
+// to it are rejected with the URL of the upstream. The repository must be in the registry
+// of the server. The refs are fetched with FetchMirror, or every interval by RunMirrors.
+// Mirrors are set up before the server is used.
+func (s *Server) SetMirror(repoName string, m cfg.Mirror) {
+	s.mirrorsMu.Lock()
+	defer s.mirrorsMu.Unlock()
+	if s.mirrors == nil {
+		s.mirrors = make(map[string]cfg.Mirror)
+	}
+	s.mirrors[repoName] = m
+}
+
+// Mirror returns the upstream of the repository when it is a mirror
+func (s *Server) Mirror(repoName string) (cfg.Mirror, bool) {
+	s.mirrorsMu.RLock()
+	defer s.mirrorsMu.RUnlock()
+	m, ok := s.mirrors[repoName]
+	return m, ok
+}
+
+// RunMirrors fetches each mirror from its upstream right away and then every interval,
+// until ctx is done. A fetch that fails is logged and tried again on the next interval.
+func (s *Server) RunMirrors(ctx context.Context) {
+	s.mirrorsMu.RLock()
+	mirrors := make(map[string]cfg.Mirror, len(s.mirrors))
+	for repoName, m := range s.mirrors {
+		mirrors[repoName] = m
+	}
+	s.mirrorsMu.RUnlock()
+
+	var wg sync.WaitGroup
+	for repoName, m := range mirrors {
+		interval := m.Interval
+		if interval <= 0 {
+			interval = cfg.DefaultMirrorInterval
+		}
+
+		wg.Add(1)
+		go func(repoName string, interval time.Duration) {
+			defer wg.Done()
+			tick := time.NewTicker(interval)
+			defer tick.Stop()
+			for {
+				if _, err := s.FetchMirror(ctx, ioutil.Discard, repoName); err != nil && ctx.Err() == nil {
+					s.info("mirror:", err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick.C:
+				}
+			}
+		}(repoName, interval)
+	}
+	wg.Wait()
+}
+
+// FetchMirror moves the refs of the mirror to where they are in its upstream and returns
+// the refs that moved. They are sent to the subscriptions, the replicator and the
+// post-receive hook the same as a push, with a "mirror" push-option of the upstream URL.
+// What the hook writes goes to w, which can be nil.
+func (s *Server) FetchMirror(ctx context.Context, w io.Writer, repoName string) ([]cfg.ReceivePackData, error) {
+	m, ok := s.Mirror(repoName)
+	repo, loaded := s.Registry.Lookup(repoName)
+	if !ok || !loaded {
+		return nil, ErrNotMirror.F(repoName)
+	}
+	if w == nil {
+		w = ioutil.Discard
+	}
+
+	// a fetch at a time, so the refs that moved are worked out right
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+
+	sto := repo.Storer
+	before, err := refHashes(sto)
+	if err != nil {
+		return nil, ErrMirrorFetch.F(repoName, m.URL, err)
+	}
+
+	remote := git.NewRemote(sto, &config.RemoteConfig{Name: "upstream", URLs: []string{m.URL}})
+	upstream, err := remote.List(&git.ListOptions{Auth: m.Auth})
+	if err != nil && err != transport.ErrEmptyRemoteRepository {
+		return nil, ErrMirrorFetch.F(repoName, m.URL, err)
+	}
+
+	names := make(map[plumbing.ReferenceName]bool)
+	for _, ref := range upstream {
+		switch {
+		case ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference:
+			sto.SetReference(ref) // the default branch follows the upstream
+		case strings.HasPrefix(ref.Name().String(), "refs/"):
+			names[ref.Name()] = true
+		}
+	}
+	if len(names) > 0 {
+		err := remote.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: "upstream",
+			RefSpecs:   []config.RefSpec{"+refs/*:refs/*"},
+			Auth:       m.Auth,
+			Tags:       git.NoTags,
+			Force:      true,
+		})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return nil, ErrMirrorFetch.F(repoName, m.URL, err)
+		}
+	}
+	for name := range before {
+		if !names[name] {
+			if err := sto.RemoveReference(name); err != nil {
+				return nil, ErrMirrorFetch.F(repoName, m.URL, err)
+			}
+		}
+	}
+
+	after, err := refHashes(sto)
+	if err != nil {
+		return nil, ErrMirrorFetch.F(repoName, m.URL, err)
+	}
+	var refs []cfg.ReceivePackData
+	for name := range names {
+		if before[name] != after[name] {
+			refs = append(refs, cfg.ReceivePackData{OldHash: before[name].String(), NewHash: after[name].String(), RefName: name.String()})
+		}
+	}
+	for name, h := range before {
+		if !names[name] {
+			refs = append(refs, cfg.ReceivePackData{OldHash: h.String(), NewHash: plumbing.ZeroHash.String(), RefName: name.String()})
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].RefName < refs[j].RefName })
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	s.info("mirror:", repoName, "moved", len(refs), "refs from", m.URL)
+
+	refs = cfg.WithStorer(refs, sto)
+	s.updated(ctx, w, sto, &cfg.ReceivePackHookData{
+		RepoName:    repoName,
+		Refs:        refs,
+		PushOptions: cfg.PushOptions{{Key: "mirror", Value: m.URL}},
+		Pusher:      cfg.Pusher{Username: "mirror", RemoteAddr: m.URL},
+	})
+	return refs, nil
+}
+
+// refHashes returns where the refs of the repository are, leaving out HEAD
+func refHashes(sto storer.ReferenceStorer) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	iter, err := sto.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[plumbing.ReferenceName]plumbing.Hash)
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), "refs/") {
+			hashes[ref.Name()] = ref.Hash()
+		}
+		return nil
+	})
+	return hashes, err
+}
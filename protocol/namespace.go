@@ -0,0 +1,177 @@
+package protocol
+
+import (
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// Namespace is the storage of a repository as seen from one of its git namespaces (see
+// gitnamespaces(7)). The refs of the namespace are kept under refs/namespaces/<name>/ in
+// the repository and are seen without that prefix, the refs of the rest of the repository
+// can't be seen or changed. Everything else, such as the objects, is shared, but an
+// upload-pack of the namespace only sends the objects that are reachable from its refs.
+type Namespace struct {
+	storage.Storer // the repository
+
+	name   string
+	prefix string
+}
+
+// NewNamespace returns the storage of the namespace of the repository storage sto. A
+// namespace with slashes is nested the same way as GIT_NAMESPACE, so a/b is kept under
+// refs/namespaces/a/refs/namespaces/b/.
+func NewNamespace(sto storer.Storer, name string) (*Namespace, error) {
+	s, ok := sto.(storage.Storer)
+	if !ok {
+		return nil, ErrNamespace.F(name, "the repository storage can't be namespaced")
+	}
+	var prefix string
+	for _, part := range strings.Split(name, "/") {
+		if !validNamespace(part) {
+			return nil, ErrNamespace.F(name, "bad name")
+		}
+		prefix += "refs/namespaces/" + part + "/"
+	}
+	return &Namespace{Storer: s, name: name, prefix: prefix}, nil
+}
+
+// validNamespace reports if a part of a namespace can be used in a ref name
+func validNamespace(part string) bool {
+	if part == "" || part[0] == '.' || strings.HasSuffix(part, ".lock") || strings.Contains(part, "..") || strings.Contains(part, "@{") {
+		return false
+	}
+	for _, c := range part {
+		if c < ' ' || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Name returns the name of the namespace
+func (n *Namespace) Name() string { return n.name }
+
+// RefName returns the name that the ref of the namespace has in the repository
+func (n *Namespace) RefName(name plumbing.ReferenceName) plumbing.ReferenceName {
+	return plumbing.ReferenceName(n.prefix + name.String())
+}
+
+// Refs returns copies of the refs of the namespace, with the names they have in the
+// repository and reading their changes from it
+func (n *Namespace) Refs(refs []cfg.ReceivePackData) []cfg.ReceivePackData {
+	out := make([]cfg.ReceivePackData, 0, len(refs))
+	for _, ref := range refs {
+		out = append(out, cfg.ReceivePackData{OldHash: ref.OldHash, NewHash: ref.NewHash, RefName: n.RefName(plumbing.ReferenceName(ref.RefName)).String()})
+	}
+	return cfg.WithStorer(out, n.Storer)
+}
+
+// in returns the ref of the repository as it is seen in the namespace
+func (n *Namespace) in(ref *plumbing.Reference) *plumbing.Reference {
+	name := plumbing.ReferenceName(strings.TrimPrefix(ref.Name().String(), n.prefix))
+	if ref.Type() == plumbing.SymbolicReference {
+		return plumbing.NewSymbolicReference(name, plumbing.ReferenceName(strings.TrimPrefix(ref.Target().String(), n.prefix)))
+	}
+	return plumbing.NewHashReference(name, ref.Hash())
+}
+
+// out returns the ref of the namespace as it is kept in the repository
+func (n *Namespace) out(ref *plumbing.Reference) *plumbing.Reference {
+	if ref.Type() == plumbing.SymbolicReference {
+		return plumbing.NewSymbolicReference(n.RefName(ref.Name()), n.RefName(ref.Target()))
+	}
+	return plumbing.NewHashReference(n.RefName(ref.Name()), ref.Hash())
+}
+
+// SetReference writes the ref into the namespace
+func (n *Namespace) SetReference(ref *plumbing.Reference) error {
+	return n.Storer.SetReference(n.out(ref))
+}
+
+// CheckAndSetReference writes the ref new into the namespace, when the ref is still at old
+func (n *Namespace) CheckAndSetReference(new, old *plumbing.Reference) error {
+	if old != nil {
+		old = n.out(old)
+	}
+	return n.Storer.CheckAndSetReference(n.out(new), old)
+}
+
+// Reference returns the ref of the namespace. A namespace without its own HEAD has the
+// HEAD of the repository, pointing at the same branch in the namespace.
+func (n *Namespace) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	ref, err := n.Storer.Reference(n.RefName(name))
+	if err == plumbing.ErrReferenceNotFound && name == plumbing.HEAD {
+		if head, err := n.Storer.Reference(plumbing.HEAD); err == nil && head.Type() == plumbing.SymbolicReference {
+			return head, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n.in(ref), nil
+}
+
+// IterReferences returns the refs of the namespace
+func (n *Namespace) IterReferences() (storer.ReferenceIter, error) {
+	iter, err := n.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), n.prefix) {
+			refs = append(refs, n.in(ref))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return storer.NewReferenceSliceIter(refs), nil
+}
+
+// RemoveReference removes the ref from the namespace
+func (n *Namespace) RemoveReference(name plumbing.ReferenceName) error {
+	return n.Storer.RemoveReference(n.RefName(name))
+}
+
+// Namespace returns the repository and the namespace that the request for the repoName by
+// the pusher is served from, see cfg.NamespaceFunc. The namespace is empty when the whole
+// repository is served.
+func (s *Server) Namespace(repoName string, pusher cfg.Pusher) (string, string, error) {
+	if s.NamespaceFunc == nil {
+		return repoName, "", nil
+	}
+	repo, ns, err := s.NamespaceFunc(repoName, pusher)
+	if err != nil {
+		return "", "", ErrRepoNamespace.F(repoName, err)
+	}
+	return repo, ns, nil
+}
+
+// NamespaceStorer returns the repository storage for the repoName, only the refs of the
+// namespace are in it when there is one
+func (s *Server) NamespaceStorer(repoName, ns string) (storer.Storer, error) {
+	sto, err := s.Storer(repoName)
+	if err != nil || ns == "" {
+		return sto, err
+	}
+	return NewNamespace(sto, ns)
+}
+
+// Sessions returns the transport that the go-git sessions for sto are made with, so that
+// only the refs of a namespace, or none for a repository that isn't made yet, are advertised
+func (s *Server) Sessions(sto storer.Storer) transport.Transport {
+	return server.NewServer(storerLoader{sto})
+}
+
+// storerLoader loads the same storage for every endpoint
+type storerLoader struct{ sto storer.Storer }
+
+func (l storerLoader) Load(*transport.Endpoint) (storer.Storer, error) { return l.sto, nil }
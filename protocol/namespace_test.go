@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+func TestNamespace(t *testing.T) {
+	sto, hashes := testRepository(t, "configuration.toml", "a = 1\n", "a = 2\n")
+	master := plumbing.ReferenceName("refs/heads/master")
+
+	acme, err := NewNamespace(sto, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := func(sto storer.ReferenceStorer) []string {
+		iter, err := sto.IterReferences()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		iter.ForEach(func(ref *plumbing.Reference) error {
+			names = append(names, ref.String())
+			return nil
+		})
+		return names
+	}
+	if names := refs(acme); len(names) != 0 {
+		t.Fatalf("have: %v want: no refs in a new namespace", names)
+	}
+
+	// HEAD is the one of the repository until the namespace has its own
+	head, err := acme.Reference(plumbing.HEAD)
+	if err != nil || head.Target() != master {
+		t.Fatalf("have: %v %v want: HEAD at %s", head, err, master)
+	}
+	if _, err := storer.ResolveReference(acme, plumbing.HEAD); err != plumbing.ErrReferenceNotFound {
+		t.Fatalf("have: %v want: %v", err, plumbing.ErrReferenceNotFound)
+	}
+
+	if err := acme.SetReference(plumbing.NewHashReference(master, hashes[0])); err != nil {
+		t.Fatal(err)
+	}
+	if ref, err := sto.Reference("refs/namespaces/acme/refs/heads/master"); err != nil || ref.Hash() != hashes[0] {
+		t.Fatalf("have: %v %v want: the ref under the prefix", ref, err)
+	}
+	if ref, _ := sto.Reference(master); ref.Hash() != hashes[1] {
+		t.Fatalf("have: %v want: master of the repository at %s", ref, hashes[1])
+	}
+	if ref, err := storer.ResolveReference(acme, plumbing.HEAD); err != nil || ref.Hash() != hashes[0] {
+		t.Fatalf("have: %v %v want: HEAD at %s", ref, err, hashes[0])
+	}
+	if names := refs(acme); len(names) != 1 || names[0] != hashes[0].String()+" "+master.String() {
+		t.Fatalf("have: %v want: only master without the prefix", names)
+	}
+
+	// a symbolic ref points in the namespace
+	if err := acme.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, master)); err != nil {
+		t.Fatal(err)
+	}
+	if ref, _ := sto.Reference("refs/namespaces/acme/HEAD"); ref == nil || ref.Target() != "refs/namespaces/acme/refs/heads/master" {
+		t.Fatalf("have: %v want: HEAD of the namespace at its master", ref)
+	}
+	if head, err := acme.Reference(plumbing.HEAD); err != nil || head.Target() != master {
+		t.Fatalf("have: %v %v want: HEAD at %s", head, err, master)
+	}
+
+	other, err := NewNamespace(sto, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := refs(other); len(names) != 0 {
+		t.Fatalf("have: %v want: the refs of acme kept apart", names)
+	}
+
+	// an update only happens from where the ref of the namespace is
+	err = acme.CheckAndSetReference(plumbing.NewHashReference(master, hashes[1]), plumbing.NewHashReference(master, hashes[1]))
+	if err != storage.ErrReferenceHasChanged {
+		t.Fatalf("have: %v want: %v", err, storage.ErrReferenceHasChanged)
+	}
+	if err := acme.CheckAndSetReference(plumbing.NewHashReference(master, hashes[1]), plumbing.NewHashReference(master, hashes[0])); err != nil {
+		t.Fatal(err)
+	}
+	if err := acme.RemoveReference(master); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sto.Reference("refs/namespaces/acme/refs/heads/master"); err != plumbing.ErrReferenceNotFound {
+		t.Fatalf("have: %v want: the ref removed", err)
+	}
+
+	updated := acme.Refs([]cfg.ReceivePackData{{OldHash: hashes[0].String(), NewHash: hashes[1].String(), RefName: master.String()}})
+	if updated[0].RefName != "refs/namespaces/acme/refs/heads/master" {
+		t.Fatalf("have: %s want: the name in the repository", updated[0].RefName)
+	}
+
+	nested, err := NewNamespace(sto, "acme/prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := nested.RefName(master); name != "refs/namespaces/acme/refs/namespaces/prod/refs/heads/master" {
+		t.Fatalf("have: %s want: the nested prefix", name)
+	}
+	for _, name := range []string{"", "acme/", "..", ".hidden", "a b", "a:b", "x.lock"} {
+		if _, err := NewNamespace(sto, name); !errors.Is(err, ErrNamespace) {
+			t.Fatalf("have: %v want: %v for %q", err, ErrNamespace, name)
+		}
+	}
+}
+
+func TestServerNamespace(t *testing.T) {
+	sto, hashes := testRepository(t, "configuration.toml", "a = 1\n", "a = 2\n")
+	repo, err := git.Open(sto, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(cfg.NewMapRegistry(map[string]*git.Repository{"config": repo}), "file:///")
+	s.NamespaceFunc = cfg.NamespaceFromUsername
+	var hookData []cfg.ReceivePackHookData
+	s.PostReceiveHook = func(_ context.Context, _ io.Writer, data *cfg.PostReceivePackHookData) {
+		hookData = append(hookData, data.ReceivePackHookData)
+	}
+
+	acme := cfg.Pusher{Username: "acme"}
+	sig := object.Signature{Name: "acme", Email: "acme@example.com", When: time.Unix(2e9, 0)}
+	commit := func(refName, oldHash string, pusher cfg.Pusher) (string, error) {
+		return s.Commit(context.Background(), nil, "config", cfg.Commit{
+			RefName: refName,
+			OldHash: oldHash,
+			Files:   []cfg.CommitFile{{Path: "configuration.toml", Content: []byte("a = " + oldHash + "\n")}},
+			Author:  sig,
+			Pusher:  pusher,
+		})
+	}
+
+	// master of the namespace is made, master of the repository stays where it is
+	h, err := commit("refs/heads/master", "", acme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref, err := sto.Reference("refs/namespaces/acme/refs/heads/master"); err != nil || ref.Hash().String() != h {
+		t.Fatalf("have: %v %v want: master of acme at %s", ref, err, h)
+	}
+	if ref, _ := sto.Reference("refs/heads/master"); ref.Hash() != hashes[1] {
+		t.Fatalf("have: %v want: master of the repository at %s", ref, hashes[1])
+	}
+	if len(hookData) != 1 || hookData[0].Namespace != "acme" || hookData[0].RepoName != "config" {
+		t.Fatalf("have: %+v want: the post-receive hook of config in acme", hookData)
+	}
+
+	// master of the repository can't be reached from the namespace
+	if _, err := commit("refs/heads/master", hashes[1].String(), acme); !errors.Is(err, ErrCommitStale) {
+		t.Fatalf("have: %v want: %v", err, ErrCommitStale)
+	}
+	if _, err := commit("refs/namespaces/other/refs/heads/master", "", acme); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sto.Reference("refs/namespaces/other/refs/heads/master"); err != plumbing.ErrReferenceNotFound {
+		t.Fatalf("have: %v want: the ref of other untouched", err)
+	}
+
+	// a rollback is made in the namespace too
+	h2, err := commit("refs/heads/master", h, acme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Rollback(context.Background(), nil, "config", cfg.Rollback{RefName: "refs/heads/master", Target: h, Author: sig, Pusher: acme}); err != nil {
+		t.Fatal(err)
+	}
+	if ref, _ := sto.Reference("refs/namespaces/acme/refs/heads/master"); ref.Hash().String() == h2 {
+		t.Fatalf("have: %v want: master of acme rolled back", ref)
+	}
+	if ref, _ := sto.Reference("refs/heads/master"); ref.Hash() != hashes[1] {
+		t.Fatalf("have: %v want: master of the repository at %s", ref, hashes[1])
+	}
+
+	if _, err := commit("refs/heads/master", "", cfg.Pusher{}); !errors.Is(err, ErrRepoNamespace) {
+		t.Fatalf("have: %v want: %v", err, ErrRepoNamespace)
+	}
+}
@@ -0,0 +1,95 @@
+package protocol /* import "gopkg.xa4b.com/git/protocol" */
+
+// This file holds the parts of the git wire protocol that are shared by
+// the HTTP and SSH transports
+
+import (
+	"io"
+	"strings"
+
+	"gopkg.xa4b.com/git/pktline"
+)
+
+// The protocol versions that can be requested by a client
+const (
+	V0 = 0
+	V1 = 1
+	V2 = 2
+)
+
+// Version returns the protocol version that was requested by a client. The value
+// comes from the 'Git-Protocol' HTTP header or the 'GIT_PROTOCOL' SSH environment
+// and is a colon separated list such as: version=2:object-format=sha1. The highest
+// version that is understood is returned, which is V0 when nothing was requested.
+func Version(s string) int {
+	var version = V0
+	for _, kv := range strings.Split(s, ":") {
+		switch kv {
+		case "version=1":
+			if version < V1 {
+				version = V1
+			}
+		case "version=2":
+			version = V2
+		}
+	}
+	return version
+}
+
+// Command holds a single protocol v2 command request. It is made of the
+// command name, the capabilities the client sent with it and the arguments
+// that were sent after the delim-pkt.
+type Command struct {
+	Name         string
+	Capabilities []string
+	Args         []string
+}
+
+// Capability returns the value of the capability key that was sent with
+// the command, and if the capability was sent at all.
+func (cmd *Command) Capability(key string) (string, bool) {
+	for _, c := range cmd.Capabilities {
+		if c == key {
+			return "", true
+		}
+		if strings.HasPrefix(c, key+"=") {
+			return c[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
+// ReadCommand reads the next protocol v2 command request from r. A nil command
+// and a nil error are returned when the client has ended the session, either by
+// closing the connection or by sending a lone flush-pkt.
+func ReadCommand(r io.Reader) (*Command, error) {
+	var cmd *Command
+	var inArgs bool
+
+	scn := pktline.NewScanner(r)
+	for scn.Scan() {
+		if scn.Type() == pktline.PacketDelim {
+			inArgs = true
+			continue
+		}
+
+		ln := strings.TrimSuffix(scn.Text(), "\n")
+		switch {
+		case cmd == nil:
+			if !strings.HasPrefix(ln, "command=") {
+				return nil, ErrUnexpectedLine.F("command", ln)
+			}
+			cmd = &Command{Name: strings.TrimPrefix(ln, "command=")}
+		case inArgs:
+			cmd.Args = append(cmd.Args, ln)
+		default:
+			cmd.Capabilities = append(cmd.Capabilities, ln)
+		}
+	}
+
+	if err := scn.Err(); err != nil {
+		return nil, ErrCommandScan.F(err)
+	}
+
+	return cmd, nil
+}
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want int
+	}{
+		{"empty", "", V0},
+		{"version 1", "version=1", V1},
+		{"version 2", "version=2", V2},
+		{"version 2 with other keys", "object-format=sha1:version=2", V2},
+		{"unknown version", "version=3", V0},
+	}
+
+	for _, test := range tests {
+		func(data string, want int) {
+			t.Run(test.name, func(t *testing.T) {
+				if have := Version(data); have != want {
+					t.Fatalf("have: %d want: %d", have, want)
+				}
+			})
+		}(test.data, test.want)
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    *Command
+		wantErr error
+	}{
+		{
+			name: "ls-refs",
+			data: "0014command=ls-refs\n0015agent=git/2.39.5\n0001000csymrefs\n001bref-prefix refs/heads/\n0000",
+			want: &Command{
+				Name:         "ls-refs",
+				Capabilities: []string{"agent=git/2.39.5"},
+				Args:         []string{"symrefs", "ref-prefix refs/heads/"},
+			},
+		},
+		{
+			name: "end of session",
+			data: "0000",
+		},
+		{
+			name:    "not a command",
+			data:    "000csymrefs\n0000",
+			wantErr: ErrUnexpectedLine,
+		},
+	}
+
+	for _, test := range tests {
+		func(data string, want *Command, wantErr error) {
+			t.Run(test.name, func(t *testing.T) {
+				have, haveErr := ReadCommand(strings.NewReader(data))
+				if haveErr != wantErr && !errors.Is(haveErr, wantErr) {
+					t.Fatalf("have: %v want: %v", haveErr, wantErr)
+				}
+				if !reflect.DeepEqual(have, want) {
+					t.Fatalf("have: %+v want: %+v", have, want)
+				}
+			})
+		}(test.data, test.want, test.wantErr)
+	}
+}
+
+func TestLsRefs(t *testing.T) {
+	sto := memory.NewStorage()
+	master := plumbing.NewHash("6ecf0ef2c2dffb796033e5a02219af86ec6584e5")
+	sto.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/master"))
+	sto.SetReference(plumbing.NewHashReference("refs/heads/master", master))
+	sto.SetReference(plumbing.NewHashReference("refs/tags/v1", master))
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "all",
+			want: "0032" + master.String() + " HEAD\n" +
+				"003f" + master.String() + " refs/heads/master\n" +
+				"003a" + master.String() + " refs/tags/v1\n0000",
+		},
+		{
+			name: "ref-prefix with symrefs",
+			args: []string{"symrefs", "ref-prefix HEAD", "ref-prefix refs/heads/"},
+			want: "0052" + master.String() + " HEAD symref-target:refs/heads/master\n" +
+				"003f" + master.String() + " refs/heads/master\n0000",
+		},
+	}
+
+	for _, test := range tests {
+		func(args []string, want string) {
+			t.Run(test.name, func(t *testing.T) {
+				buf := new(bytes.Buffer)
+				err := NewUploadPack(sto).ServeV2(buf, &Command{Name: "ls-refs", Args: args})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if have := buf.String(); have != want {
+					t.Fatalf("have: %q want: %q", have, want)
+				}
+			})
+		}(test.args, test.want)
+	}
+}
@@ -0,0 +1,169 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"gopkg.xa4b.com/git/cfg"
+	"gopkg.xa4b.com/git/pktline"
+)
+
+// Push runs the receive-pack request req that the pusher p sent for the repository: the
+// pack is kept in a quarantine while the pre-receive hooks decide, the refs they accept
+// are updated, and the subscriptions, the replicator and the post-receive hook are sent
+// the refs that moved. Everything the client is told, what the hooks write and the
+// report-status, is written to w. A push to a mirror is rejected, and a push to a
+// repository that doesn't exist makes it when the server creates repositories on push.
+//
+// The hooks run with ctx, so they can stop when the client goes away. The error is only
+// for what can't be reported to the client, a rejected push is reported and returns nil.
+func (s *Server) Push(ctx context.Context, w io.Writer, repoName string, p cfg.Pusher, req *ReceiveRequest) error {
+	if len(req.Commands) == 0 {
+		return nil // nothing to push
+	}
+
+	// a push to a namespace only changes the refs of the namespace
+	repoName, ns, err := s.Namespace(repoName, p)
+	if err != nil {
+		return ErrSession.F("receive-pack", err)
+	}
+	if m, ok := s.Mirror(repoName); ok {
+		s.info("receive-pack:", "rejected: a mirror of", m.URL)
+		req.Report(w, req.Reject(nil, ErrMirrorPush.F(m.URL)))
+		return nil
+	}
+
+	// a push to a repository that doesn't exist makes it, now that it has commands
+	if err := s.CreateRepo(ctx, repoName, p); err != nil {
+		s.info("receive-pack:", "rejected:", err)
+		req.Report(w, req.Reject(nil, err))
+		return nil
+	}
+	sto, err := s.NamespaceStorer(repoName, ns)
+	if err != nil {
+		return ErrSession.F("receive-pack", err)
+	}
+
+	// the pack is kept in a quarantine until the hooks accept the push,
+	// so that they can read the new objects
+	rpack := NewReceivePack(sto, s.MaxPackSize, s.PackSpillSize)
+	quarantine, err := rpack.Quarantine(req)
+	switch {
+	case errors.Is(err, ErrPackTooLarge):
+		s.info("receive-pack:", "rejected:", err)
+		req.Report(w, req.Reject(err, err))
+		return nil
+	case err != nil:
+		return err
+	}
+	defer quarantine.Close()
+
+	repo, err := quarantine.Repository()
+	if err != nil {
+		s.info("receive-pack:", "ERR:", err) // the hooks can still run without it
+	}
+
+	// the agent is only known once the client has sent its capabilities
+	p.Agent = req.Agent()
+	hookData := &cfg.ReceivePackHookData{
+		RepoName:    repoName,
+		Namespace:   ns,
+		Refs:        cfg.WithStorer(req.Refs(), quarantine),
+		PushOptions: req.PushOptions,
+		Pusher:      p,
+	}
+
+	// the git pre-receive-hook function
+	if s.PreReceiveHook != nil {
+		buf := new(bytes.Buffer)
+		var refBranch string
+		var err *cfg.ReceivePackHookError
+		if hookErr := RunHook(ctx, "pre-receive", s.PreReceiveTimeout, func(ctx context.Context) {
+			refBranch, err = s.PreReceiveHook(ctx, buf, &cfg.PreReceivePackHookData{ReceivePackHookData: *hookData, Repository: repo})
+		}); hookErr != nil {
+			return s.hookFailed(w, req, hookErr)
+		}
+		if err != nil {
+			enc := req.Encoder(w)
+			progress(enc, buf)
+			if req.Atomic() {
+				// no ref moves, so every ref is rejected for the same reason
+				pktline.ReportStatus(enc, req.Reject(nil, ErrAtomicPush.F(refBranch, err)))
+			} else {
+				enc.EncodeString("unpack ok\n")
+				enc.EncodeString(fmt.Sprintf("ng %s %s\n", refBranch, err))
+				enc.Sideband.Flush()
+			}
+			enc.Flush()
+			return nil
+		}
+	}
+
+	// the per-ref pre-receive-hook function, refs that it rejects are
+	// left out when the references are updated
+	var result *cfg.PreReceivePackHookResult
+	if s.PreReceiveRefHook != nil {
+		buf := new(bytes.Buffer)
+		if err := RunHook(ctx, "pre-receive", s.PreReceiveTimeout, func(ctx context.Context) {
+			result = s.PreReceiveRefHook(ctx, buf, &cfg.PreReceivePackHookData{ReceivePackHookData: *hookData, Repository: repo})
+		}); err != nil {
+			return s.hookFailed(w, req, err)
+		}
+		progress(req.Encoder(w), buf)
+	}
+
+	rStat := rpack.UpdateReferences(req, result)
+
+	// the subscriptions and the post-receive-hook only see the refs that were updated
+	updated := Updated(hookData.Refs, rStat)
+	s.Publish(repoName, sto, updated, hookData.PushOptions)
+	if s.PostReceiveHook != nil && len(updated) > 0 {
+		postData := *hookData
+		postData.Refs = updated
+		pr, pw := io.Pipe()
+		go func() {
+			// a hook that doesn't finish in time has its writes cut off
+			pw.CloseWithError(RunHook(ctx, "post-receive", s.PostReceiveTimeout, func(ctx context.Context) {
+				s.PostReceiveHook(ctx, pw, &cfg.PostReceivePackHookData{ReceivePackHookData: postData})
+			}))
+		}()
+		enc := req.Encoder(w)
+		if err := progress(enc, pr); err != nil {
+			s.info("receive-pack:", "ERR:", err)
+			enc.Sideband.EncodeProgress(err.Error() + "\n")
+		}
+	}
+
+	// the whole reason for each rejected ref goes right before the report,
+	// which only has room for the first line
+	req.WriteRejected(req.Encoder(w), result)
+	req.Report(w, rStat)
+	return nil
+}
+
+// hookFailed rejects every ref of the request when a pre-receive hook didn't finish,
+// unless the client went away, then there is no one left to tell
+func (s *Server) hookFailed(w io.Writer, req *ReceiveRequest, err error) error {
+	if errors.Is(err, ErrHookCanceled) {
+		return err
+	}
+	s.info("receive-pack:", "rejected:", err)
+	if errors.Is(err, ErrHookPanic) {
+		err = ErrHookDeclined // what went wrong is for the logs only
+	}
+	req.Report(w, req.Reject(nil, err))
+	return nil
+}
+
+// progress sends each line that a hook wrote to r on the progress sideband of enc
+func progress(enc *pktline.Encoder, r io.Reader) error {
+	scn := bufio.NewScanner(r)
+	for scn.Scan() {
+		enc.Sideband.EncodeProgress(scn.Text() + "\n")
+	}
+	return scn.Err()
+}
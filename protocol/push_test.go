@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+func TestPush(t *testing.T) {
+	sto, hashes := testRepository(t, "configuration.toml", "a = 1\n", "a = 2\n")
+	if err := sto.SetReference(plumbing.NewHashReference("refs/heads/dev", hashes[0])); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := git.Open(sto, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(cfg.NewMapRegistry(map[string]*git.Repository{"config": repo}), "file:///")
+
+	s.PreReceiveRefHook = func(_ context.Context, w io.Writer, data *cfg.PreReceivePackHookData) *cfg.PreReceivePackHookResult {
+		fmt.Fprintln(w, "checked by", data.Pusher.Username)
+		result := &cfg.PreReceivePackHookResult{}
+		for _, ref := range data.Refs {
+			if ref.RefName == "refs/heads/master" {
+				result.Reject(ref, "master is protected")
+				continue
+			}
+			result.Accept(ref)
+		}
+		return result
+	}
+	var postData []cfg.ReceivePackHookData
+	s.PostReceiveHook = func(_ context.Context, w io.Writer, data *cfg.PostReceivePackHookData) {
+		fmt.Fprintln(w, "deployed")
+		postData = append(postData, data.ReceivePackHookData)
+	}
+
+	// deletes don't send a pack, so the request is only the commands
+	zero := plumbing.ZeroHash.String()
+	pkt := func(s string) string { return fmt.Sprintf("%04x%s", len(s)+4, s) }
+	push := func(t *testing.T) string {
+		t.Helper()
+		data := pkt(hashes[1].String()+" "+zero+" refs/heads/master\x00report-status side-band-64k delete-refs agent=git/2.39.5\n") +
+			pkt(hashes[0].String()+" "+zero+" refs/heads/dev\n") + "0000"
+		req, err := ReadReceiveRequest(strings.NewReader(data), 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := new(bytes.Buffer)
+		if err := s.Push(context.Background(), out, "config", cfg.Pusher{Username: "acme"}, req); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	out := push(t)
+	for _, want := range []string{"checked by acme\n", "deployed\n", "ok refs/heads/dev\n", "ng refs/heads/master master is protected\n"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("have: %q want: %q in it", out, want)
+		}
+	}
+	if _, err := sto.Reference("refs/heads/dev"); err != plumbing.ErrReferenceNotFound {
+		t.Fatalf("have: %v want: dev deleted", err)
+	}
+	if ref, _ := sto.Reference("refs/heads/master"); ref.Hash() != hashes[1] {
+		t.Fatalf("have: %v want: master at %s", ref, hashes[1])
+	}
+
+	// the post-receive hook only sees the refs that moved, and the agent of the client
+	if len(postData) != 1 || len(postData[0].Refs) != 1 || postData[0].Refs[0].RefName != "refs/heads/dev" ||
+		postData[0].Pusher.Agent != "git/2.39.5" {
+		t.Fatalf("have: %+v want: the post-receive hook of dev from git/2.39.5", postData)
+	}
+
+	// a mirror can't be pushed to
+	s.SetMirror("config", cfg.Mirror{URL: "https://example.com/config"})
+	if out := push(t); !strings.Contains(out, "ng refs/heads/master "+ErrMirrorPush.F("https://example.com/config").Error()) {
+		t.Fatalf("have: %q want: %s", out, ErrMirrorPush)
+	}
+}
@@ -0,0 +1,261 @@
+package protocol
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem/dotgit"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// Quarantine keeps the objects of a push apart from the repository until the push is
+// accepted, so the pre-receive hooks can read the new objects before they are in the
+// repository. Objects are written to the quarantine, and read from the quarantine and
+// then the repository. Everything else, such as the references, is the repository's.
+//
+// The objects are kept in memory for a repository that is in memory, and in a temporary
+// directory for one that writes packfiles to disk, along with the packfile they came in.
+// Migrate moves them into the repository, and Close throws away whatever is left.
+type Quarantine struct {
+	storer.Storer // the repository
+
+	objects storer.EncodedObjectStorer
+	dir     string
+	pack    string // the packfile of the push, kept in dir
+}
+
+// NewQuarantine returns an empty quarantine for the repository storage sto
+func NewQuarantine(sto storer.Storer) (*Quarantine, error) {
+	q := &Quarantine{Storer: sto}
+	if _, ok := sto.(storer.PackfileWriter); !ok {
+		q.objects = memory.NewStorage()
+		return q, nil
+	}
+
+	dir, err := ioutil.TempDir("", "receive-pack-quarantine-")
+	if err != nil {
+		return nil, ErrQuarantine.F(err)
+	}
+	q.dir = dir
+	q.objects = filesystem.NewObjectStorage(dotgit.New(osfs.New(dir)), cache.NewObjectLRUDefault())
+	return q, nil
+}
+
+// NewEncodedObject returns a new object for the quarantine
+func (q *Quarantine) NewEncodedObject() plumbing.EncodedObject {
+	return q.objects.NewEncodedObject()
+}
+
+// SetEncodedObject writes the object to the quarantine
+func (q *Quarantine) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	return q.objects.SetEncodedObject(obj)
+}
+
+// EncodedObject reads the object from the quarantine, or from the repository
+func (q *Quarantine) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := q.objects.EncodedObject(t, h)
+	if err == plumbing.ErrObjectNotFound {
+		return q.Storer.EncodedObject(t, h)
+	}
+	return obj, err
+}
+
+// IterEncodedObjects iterates over the objects of the quarantine and then the repository
+func (q *Quarantine) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	qIter, err := q.objects.IterEncodedObjects(t)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := q.Storer.IterEncodedObjects(t)
+	if err != nil {
+		qIter.Close()
+		return nil, err
+	}
+	return storer.NewMultiEncodedObjectIter([]storer.EncodedObjectIter{qIter, iter}), nil
+}
+
+// HasEncodedObject returns nil when the object is in the quarantine or the repository
+func (q *Quarantine) HasEncodedObject(h plumbing.Hash) error {
+	if err := q.objects.HasEncodedObject(h); err != plumbing.ErrObjectNotFound {
+		return err
+	}
+	return q.Storer.HasEncodedObject(h)
+}
+
+// EncodedObjectSize returns the size of the object from the quarantine, or from the repository
+func (q *Quarantine) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	size, err := q.objects.EncodedObjectSize(h)
+	if err == plumbing.ErrObjectNotFound {
+		return q.Storer.EncodedObjectSize(h)
+	}
+	return size, err
+}
+
+// Migrate moves the objects of the quarantine into the repository, this is done
+// before any of the references of the push point at them. A repository that writes
+// packfiles is given the objects as one packfile, others are given them one at a time,
+// in one transaction when the repository has them.
+func (q *Quarantine) Migrate() error {
+	if pw, ok := q.Storer.(storer.PackfileWriter); ok && q.pack != "" {
+		return ErrQuarantine.F(q.migratePack(pw))
+	}
+
+	iter, err := q.objects.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return ErrQuarantine.F(err)
+	}
+	defer iter.Close()
+
+	set := q.Storer.SetEncodedObject
+	var tx storer.Transaction
+	if t, ok := q.Storer.(storer.Transactioner); ok {
+		tx = t.Begin()
+		defer tx.Rollback() // a no-op once it is committed
+		set = tx.SetEncodedObject
+	}
+	if err := iter.ForEach(func(obj plumbing.EncodedObject) error {
+		_, err := set(obj)
+		return err
+	}); err != nil {
+		return ErrQuarantine.F(err)
+	}
+	if tx != nil {
+		return ErrQuarantine.F(tx.Commit())
+	}
+	return nil
+}
+
+// migratePack streams the packfile of the push into the repository. A thin pack, one
+// with deltas of objects that are only in the repository, can't be indexed on its own,
+// so the objects of the quarantine are packed again without them.
+func (q *Quarantine) migratePack(pw storer.PackfileWriter) error {
+	thin, err := q.thin()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(q.pack)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := pw.PackfileWriter()
+	if err != nil {
+		return err
+	}
+	if thin {
+		err = q.encode(w)
+	} else {
+		_, err = io.Copy(w, f)
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// thin returns true when the packfile of the push has a delta with a base that isn't in it
+func (q *Quarantine) thin() (bool, error) {
+	f, err := os.Open(q.pack)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := packfile.NewScanner(f)
+	_, count, err := scanner.Header()
+	if err != nil {
+		return false, err
+	}
+	for i := uint32(0); i < count; i++ {
+		oh, err := scanner.NextObjectHeader()
+		if err != nil {
+			return false, err
+		}
+		if oh.Type == plumbing.REFDeltaObject && q.objects.HasEncodedObject(oh.Reference) != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// encode writes the objects of the quarantine to w as a packfile
+func (q *Quarantine) encode(w io.Writer) error {
+	iter, err := q.objects.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return err
+	}
+	var hashes []plumbing.Hash
+	if err := iter.ForEach(func(obj plumbing.EncodedObject) error {
+		hashes = append(hashes, obj.Hash())
+		return nil
+	}); err != nil {
+		return err
+	}
+	_, err = packfile.NewEncoder(w, q.objects, false).Encode(hashes, packWindow)
+	return err
+}
+
+// Close throws away the objects of the quarantine, the ones that were migrated
+// are in the repository
+func (q *Quarantine) Close() error {
+	q.objects = memory.NewStorage()
+	if q.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(q.dir)
+}
+
+// Repository returns a read-only repository of the objects in the quarantine and
+// the repository, for the pre-receive hooks. The references are the ones from before
+// the push. Anything that would change the repository returns ErrReadOnly.
+func (q *Quarantine) Repository() (*git.Repository, error) {
+	sto, ok := q.Storer.(storage.Storer)
+	if !ok {
+		return nil, ErrQuarantine.F("the repository storage can't be opened")
+	}
+	return git.Open(&readOnly{Storer: sto, q: q}, nil)
+}
+
+// readOnly is the storage of the repository that the pre-receive hooks are given,
+// the objects come from the quarantine
+type readOnly struct {
+	storage.Storer // the repository
+
+	q *Quarantine
+}
+
+func (ro *readOnly) NewEncodedObject() plumbing.EncodedObject { return ro.q.NewEncodedObject() }
+func (ro *readOnly) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	return ro.q.EncodedObject(t, h)
+}
+func (ro *readOnly) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	return ro.q.IterEncodedObjects(t)
+}
+func (ro *readOnly) HasEncodedObject(h plumbing.Hash) error { return ro.q.HasEncodedObject(h) }
+func (ro *readOnly) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	return ro.q.EncodedObjectSize(h)
+}
+
+func (ro *readOnly) SetEncodedObject(plumbing.EncodedObject) (plumbing.Hash, error) {
+	return plumbing.ZeroHash, ErrReadOnly
+}
+func (ro *readOnly) SetReference(*plumbing.Reference) error              { return ErrReadOnly }
+func (ro *readOnly) CheckAndSetReference(_, _ *plumbing.Reference) error { return ErrReadOnly }
+func (ro *readOnly) RemoveReference(plumbing.ReferenceName) error        { return ErrReadOnly }
+func (ro *readOnly) PackRefs() error                                     { return ErrReadOnly }
+func (ro *readOnly) SetShallow([]plumbing.Hash) error                    { return ErrReadOnly }
+func (ro *readOnly) SetIndex(*index.Index) error                         { return ErrReadOnly }
+func (ro *readOnly) SetConfig(*config.Config) error                      { return ErrReadOnly }
+func (ro *readOnly) Module(string) (storage.Storer, error)               { return nil, ErrReadOnly }
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/revlist"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+func TestQuarantine(t *testing.T) {
+	src, hashes := testRepository(t, "configuration.toml", "a = 1\n", "a = 2\n")
+	objs, err := revlist.Objects(src, hashes[1:], hashes[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack := new(bytes.Buffer)
+	if _, err := packfile.NewEncoder(pack, src, false).Encode(objs, packWindow); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		onDisk bool
+		reject bool
+	}{
+		{name: "accepted"},
+		{name: "rejected", reject: true},
+		{name: "accepted on disk", onDisk: true},
+		{name: "rejected on disk", onDisk: true, reject: true},
+	}
+
+	for _, test := range tests {
+		func(onDisk, reject bool) {
+			t.Run(test.name, func(t *testing.T) {
+				var sto storage.Storer = memory.NewStorage()
+				var dir string
+				if onDisk {
+					dir, err = ioutil.TempDir("", "quarantine-test-")
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer os.RemoveAll(dir)
+					sto = filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+				}
+
+				// the repository has the first commit, the push has the second
+				base, err := revlist.Objects(src, hashes[:1], nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, h := range base {
+					obj, _ := src.EncodedObject(plumbing.AnyObject, h)
+					if _, err := sto.SetEncodedObject(obj); err != nil {
+						t.Fatal(err)
+					}
+				}
+				sto.SetReference(plumbing.NewHashReference("refs/heads/master", hashes[0]))
+				sto.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/master"))
+
+				req := &ReceiveRequest{
+					Capabilities: capability.NewList(),
+					Commands:     []*packp.Command{{Name: "refs/heads/master", Old: hashes[0], New: hashes[1]}},
+					Packfile:     bytes.NewReader(pack.Bytes()),
+				}
+
+				rpack := NewReceivePack(sto, 0, 0)
+				q, err := rpack.Quarantine(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer q.Close()
+
+				if err := sto.HasEncodedObject(hashes[1]); err != plumbing.ErrObjectNotFound {
+					t.Fatalf("have: %v want: %v", err, plumbing.ErrObjectNotFound)
+				}
+
+				repo, err := q.Repository()
+				if err != nil {
+					t.Fatal(err)
+				}
+				commit, err := repo.CommitObject(hashes[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				file, err := commit.File("configuration.toml")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if have, _ := file.Contents(); have != "a = 2\n" {
+					t.Fatalf("have: %q want: %q", have, "a = 2\n")
+				}
+				if _, err := commit.Parent(0); err != nil {
+					t.Fatal(err) // from the repository
+				}
+				if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/x", hashes[1])); !errors.Is(err, ErrReadOnly) {
+					t.Fatalf("have: %v want: %v", err, ErrReadOnly)
+				}
+
+				var result *cfg.PreReceivePackHookResult
+				want := error(nil)
+				if reject {
+					result = &cfg.PreReceivePackHookResult{}
+					result.Reject(req.Refs()[0], "no")
+					want = plumbing.ErrObjectNotFound
+				}
+				rpack.UpdateReferences(req, result)
+				q.Close()
+
+				if err := sto.HasEncodedObject(hashes[1]); err != want {
+					t.Fatalf("have: %v want: %v", err, want)
+				}
+				if onDisk && !reject {
+					// the objects of the push are in one packfile, none are loose
+					packs, _ := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.pack"))
+					loose, _ := filepath.Glob(filepath.Join(dir, "objects", "[0-9a-f][0-9a-f]", "*"))
+					if len(packs) != 1 || len(loose) != len(base) {
+						t.Fatalf("have: %d packs %d loose want: 1 pack %d loose", len(packs), len(loose), len(base))
+					}
+				}
+			})
+		}(test.onDisk, test.reject)
+	}
+}
@@ -0,0 +1,599 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.xa4b.com/git/cfg"
+	"gopkg.xa4b.com/git/pktline"
+)
+
+// The default limits for the push-options that are sent with a single push
+const (
+	DefaultMaxPushOptions    = 32
+	DefaultMaxPushOptionSize = 1024
+)
+
+// The default limits for the packfile that is sent with a single push. The
+// pack size is not limited by default, and packs that are larger than the
+// spill size are written to a temporary file instead of being held in memory.
+const (
+	DefaultMaxPackSize   = 0
+	DefaultPackSpillSize = 8 << 20
+)
+
+// ReceiveRequest holds a receive-pack request as it is sent by the client. The
+// command list and the push-options are read up front, the packfile is left
+// on the connection so that it can be streamed into the repository.
+type ReceiveRequest struct {
+	Commands     []*packp.Command
+	Capabilities *capability.List
+	Sideband     pktline.SidebandCapability
+	PushOptions  cfg.PushOptions
+	Packfile     io.Reader
+}
+
+// ReadReceiveRequest reads the command list of a receive-pack request from r, the
+// capabilities are sent with the first command. When the client sent the push-options
+// capability the push-options section is read as well, with the limits of
+// ReadPushOptions. A push-option limit error is returned along with the request so
+// that the commands can still be rejected. A request without any commands means
+// the client had nothing to push.
+func ReadReceiveRequest(r io.Reader, maxPushOptions, maxPushOptionSize int) (*ReceiveRequest, error) {
+	req := &ReceiveRequest{Capabilities: capability.NewList(), Packfile: r}
+
+	scn := pktline.NewScanner(r)
+	for scn.Scan() {
+		ln := strings.TrimSuffix(scn.Text(), "\n")
+		if strings.HasPrefix(ln, "shallow ") {
+			continue // the client is shallow, the commands follow
+		}
+
+		if len(req.Commands) == 0 {
+			var caps string
+			if i := strings.IndexByte(ln, 0); i > -1 {
+				ln, caps = ln[:i], ln[i+1:]
+			}
+			if err := req.capabilities(caps); err != nil {
+				return nil, err
+			}
+		}
+
+		cmd, err := command(ln)
+		if err != nil {
+			return nil, err
+		}
+		req.Commands = append(req.Commands, cmd)
+	}
+
+	if err := scn.Err(); err != nil {
+		return nil, ErrCommandScan.F(err)
+	}
+
+	// the push-options come between the commands and the packfile
+	if len(req.Commands) > 0 && req.Capabilities.Supports(capability.PushOptions) {
+		var err error
+		if req.PushOptions, err = ReadPushOptions(r, maxPushOptions, maxPushOptionSize); err != nil {
+			return req, err
+		}
+	}
+
+	return req, nil
+}
+
+// capabilities decodes the capabilities sent with the first command, the
+// sideband that the report-status should be sent on is picked from them.
+func (req *ReceiveRequest) capabilities(caps string) error {
+	if err := req.Capabilities.Decode([]byte(strings.TrimSpace(caps))); err != nil {
+		return ErrCapabilities.F("receive-pack", err)
+	}
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		req.Sideband = pktline.Sideband64k
+	case req.Capabilities.Supports(capability.Sideband):
+		req.Sideband = pktline.Sideband
+	}
+	return nil
+}
+
+// command parses a single command line: <old-id> <new-id> <ref-name>
+func command(ln string) (*packp.Command, error) {
+	f := strings.Fields(ln)
+	if len(f) != 3 || !isHash(f[0]) || !isHash(f[1]) {
+		return nil, ErrInvalidCommand.F(ln)
+	}
+	return &packp.Command{
+		Name: plumbing.ReferenceName(f[2]),
+		Old:  plumbing.NewHash(f[0]),
+		New:  plumbing.NewHash(f[1]),
+	}, nil
+}
+
+// Refs returns the commands of the request in the form that is passed to the hooks
+func (req *ReceiveRequest) Refs() []cfg.ReceivePackData {
+	refs := make([]cfg.ReceivePackData, 0, len(req.Commands))
+	for _, cmd := range req.Commands {
+		refs = append(refs, cfg.ReceivePackData{
+			OldHash: cmd.Old.String(),
+			NewHash: cmd.New.String(),
+			RefName: cmd.Name.String(),
+		})
+	}
+	return refs
+}
+
+// DeleteOnly returns true when every command deletes a reference, the client
+// doesn't send a packfile at all for those requests.
+func (req *ReceiveRequest) DeleteOnly() bool {
+	for _, cmd := range req.Commands {
+		if cmd.Action() != packp.Delete {
+			return false
+		}
+	}
+	return true
+}
+
+// Agent returns the agent that the client sent with its capabilities, if any
+func (req *ReceiveRequest) Agent() string {
+	if agent := req.Capabilities.Get(capability.Agent); len(agent) > 0 {
+		return agent[0]
+	}
+	return ""
+}
+
+// Atomic returns true when the client asked for all of the commands to be
+// applied, or none of them
+func (req *ReceiveRequest) Atomic() bool {
+	return req.Capabilities.Supports(capability.Atomic)
+}
+
+// Reject returns a report-status where every command of the request is rejected
+// for the same reason, a nil reason accepts them all instead. The unpack status
+// is "ok" unless an unpack error is passed.
+func (req *ReceiveRequest) Reject(unpackErr, reason error) *packp.ReportStatus {
+	rs := packp.NewReportStatus()
+	rs.UnpackStatus = "ok"
+	if unpackErr != nil {
+		rs.UnpackStatus = unpackErr.Error()
+	}
+	status := "ok"
+	if reason != nil {
+		status = reason.Error()
+	}
+	for _, cmd := range req.Commands {
+		rs.CommandStatuses = append(rs.CommandStatuses, &packp.CommandStatus{
+			ReferenceName: cmd.Name,
+			Status:        status,
+		})
+	}
+	return rs
+}
+
+// Encoder returns a pkt-line encoder of w with the sideband that the client asked for,
+// what is written to the sideband of the encoder is muxed onto it
+func (req *ReceiveRequest) Encoder(w io.Writer) *pktline.Encoder {
+	var opts []pktline.EncoderOption
+	switch req.Sideband {
+	case pktline.Sideband64k:
+		opts = append(opts, pktline.WithSideband64kMuxer)
+	case pktline.Sideband:
+		opts = append(opts, pktline.WithSidebandMuxer)
+	}
+	return pktline.NewEncoder(w, opts...).WithSidebandCapability(pktline.Sideband64k)
+}
+
+// Report sends the report-status rs to w, when the client asked for it
+func (req *ReceiveRequest) Report(w io.Writer, rs *packp.ReportStatus) {
+	if !req.Capabilities.Supports(capability.ReportStatus) {
+		return
+	}
+	enc := req.Encoder(w)
+	pktline.ReportStatus(enc, rs)
+	enc.Flush()
+}
+
+// ReadPushOptions reads the push-options section that follows the command list of a
+// receive-pack request when the client sent the push-options capability. Each option
+// is a pkt-line and the section ends with a flush-pkt. A limit of zero or less is not
+// enforced, otherwise breaking a limit returns ErrPushOptionsCount or ErrPushOptionSize
+// after the whole section has been read, so the packfile can still be read from r.
+func ReadPushOptions(r io.Reader, maxCount, maxSize int) (cfg.PushOptions, error) {
+	var opts cfg.PushOptions
+	var limitErr error
+
+	scn := pktline.NewScanner(r)
+	for scn.Scan() {
+		ln := strings.TrimSuffix(scn.Text(), "\n")
+		switch {
+		case limitErr != nil:
+			continue // keep reading until the end of the section
+		case maxCount > 0 && len(opts) >= maxCount:
+			limitErr = ErrPushOptionsCount.F(maxCount)
+		case maxSize > 0 && len(ln) > maxSize:
+			limitErr = ErrPushOptionSize.F(maxSize)
+		default:
+			opts = append(opts, cfg.NewPushOption(ln))
+		}
+	}
+
+	if err := scn.Err(); err != nil {
+		return nil, ErrPushOptionsScan.F(err)
+	}
+
+	return opts, limitErr
+}
+
+// ReceivePack serves the receive-pack service of a single repository
+type ReceivePack struct {
+	sto        storer.Storer
+	quarantine *Quarantine
+
+	maxPackSize   int64
+	packSpillSize int64
+}
+
+// NewReceivePack returns a new ReceivePack object for the repository storage sto. Pushed
+// packfiles larger than maxPackSize are rejected, and the ones larger than packSpillSize
+// are spooled to a temporary file while they are read. A size of zero or less for
+// maxPackSize is unlimited, and for packSpillSize means the pack is always spooled to disk.
+func NewReceivePack(sto storer.Storer, maxPackSize, packSpillSize int64) *ReceivePack {
+	return &ReceivePack{sto: sto, maxPackSize: maxPackSize, packSpillSize: packSpillSize}
+}
+
+// WritePack reads the packfile from r and writes its objects into the repository.
+//
+// The pack is read in full before anything is stored, so a pack that breaks the max
+// pack size (ErrPackTooLarge) or that is cut short leaves the repository untouched.
+// While it is read the pack is kept in memory up to the spill size and in a temporary
+// file after that, which also lets go-git seek back to delta bases instead of caching
+// them. The rest of an oversized pack is discarded so the client can read the report.
+func (rp *ReceivePack) WritePack(r io.Reader) error {
+	sp := &spool{spill: rp.packSpillSize}
+	defer sp.Close()
+
+	src := r
+	if rp.maxPackSize > 0 {
+		src = io.LimitReader(r, rp.maxPackSize+1)
+	}
+	if _, err := io.Copy(sp, src); err != nil {
+		return ErrPackRead.F(err)
+	}
+
+	if rp.maxPackSize > 0 && sp.size > rp.maxPackSize {
+		io.Copy(ioutil.Discard, r)
+		return ErrPackTooLarge.F(rp.maxPackSize)
+	}
+	if sp.size == 0 {
+		return nil // a pack with nothing in it
+	}
+
+	pack, err := sp.Reader()
+	if err != nil {
+		return ErrPackRead.F(err)
+	}
+
+	if pw, ok := rp.sto.(storer.PackfileWriter); ok {
+		if err := packfile.WritePackfileToObjectStorage(pw, pack); err != nil {
+			return ErrPackWrite.F(err)
+		}
+		return nil
+	}
+
+	p, err := packfile.NewParserWithStorage(packfile.NewScanner(pack), rp.sto)
+	if err != nil {
+		return ErrPackWrite.F(err)
+	}
+	if _, err := p.Parse(); err != nil {
+		return ErrPackWrite.F(err)
+	}
+	return nil
+}
+
+// Quarantine reads the packfile of the request into a quarantine the same way as
+// WritePack, so the objects can be read before they are in the repository (see
+// Quarantine). UpdateReferences migrates them into the repository when it has
+// commands to apply. The caller closes the quarantine once it is done with it.
+func (rp *ReceivePack) Quarantine(req *ReceiveRequest) (*Quarantine, error) {
+	q, err := NewQuarantine(rp.sto)
+	if err != nil {
+		return nil, err
+	}
+	if !req.DeleteOnly() {
+		if err := rp.quarantinePack(q, req.Packfile); err != nil {
+			q.Close()
+			return nil, err
+		}
+	}
+	rp.quarantine = q
+	return q, nil
+}
+
+// quarantinePack writes the objects of the packfile r into the quarantine q. When the
+// quarantine is on disk the packfile is kept there too, for Migrate.
+func (rp *ReceivePack) quarantinePack(q *Quarantine, r io.Reader) error {
+	qp := &ReceivePack{sto: q, maxPackSize: rp.maxPackSize, packSpillSize: rp.packSpillSize}
+	if q.dir == "" {
+		return qp.WritePack(r)
+	}
+
+	f, err := os.Create(filepath.Join(q.dir, "push.pack"))
+	if err != nil {
+		return ErrQuarantine.F(err)
+	}
+	defer f.Close()
+
+	src := r
+	if rp.maxPackSize > 0 {
+		src = io.LimitReader(r, rp.maxPackSize+1) // so an oversized pack isn't kept
+	}
+	if err := qp.WritePack(io.TeeReader(src, f)); err != nil {
+		io.Copy(ioutil.Discard, r)
+		return err
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		q.pack = f.Name()
+	}
+	return nil
+}
+
+// UpdateReferences applies the commands of the request to the references of the
+// repository. The status of every command is returned in the order that they were sent.
+// Without the atomic capability the commands are applied one at a time, and a command
+// that fails doesn't stop the others. Refs that the pre-receive hook rejected in result
+// are left alone and get the first line of the reason as their status, a nil result
+// accepts every ref. The objects of the quarantine are migrated before any ref is changed.
+func (rp *ReceivePack) UpdateReferences(req *ReceiveRequest, result *cfg.PreReceivePackHookResult) *packp.ReportStatus {
+	if err := rp.migrate(req, result); err != nil {
+		return req.Reject(err, err)
+	}
+
+	if req.Atomic() {
+		return rp.updateAtomic(req, result)
+	}
+
+	rs := packp.NewReportStatus()
+	rs.UnpackStatus = "ok"
+
+	for _, cmd := range req.Commands {
+		status := "ok"
+		err := rejected(cmd, result)
+		if err == nil {
+			err = rp.checkReference(cmd)
+		}
+		if err == nil {
+			err = rp.setReference(cmd)
+		}
+		if err != nil {
+			status = err.Error()
+		}
+		rs.CommandStatuses = append(rs.CommandStatuses, &packp.CommandStatus{
+			ReferenceName: cmd.Name,
+			Status:        status,
+		})
+	}
+
+	return rs
+}
+
+// updateAtomic applies all of the commands or none of them. Every command is checked
+// before any reference is changed, and the references that were changed are put back
+// when a later one fails. A failure rejects every command with the same reason.
+func (rp *ReceivePack) updateAtomic(req *ReceiveRequest, result *cfg.PreReceivePackHookResult) *packp.ReportStatus {
+	for _, cmd := range req.Commands {
+		err := rejected(cmd, result)
+		if err == nil {
+			err = rp.checkReference(cmd)
+		}
+		if err != nil {
+			return req.Reject(nil, ErrAtomicPush.F(cmd.Name, err))
+		}
+	}
+
+	var undo []*packp.Command
+	for _, cmd := range req.Commands {
+		old := plumbing.ZeroHash
+		if ref, err := rp.sto.Reference(cmd.Name); err == nil {
+			old = ref.Hash()
+		}
+		if err := rp.setReference(cmd); err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				rp.setReference(undo[i])
+			}
+			return req.Reject(nil, ErrAtomicPush.F(cmd.Name, err))
+		}
+		undo = append(undo, &packp.Command{Name: cmd.Name, Old: cmd.New, New: old})
+	}
+
+	return req.Reject(nil, nil)
+}
+
+// migrate moves the objects of the quarantine into the repository, unless there
+// is no command that can point a reference at them
+func (rp *ReceivePack) migrate(req *ReceiveRequest, result *cfg.PreReceivePackHookResult) error {
+	if rp.quarantine == nil {
+		return nil
+	}
+
+	var updates int
+	for _, cmd := range req.Commands {
+		switch {
+		case rejected(cmd, result) != nil && req.Atomic():
+			return nil // nothing is applied
+		case rejected(cmd, result) == nil && cmd.Action() != packp.Delete:
+			updates++
+		}
+	}
+	if updates == 0 {
+		return nil
+	}
+	return rp.quarantine.Migrate()
+}
+
+// rejected returns the reason the pre-receive hook rejected the ref of a command as
+// an error. A report-status line can't hold more than one line, so only the first
+// line of the reason is used, the rest is for the sideband (see WriteRejected).
+func rejected(cmd *packp.Command, result *cfg.PreReceivePackHookResult) error {
+	reason, ok := result.Rejected(cmd.Name.String())
+	if !ok {
+		return nil
+	}
+	for _, ln := range strings.Split(reason, "\n") {
+		if ln = strings.TrimSpace(ln); ln != "" && ln != "ok" {
+			return errors.New(ln)
+		}
+	}
+	return ErrHookDeclined
+}
+
+// WriteRejected sends the whole reason for every ref that the pre-receive hook
+// rejected on the sideband, each line under the name of its ref. The reasons go on
+// the progress channel so that the client still reads the report-status after them,
+// unless the client didn't ask for report-status, then the error channel is the
+// only way to tell it that the push failed. Nothing is sent without a sideband.
+func (req *ReceiveRequest) WriteRejected(enc *pktline.Encoder, result *cfg.PreReceivePackHookResult) error {
+	sb, ok := enc.Sideband.(*pktline.SidebandEncoder)
+	if !ok {
+		return nil
+	}
+
+	var text strings.Builder
+	for _, cmd := range req.Commands {
+		reason, ok := result.Rejected(cmd.Name.String())
+		if !ok {
+			continue
+		}
+		if reason = strings.TrimRight(reason, "\n"); reason == "" {
+			reason = ErrHookDeclined.Error()
+		}
+		for _, ln := range strings.Split(reason, "\n") {
+			fmt.Fprintf(&text, "%s: %s\n", cmd.Name, ln)
+		}
+	}
+	if text.Len() == 0 {
+		return nil
+	}
+
+	c := pktline.SidebandProgress
+	if !req.Capabilities.Supports(capability.ReportStatus) {
+		c = pktline.SidebandError
+	}
+	w := sb.Writer(c)
+	w.WriteString(text.String())
+	return w.Flush()
+}
+
+// Updated returns the refs that were changed according to the report-status rs,
+// refs holds the data of the commands of the request
+func Updated(refs []cfg.ReceivePackData, rs *packp.ReportStatus) []cfg.ReceivePackData {
+	ok := make(map[string]bool, len(rs.CommandStatuses))
+	for _, cs := range rs.CommandStatuses {
+		ok[cs.ReferenceName.String()] = cs.Error() == nil
+	}
+
+	var updated []cfg.ReceivePackData
+	for _, ref := range refs {
+		if ok[ref.RefName] {
+			updated = append(updated, ref)
+		}
+	}
+	return updated
+}
+
+// checkReference checks that a command can be applied, a create must not overwrite
+// a reference and an update or delete must change the reference from its old object id.
+func (rp *ReceivePack) checkReference(cmd *packp.Command) error {
+	ref, err := rp.sto.Reference(cmd.Name)
+	switch {
+	case err == plumbing.ErrReferenceNotFound:
+		if cmd.Action() != packp.Create {
+			return ErrUpdateReference
+		}
+	case err != nil:
+		return err
+	case cmd.Action() == packp.Create:
+		return ErrUpdateReference
+	case ref.Hash() != cmd.Old:
+		return ErrStaleReference
+	}
+	return nil
+}
+
+// setReference points the reference of a command at its new object id, or
+// removes the reference for a delete. An update only happens when the reference
+// is still at its old object id.
+func (rp *ReceivePack) setReference(cmd *packp.Command) error {
+	switch cmd.Action() {
+	case packp.Delete:
+		return rp.sto.RemoveReference(cmd.Name)
+	case packp.Update:
+		err := rp.sto.CheckAndSetReference(plumbing.NewHashReference(cmd.Name, cmd.New), plumbing.NewHashReference(cmd.Name, cmd.Old))
+		if err == storage.ErrReferenceHasChanged {
+			return ErrStaleReference
+		}
+		return err
+	}
+	return rp.sto.SetReference(plumbing.NewHashReference(cmd.Name, cmd.New))
+}
+
+// spool is a writer that keeps what is written in memory until it grows past
+// the spill size, after that everything is moved to a temporary file
+type spool struct {
+	spill int64
+	size  int64
+
+	buf  bytes.Buffer
+	file *os.File
+}
+
+func (sp *spool) Write(p []byte) (int, error) {
+	if sp.file == nil && sp.size+int64(len(p)) > sp.spill {
+		f, err := ioutil.TempFile("", "receive-pack-*.pack")
+		if err != nil {
+			return 0, err
+		}
+		sp.file = f
+		if _, err := sp.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if sp.file != nil {
+		n, err = sp.file.Write(p)
+	} else {
+		n, err = sp.buf.Write(p)
+	}
+	sp.size += int64(n)
+	return n, err
+}
+
+// Reader returns a reader for everything that has been written from the start
+func (sp *spool) Reader() (io.ReadSeeker, error) {
+	if sp.file == nil {
+		return bytes.NewReader(sp.buf.Bytes()), nil
+	}
+	_, err := sp.file.Seek(0, io.SeekStart)
+	return sp.file, err
+}
+
+// Close removes the temporary file, if there is one
+func (sp *spool) Close() error {
+	if sp.file == nil {
+		return nil
+	}
+	sp.file.Close()
+	return os.Remove(sp.file.Name())
+}
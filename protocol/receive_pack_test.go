@@ -0,0 +1,328 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/revlist"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.xa4b.com/git/cfg"
+	"gopkg.xa4b.com/git/pktline"
+)
+
+func TestReadPushOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		maxCount int
+		maxSize  int
+		want     cfg.PushOptions
+		wantErr  error
+		wantRest string
+	}{
+		{
+			name:     "ordered options",
+			data:     "000ereload=now000fenv=staging000bverbose0000PACK",
+			want:     cfg.PushOptions{{Key: "reload", Value: "now"}, {Key: "env", Value: "staging"}, {Key: "verbose"}},
+			wantRest: "PACK",
+		},
+		{
+			name:     "too many",
+			data:     "0005a0005b0005c0000PACK",
+			maxCount: 2,
+			want:     cfg.PushOptions{{Key: "a"}, {Key: "b"}},
+			wantErr:  ErrPushOptionsCount,
+			wantRest: "PACK",
+		},
+		{
+			name:     "too long",
+			data:     "000ereload=now0000PACK",
+			maxSize:  5,
+			wantErr:  ErrPushOptionSize,
+			wantRest: "PACK",
+		},
+	}
+
+	for _, test := range tests {
+		func(data string, maxCount, maxSize int, want cfg.PushOptions, wantErr error, wantRest string) {
+			t.Run(test.name, func(t *testing.T) {
+				r := strings.NewReader(data)
+				have, haveErr := ReadPushOptions(r, maxCount, maxSize)
+				if haveErr != wantErr && !errors.Is(haveErr, wantErr) {
+					t.Fatalf("have: %v want: %v", haveErr, wantErr)
+				}
+				if !reflect.DeepEqual(have, want) {
+					t.Fatalf("have: %v want: %v", have, want)
+				}
+				if haveRest, _ := ioutil.ReadAll(r); string(haveRest) != wantRest {
+					t.Fatalf("have: %q want: %q", haveRest, wantRest)
+				}
+			})
+		}(test.data, test.maxCount, test.maxSize, test.want, test.wantErr, test.wantRest)
+	}
+}
+
+func TestReadReceiveRequest(t *testing.T) {
+	zero, a, b := plumbing.ZeroHash.String(), strings.Repeat("a", 40), strings.Repeat("b", 40)
+	pkt := func(s string) string { return fmt.Sprintf("%04x%s", len(s)+4, s) }
+
+	tests := []struct {
+		name         string
+		data         string
+		wantRefs     []cfg.ReceivePackData
+		wantSideband pktline.SidebandCapability
+		wantOpts     cfg.PushOptions
+		wantErr      error
+		wantRest     string
+	}{
+		{
+			name: "every command",
+			data: pkt(zero+" "+a+" refs/heads/master\x00 report-status side-band-64k agent=git/2.39.5\n") +
+				pkt(a+" "+b+" refs/heads/dev\n") + "0000PACK",
+			wantRefs: []cfg.ReceivePackData{
+				{OldHash: zero, NewHash: a, RefName: "refs/heads/master"},
+				{OldHash: a, NewHash: b, RefName: "refs/heads/dev"},
+			},
+			wantSideband: pktline.Sideband64k,
+			wantRest:     "PACK",
+		},
+		{
+			name: "push-options",
+			data: pkt(a+" "+b+" refs/heads/master\x00report-status side-band push-options\n") + "0000" +
+				pkt("reload=now") + "0000PACK",
+			wantRefs:     []cfg.ReceivePackData{{OldHash: a, NewHash: b, RefName: "refs/heads/master"}},
+			wantSideband: pktline.Sideband,
+			wantOpts:     cfg.PushOptions{{Key: "reload", Value: "now"}},
+			wantRest:     "PACK",
+		},
+		{
+			name:     "nothing to push",
+			data:     "0000",
+			wantRefs: []cfg.ReceivePackData{},
+		},
+		{
+			name:    "bad command",
+			data:    pkt(a+" refs/heads/master\x00report-status\n") + "0000",
+			wantErr: ErrInvalidCommand,
+		},
+	}
+
+	for _, test := range tests {
+		func(data string, wantRefs []cfg.ReceivePackData, wantSideband pktline.SidebandCapability, wantOpts cfg.PushOptions, wantErr error, wantRest string) {
+			t.Run(test.name, func(t *testing.T) {
+				r := strings.NewReader(data)
+				have, haveErr := ReadReceiveRequest(r, 0, 0)
+				if haveErr != wantErr && !errors.Is(haveErr, wantErr) {
+					t.Fatalf("have: %v want: %v", haveErr, wantErr)
+				}
+				if wantErr != nil {
+					return
+				}
+				if haveRefs := have.Refs(); !reflect.DeepEqual(haveRefs, wantRefs) {
+					t.Fatalf("have: %v want: %v", haveRefs, wantRefs)
+				}
+				if have.Sideband != wantSideband {
+					t.Fatalf("have: %v want: %v", have.Sideband, wantSideband)
+				}
+				if !reflect.DeepEqual(have.PushOptions, wantOpts) {
+					t.Fatalf("have: %v want: %v", have.PushOptions, wantOpts)
+				}
+				if haveRest, _ := ioutil.ReadAll(have.Packfile); string(haveRest) != wantRest {
+					t.Fatalf("have: %q want: %q", haveRest, wantRest)
+				}
+			})
+		}(test.data, test.wantRefs, test.wantSideband, test.wantOpts, test.wantErr, test.wantRest)
+	}
+}
+
+func TestWritePack(t *testing.T) {
+	src, hashes := testRepository(t, "configuration.toml", "a = 1\n", "a = 2\n")
+	objs, err := revlist.Objects(src, hashes[1:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack := new(bytes.Buffer)
+	if _, err := packfile.NewEncoder(pack, src, false).Encode(objs, packWindow); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(pack.Len())
+
+	tests := []struct {
+		name      string
+		maxSize   int64
+		spillSize int64
+		wantErr   error
+	}{
+		{name: "in memory", spillSize: size},
+		{name: "spilled to disk", spillSize: size / 2},
+		{name: "at the max size", maxSize: size, spillSize: size},
+		{name: "too large", maxSize: size - 1, spillSize: size, wantErr: ErrPackTooLarge},
+	}
+
+	for _, test := range tests {
+		func(maxSize, spillSize int64, wantErr error) {
+			t.Run(test.name, func(t *testing.T) {
+				sto := memory.NewStorage()
+				r := bytes.NewReader(pack.Bytes())
+				haveErr := NewReceivePack(sto, maxSize, spillSize).WritePack(r)
+				if haveErr != wantErr && !errors.Is(haveErr, wantErr) {
+					t.Fatalf("have: %v want: %v", haveErr, wantErr)
+				}
+				if r.Len() != 0 {
+					t.Fatalf("have: %d unread bytes want: 0", r.Len())
+				}
+
+				want := len(objs)
+				if wantErr != nil {
+					want = 0 // nothing is stored from a rejected pack
+				}
+				if have := len(sto.Objects); have != want {
+					t.Fatalf("have: %d objects want: %d", have, want)
+				}
+			})
+		}(test.maxSize, test.spillSize, test.wantErr)
+	}
+}
+
+func TestUpdateReferences(t *testing.T) {
+	a, b := plumbing.NewHash(strings.Repeat("a", 40)), plumbing.NewHash(strings.Repeat("b", 40))
+	dev := cfg.ReceivePackData{OldHash: a.String(), NewHash: b.String(), RefName: "refs/heads/dev"}
+
+	tests := []struct {
+		name    string
+		atomic  bool
+		reject  string
+		want    []string
+		wantDev plumbing.Hash
+	}{
+		{
+			name:    "ref by ref",
+			want:    []string{"ok", "failed to update ref"},
+			wantDev: b,
+		},
+		{
+			name:    "atomic",
+			atomic:  true,
+			want:    []string{"atomic push failed for refs/tags/v1: failed to update ref", "atomic push failed for refs/tags/v1: failed to update ref"},
+			wantDev: a,
+		},
+		{
+			name:    "rejected by the hook",
+			reject:  "\ndev is protected\nask an admin to merge it",
+			want:    []string{"dev is protected", "failed to update ref"},
+			wantDev: a,
+		},
+		{
+			name:    "rejected by the hook without a reason",
+			want:    []string{"pre-receive hook declined", "failed to update ref"},
+			reject:  " ",
+			wantDev: a,
+		},
+		{
+			name:    "atomic rejected by the hook",
+			atomic:  true,
+			reject:  "dev is protected",
+			want:    []string{"atomic push failed for refs/heads/dev: dev is protected", "atomic push failed for refs/heads/dev: dev is protected"},
+			wantDev: a,
+		},
+	}
+
+	for _, test := range tests {
+		func(atomic bool, reject string, want []string, wantDev plumbing.Hash) {
+			t.Run(test.name, func(t *testing.T) {
+				sto := memory.NewStorage()
+				sto.SetReference(plumbing.NewHashReference("refs/heads/dev", a))
+				sto.SetReference(plumbing.NewHashReference("refs/tags/v1", a))
+
+				req := &ReceiveRequest{
+					Capabilities: capability.NewList(),
+					Commands: []*packp.Command{
+						{Name: "refs/heads/dev", Old: a, New: b},
+						{Name: "refs/tags/v1", Old: plumbing.ZeroHash, New: b}, // v1 already exists
+					},
+				}
+				if atomic {
+					req.Capabilities.Set(capability.Atomic)
+				}
+
+				var result *cfg.PreReceivePackHookResult
+				if reject != "" {
+					result = &cfg.PreReceivePackHookResult{}
+					result.Reject(dev, reject)
+				}
+
+				rs := NewReceivePack(sto, 0, 0).UpdateReferences(req, result)
+				var have []string
+				for _, cs := range rs.CommandStatuses {
+					have = append(have, cs.Status)
+				}
+				if !reflect.DeepEqual(have, want) {
+					t.Fatalf("have: %q want: %q", have, want)
+				}
+				if ref, _ := sto.Reference("refs/heads/dev"); ref.Hash() != wantDev {
+					t.Fatalf("have: %s want: %s", ref.Hash(), wantDev)
+				}
+			})
+		}(test.atomic, test.reject, test.want, test.wantDev)
+	}
+}
+
+func TestWriteRejected(t *testing.T) {
+	a, b := plumbing.NewHash(strings.Repeat("a", 40)), plumbing.NewHash(strings.Repeat("b", 40))
+
+	tests := []struct {
+		name         string
+		reportStatus bool
+		want         string
+	}{
+		{
+			name:         "progress",
+			reportStatus: true,
+			want:         "003a\x02refs/heads/dev: dev is protected\nrefs/heads/dev: ask\n0000",
+		},
+		{
+			name: "error without report-status",
+			want: "003a\x03refs/heads/dev: dev is protected\nrefs/heads/dev: ask\n0000",
+		},
+	}
+
+	for _, test := range tests {
+		func(reportStatus bool, want string) {
+			t.Run(test.name, func(t *testing.T) {
+				req := &ReceiveRequest{
+					Capabilities: capability.NewList(),
+					Commands: []*packp.Command{
+						{Name: "refs/heads/dev", Old: a, New: b},
+						{Name: "refs/heads/main", Old: a, New: b},
+					},
+				}
+				if reportStatus {
+					req.Capabilities.Set(capability.ReportStatus)
+				}
+
+				result := &cfg.PreReceivePackHookResult{}
+				result.Accept(req.Refs()[1])
+				result.Reject(req.Refs()[0], "dev is protected\nask")
+
+				buf := new(bytes.Buffer)
+				enc := pktline.NewEncoder(buf, pktline.WithSideband64kMuxer)
+				if err := req.WriteRejected(enc, result); err != nil {
+					t.Fatal(err)
+				}
+				enc.Flush()
+				if have := buf.String(); have != want {
+					t.Fatalf("have: %q want: %q", have, want)
+				}
+			})
+		}(test.reportStatus, test.want)
+	}
+}
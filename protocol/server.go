@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"gopkg.xa4b.com/git/cfg"
+)
+
+// Server is the part of a git server that doesn't depend on the transport: the registry of
+// the repositories that are served, the hooks, and what is done with the refs that a push,
+// a commit, a mirror or a bundle updates. The servers of cfghttp and cfgssh are built on
+// one, they read and write the git protocol on top of it.
+//
+// The fields are set before the server is used.
+type Server struct {
+	Registry cfg.Registry
+	Endpoint string        // the repositories are loaded from Endpoint + repoName
+	Loader   server.Loader // loads the repositories of the registry
+
+	MaxPackSize   int64
+	PackSpillSize int64
+
+	PreReceiveHook    cfg.PreReceivePackHookContextFunc
+	PreReceiveRefHook cfg.PreReceivePackRefHookContextFunc
+	PostReceiveHook   cfg.PostReceivePackHookContextFunc
+
+	PreReceiveTimeout  time.Duration
+	PostReceiveTimeout time.Duration
+
+	Replicator    cfg.Replicator
+	CreateOnPush  *cfg.CreateOnPush
+	NamespaceFunc cfg.NamespaceFunc
+
+	// Log is where the info logs go, nil doesn't log
+	Log func(v ...interface{})
+
+	watchers cfg.Watchers
+
+	mirrors   map[string]cfg.Mirror
+	mirrorsMu sync.RWMutex
+	fetchMu   sync.Mutex
+
+	createMu sync.Mutex
+}
+
+// NewServer returns a server of the repositories in the registry, they are loaded from
+// the endpoint the same way as the go-git transport sessions load them
+func NewServer(reg cfg.Registry, endpoint string) *Server {
+	return &Server{
+		Registry:      reg,
+		Endpoint:      endpoint,
+		Loader:        cfg.NewRegistryLoader(reg, endpoint),
+		MaxPackSize:   DefaultMaxPackSize,
+		PackSpillSize: DefaultPackSpillSize,
+	}
+}
+
+// Subscribe returns a subscription to the changes of the files that match the path glob on
+// the ref of the repository, see cfg.Watchers
+func (s *Server) Subscribe(repoName, refName, glob string) *cfg.Subscription {
+	return s.watchers.Subscribe(repoName, refName, glob)
+}
+
+// Storer returns the repository storage for the repoName
+func (s *Server) Storer(repoName string) (storer.Storer, error) {
+	endpoint, err := transport.NewEndpoint(s.Endpoint + repoName)
+	if err != nil {
+		return nil, ErrEndpoint.F(repoName, err)
+	}
+	return s.Loader.Load(endpoint)
+}
+
+// Publish sends the refs that were just updated in the repository storage sto to the
+// subscriptions and the replicator. The refs of a namespace are sent with the names they
+// have in the repository, so that the namespaces are kept apart.
+func (s *Server) Publish(repoName string, sto storer.Storer, refs []cfg.ReceivePackData, opts cfg.PushOptions) {
+	if ns, ok := sto.(*Namespace); ok {
+		sto, refs = ns.Storer, ns.Refs(refs)
+	}
+	s.watchers.Publish(repoName, sto, refs)
+	if s.Replicator != nil && len(refs) > 0 {
+		s.Replicator.Replicate(repoName, sto, refs, opts)
+	}
+}
+
+// updated publishes the refs of data, which were just updated in the repository sto, and
+// runs the post-receive hook the same as after a push. What the hook writes goes to w.
+func (s *Server) updated(ctx context.Context, w io.Writer, sto storer.Storer, data *cfg.ReceivePackHookData) {
+	if len(data.Refs) == 0 {
+		return
+	}
+	s.Publish(data.RepoName, sto, data.Refs, data.PushOptions)
+	if s.PostReceiveHook == nil {
+		return
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		// a hook that doesn't finish in time has its writes cut off
+		pw.CloseWithError(RunHook(ctx, "post-receive", s.PostReceiveTimeout, func(ctx context.Context) {
+			s.PostReceiveHook(ctx, pw, &cfg.PostReceivePackHookData{ReceivePackHookData: *data})
+		}))
+	}()
+	if _, err := io.Copy(w, pr); err != nil {
+		s.info("ERR:", err) // the refs are updated, so it isn't undone
+		fmt.Fprintln(w, err)
+		io.Copy(ioutil.Discard, pr) // so the hook isn't stuck on a writer that failed
+	}
+}
+
+// info logs v when there is a logger
+func (s *Server) info(v ...interface{}) {
+	if s.Log != nil {
+		s.Log(v...)
+	}
+}
@@ -0,0 +1,275 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.xa4b.com/git/pktline"
+)
+
+// shallowArg parses a shallow or deepen line of a fetch request, these are
+// the same for all of the protocol versions. False is returned when the line
+// is something else.
+func (req *uploadRequest) shallowArg(cmd string, kv []string) (bool, error) {
+	switch kv[0] {
+	case "shallow":
+		if len(kv) != 2 || !isHash(kv[1]) {
+			return true, ErrInvalidObjectID.F(cmd, strings.Join(kv, " "))
+		}
+		req.shallows = append(req.shallows, plumbing.NewHash(kv[1]))
+	case "deepen":
+		depth, err := strconv.Atoi(strings.Join(kv[1:], " "))
+		if err != nil || depth <= 0 {
+			return true, ErrInvalidDeepen.F(strings.Join(kv, " "))
+		}
+		req.depth = depth
+	case "deepen-since":
+		since, err := strconv.ParseInt(strings.Join(kv[1:], " "), 10, 64)
+		if err != nil {
+			return true, ErrInvalidDeepen.F(strings.Join(kv, " "))
+		}
+		req.deepenSince = since
+	case "deepen-not":
+		if len(kv) != 2 {
+			return true, ErrInvalidDeepen.F(strings.Join(kv, " "))
+		}
+		req.deepenNot = append(req.deepenNot, kv[1])
+	case "deepen-relative":
+		req.deepenRelative = true
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// deepening returns true when the client asked to change the depth of its history
+func (req *uploadRequest) deepening() bool {
+	return req.depth > 0 || req.deepenSince > 0 || len(req.deepenNot) > 0
+}
+
+// isShallow returns true when the client is deepening or already has a shallow
+// history, then the pack must stop at the shallow boundary.
+func (req *uploadRequest) isShallow() bool {
+	return req.deepening() || len(req.shallows) > 0
+}
+
+// deepen works out the new shallow boundary of the client. The commits that become
+// shallow and the ones that the client has as shallow, but are not anymore, are
+// returned. The parents of the unshallow commits are added to the wants so that the
+// history behind them is sent. Every commit whose parents are not sent ends up in cut.
+func (up *UploadPack) deepen(req *uploadRequest) (shallow, unshallow []plumbing.Hash, err error) {
+	if req.depth > 0 && (req.deepenSince > 0 || len(req.deepenNot) > 0) {
+		return nil, nil, ErrDeepenConflict
+	}
+
+	clientShallow := make(map[plumbing.Hash]bool, len(req.shallows))
+	for _, h := range req.shallows {
+		if _, err := up.sto.EncodedObject(plumbing.CommitObject, h); err == nil {
+			clientShallow[h] = true // shallow commits we don't know about are ignored
+		}
+	}
+
+	var boundary, notShallow map[plumbing.Hash]bool
+	switch {
+	case req.depth > 0 && req.deepenRelative:
+		// the depth starts from where the history of the client stops
+		from := make([]plumbing.Hash, 0, len(clientShallow))
+		for h := range clientShallow {
+			from = append(from, h)
+		}
+		boundary, notShallow, err = up.shallowByDepth(from, req.depth+1)
+	case req.depth > 0:
+		boundary, notShallow, err = up.shallowByDepth(req.wants, req.depth)
+	case req.deepenSince > 0 || len(req.deepenNot) > 0:
+		boundary, notShallow, err = up.shallowByRevList(req.wants, req.deepenSince, req.deepenNot)
+	default:
+		boundary, notShallow = map[plumbing.Hash]bool{}, map[plumbing.Hash]bool{}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.cut = make(map[plumbing.Hash]bool, len(boundary)+len(clientShallow))
+	for h := range boundary {
+		req.cut[h] = true
+		if !clientShallow[h] {
+			shallow = append(shallow, h)
+		}
+	}
+
+	for _, h := range req.shallows {
+		if !clientShallow[h] {
+			continue
+		}
+		if !notShallow[h] {
+			req.cut[h] = true // the client stays shallow here
+			continue
+		}
+		unshallow = append(unshallow, h)
+		c, err := object.GetCommit(up.sto, h)
+		if err != nil {
+			return nil, nil, ErrRevList.F(err)
+		}
+		req.wants = append(req.wants, c.ParentHashes...)
+	}
+
+	sortHashes(shallow)
+	return shallow, unshallow, nil
+}
+
+// shallowByDepth walks the history from the commits in from, the commits at the depth
+// that still have parents are the shallow boundary. The commits before the boundary
+// have their parents sent, these are the not shallow commits.
+func (up *UploadPack) shallowByDepth(from []plumbing.Hash, depth int) (boundary, notShallow map[plumbing.Hash]bool, err error) {
+	boundary, notShallow = make(map[plumbing.Hash]bool), make(map[plumbing.Hash]bool)
+
+	seen := make(map[plumbing.Hash]bool)
+	for d, level := 1, up.commits(from); len(level) > 0; d++ {
+		var next []plumbing.Hash
+		for _, h := range level {
+			if seen[h] {
+				continue
+			}
+			seen[h] = true
+
+			c, err := object.GetCommit(up.sto, h)
+			if err != nil {
+				return nil, nil, ErrRevList.F(err)
+			}
+			if d >= depth {
+				if c.NumParents() > 0 {
+					boundary[h] = true
+				}
+				continue
+			}
+			notShallow[h] = true
+			next = append(next, c.ParentHashes...)
+		}
+		level = next
+	}
+
+	return boundary, notShallow, nil
+}
+
+// shallowByRevList selects the commits that are reachable from the wants, that were
+// committed at or after since and that are not reachable from the deepen-not references.
+// The selected commits that have a parent which was not selected are the shallow boundary.
+func (up *UploadPack) shallowByRevList(wants []plumbing.Hash, since int64, not []string) (boundary, notShallow map[plumbing.Hash]bool, err error) {
+	exclude := make(map[plumbing.Hash]bool)
+	for _, name := range not {
+		ref, err := up.expandRef(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := up.walkCommits(up.commits([]plumbing.Hash{ref.Hash()}), func(c *object.Commit) bool {
+			exclude[c.Hash] = true
+			return true
+		}); err != nil {
+			return nil, nil, ErrRevList.F(err)
+		}
+	}
+
+	selected := make(map[plumbing.Hash]bool)
+	if err := up.walkCommits(up.commits(wants), func(c *object.Commit) bool {
+		if exclude[c.Hash] || (since > 0 && c.Committer.When.Unix() < since) {
+			return false
+		}
+		selected[c.Hash] = true
+		return true
+	}); err != nil {
+		return nil, nil, ErrRevList.F(err)
+	}
+	if len(selected) == 0 {
+		return nil, nil, ErrNoShallowCommits
+	}
+
+	boundary, notShallow = make(map[plumbing.Hash]bool), make(map[plumbing.Hash]bool)
+	for h := range selected {
+		c, err := object.GetCommit(up.sto, h)
+		if err != nil {
+			return nil, nil, ErrRevList.F(err)
+		}
+		notShallow[h] = true
+		for _, p := range c.ParentHashes {
+			if !selected[p] {
+				boundary[h] = true
+				delete(notShallow, h)
+				break
+			}
+		}
+	}
+
+	return boundary, notShallow, nil
+}
+
+// expandRef finds the reference for a name the way that git does for
+// rev-parse, a name such as v1.0 matches refs/tags/v1.0.
+func (up *UploadPack) expandRef(name string) (*plumbing.Reference, error) {
+	for _, rule := range plumbing.RefRevParseRules {
+		ref, err := storer.ResolveReference(up.sto, plumbing.ReferenceName(fmt.Sprintf(rule, name)))
+		if err == nil {
+			return ref, nil
+		}
+	}
+	return nil, ErrInvalidDeepen.F("deepen-not " + name)
+}
+
+// commits returns the commits of hashes, annotated tags are peeled to what they
+// point at and everything that is not a commit is left out.
+func (up *UploadPack) commits(hashes []plumbing.Hash) []plumbing.Hash {
+	var commits []plumbing.Hash
+	for _, h := range hashes {
+		if tag, err := object.GetTag(up.sto, h); err == nil {
+			if h, err = peelTag(up.sto, tag); err != nil {
+				continue
+			}
+		}
+		if _, err := up.sto.EncodedObject(plumbing.CommitObject, h); err == nil {
+			commits = append(commits, h)
+		}
+	}
+	return commits
+}
+
+// walkCommits calls fn for every commit that is reachable from the commits in from,
+// once each. The parents of a commit are only walked when fn returns true.
+func (up *UploadPack) walkCommits(from []plumbing.Hash, fn func(*object.Commit) bool) error {
+	seen := make(map[plumbing.Hash]bool)
+	for stack := from; len(stack) > 0; {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		c, err := object.GetCommit(up.sto, h)
+		if err != nil {
+			return err
+		}
+		if fn(c) {
+			stack = append(stack, c.ParentHashes...)
+		}
+	}
+	return nil
+}
+
+// writeShallowInfo writes the shallow and unshallow lines, the caller ends the section
+func writeShallowInfo(enc *pktline.Encoder, shallow, unshallow []plumbing.Hash) {
+	for _, h := range shallow {
+		enc.EncodeString(fmt.Sprintf("shallow %s\n", h))
+	}
+	for _, h := range unshallow {
+		enc.EncodeString(fmt.Sprintf("unshallow %s\n", h))
+	}
+}
+
+// sortHashes sorts hashes so that they are always sent in the same order
+func sortHashes(hashes []plumbing.Hash) {
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].String() < hashes[j].String() })
+}
@@ -0,0 +1,545 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.xa4b.com/git/pktline"
+)
+
+// packWindow is the number of objects go-git looks back at when it is
+// searching for deltas
+const packWindow = 10
+
+// UploadPack serves the upload-pack service of a single repository
+type UploadPack struct {
+	sto storer.Storer
+
+	// the objects of the advertised refs, and the ones reachable from them, for the wants
+	tips, fromTips map[plumbing.Hash]bool
+}
+
+// NewUploadPack returns a new UploadPack object for the repository storage sto
+func NewUploadPack(sto storer.Storer) *UploadPack {
+	return &UploadPack{sto: sto}
+}
+
+// uploadRequest holds what a client asked for in an upload-pack request, it
+// is the same for all of the protocol versions
+type uploadRequest struct {
+	wants, haves []plumbing.Hash
+	sideband     pktline.SidebandCapability
+
+	done, ofsDelta, includeTag, noProgress bool
+
+	// the shallow and deepen lines, cut is where the history that is sent stops
+	shallows       []plumbing.Hash
+	depth          int
+	deepenSince    int64
+	deepenNot      []string
+	deepenRelative bool
+	cut            map[plumbing.Hash]bool
+
+	filter *objectFilter
+}
+
+// SetCapabilities sets the protocol v0 and v1 capabilities that the upload-pack
+// supports on the advertised capability list caps.
+func (up *UploadPack) SetCapabilities(caps *capability.List) error {
+	for _, c := range []capability.Capability{
+		capability.OFSDelta,
+		capability.Sideband,
+		capability.Sideband64k,
+		capability.NoProgress,
+		capability.IncludeTag,
+		capability.Shallow,
+		capability.DeepenSince,
+		capability.DeepenNot,
+		capability.DeepenRelative,
+		Filter,
+		capability.AllowReachableSHA1InWant,
+	} {
+		if err := caps.Set(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeV0 serves a protocol v0 or v1 upload-pack request that is read from r, after
+// the references have been advertised. For stateless connections (HTTP) only a single
+// round of negotiation is read, the client sends the next round in a new request.
+// Errors that come from a bad request are also sent to the client.
+func (up *UploadPack) ServeV0(w io.Writer, r io.Reader, stateless bool) error {
+	req, err := up.readWants(r)
+	if err != nil {
+		pktline.NewEncoder(w).EncodeString(fmt.Sprintf("ERR %v\n", err))
+		return err
+	}
+	if len(req.wants) == 0 {
+		return nil // the client is up to date
+	}
+
+	// the new shallow boundary is sent before the negotiation starts, but only
+	// to a client that is deepening, otherwise it doesn't read it
+	if req.isShallow() {
+		shallow, unshallow, err := up.deepen(req)
+		if err != nil {
+			pktline.NewEncoder(w).EncodeString(fmt.Sprintf("ERR %v\n", err))
+			return err
+		}
+		if req.deepening() {
+			enc := pktline.NewEncoder(w)
+			writeShallowInfo(enc, shallow, unshallow)
+			enc.Flush()
+		}
+	}
+
+	common, err := up.negotiate(w, r, req, stateless)
+	if err != nil {
+		pktline.NewEncoder(w).EncodeString(fmt.Sprintf("ERR %v\n", err))
+		return err
+	}
+	if !req.done {
+		return nil // the next round comes in the next request
+	}
+
+	return up.sendPack(w, req, common)
+}
+
+// readWants reads the want lines of an upload-request, the first line also
+// carries the capabilities the client would like to use. The shallow, deepen
+// and filter lines come after the wants.
+func (up *UploadPack) readWants(r io.Reader) (*uploadRequest, error) {
+	req := new(uploadRequest)
+
+	scn := pktline.NewScanner(r)
+	for scn.Scan() {
+		ln := strings.TrimSuffix(scn.Text(), "\n")
+		kv := strings.SplitN(ln, " ", 3)
+		switch kv[0] {
+		case "want":
+			h, err := up.want(kv[:2])
+			if err != nil {
+				return nil, err
+			}
+			if len(req.wants) == 0 && len(kv) == 3 {
+				req.capabilities(strings.Fields(kv[2]))
+			}
+			req.wants = append(req.wants, h)
+		case "filter":
+			f, err := parseFilter(strings.TrimPrefix(ln, "filter "))
+			if err != nil {
+				return nil, err
+			}
+			req.filter = f
+		default:
+			if ok, err := req.shallowArg("upload-pack", kv); err != nil {
+				return nil, err
+			} else if !ok {
+				return nil, ErrUnexpectedLine.F("upload-pack", ln)
+			}
+		}
+	}
+
+	if err := scn.Err(); err != nil {
+		return nil, ErrCommandScan.F(err)
+	}
+
+	return req, nil
+}
+
+// capabilities sets the request options from the capabilities sent by the client,
+// the ones that are not understood are ignored.
+func (req *uploadRequest) capabilities(caps []string) {
+	for _, c := range caps {
+		switch capability.Capability(c) {
+		case capability.Sideband:
+			if req.sideband == pktline.SidebandNone {
+				req.sideband = pktline.Sideband
+			}
+		case capability.Sideband64k:
+			req.sideband = pktline.Sideband64k
+		case capability.OFSDelta:
+			req.ofsDelta = true
+		case capability.IncludeTag:
+			req.includeTag = true
+		case capability.NoProgress:
+			req.noProgress = true
+		case capability.DeepenRelative:
+			req.deepenRelative = true
+		}
+	}
+}
+
+// negotiate reads the haves of the client until it is done. Without multi_ack the
+// first common commit is acknowledged, and a NAK is sent for every flush-pkt until
+// then. The commits that are common are returned.
+func (up *UploadPack) negotiate(w io.Writer, r io.Reader, req *uploadRequest, stateless bool) ([]plumbing.Hash, error) {
+	enc := pktline.NewEncoder(w)
+	for {
+		var lines int
+
+		scn := pktline.NewScanner(r)
+		for scn.Scan() {
+			lines++
+			ln := strings.TrimSuffix(scn.Text(), "\n")
+			switch {
+			case ln == "done":
+				req.done = true
+				if len(req.haves) == 0 {
+					enc.EncodeString("NAK\n")
+				}
+				return req.haves, nil
+			case strings.HasPrefix(ln, "have "):
+				h := strings.TrimPrefix(ln, "have ")
+				if !isHash(h) {
+					return nil, ErrInvalidObjectID.F("upload-pack", ln)
+				}
+				if common := up.common([]plumbing.Hash{plumbing.NewHash(h)}); len(common) > 0 {
+					req.haves = append(req.haves, common...)
+					if len(req.haves) == 1 {
+						enc.EncodeString(fmt.Sprintf("ACK %s\n", h))
+					}
+				}
+			default:
+				return nil, ErrUnexpectedLine.F("upload-pack", ln)
+			}
+		}
+
+		if err := scn.Err(); err != nil {
+			return nil, ErrCommandScan.F(err)
+		}
+		if lines == 0 && stateless && req.deepening() {
+			return nil, nil // the first request of a shallow fetch only asks for the shallow info
+		}
+		if lines == 0 {
+			return nil, ErrNegotiation // the client went away without being done
+		}
+
+		if len(req.haves) == 0 {
+			enc.EncodeString("NAK\n")
+		}
+		if stateless {
+			return req.haves, nil
+		}
+	}
+}
+
+// want checks the object id of a want line, the object must be one of the advertised
+// refs or be reachable from them
+func (up *UploadPack) want(kv []string) (plumbing.Hash, error) {
+	if len(kv) != 2 || !isHash(kv[1]) {
+		return plumbing.ZeroHash, ErrInvalidObjectID.F("want", strings.Join(kv, " "))
+	}
+	h := plumbing.NewHash(kv[1])
+	if _, err := up.sto.EncodedObject(plumbing.AnyObject, h); err != nil {
+		return plumbing.ZeroHash, ErrNotOurRef.F(h)
+	}
+	ok, err := up.isReachable(h)
+	if err != nil {
+		return plumbing.ZeroHash, ErrRevList.F(err)
+	}
+	if !ok {
+		return plumbing.ZeroHash, ErrNotOurRef.F(h)
+	}
+	return h, nil
+}
+
+// isReachable returns true when h is an advertised ref, a tag that one peels to, or an
+// object reachable from them. The reachable objects are only walked once a want isn't
+// a ref, which is rare.
+func (up *UploadPack) isReachable(h plumbing.Hash) (bool, error) {
+	if up.tips == nil {
+		refs, err := up.references()
+		if err != nil {
+			return false, err
+		}
+		up.tips = make(map[plumbing.Hash]bool, len(refs))
+		for _, ref := range refs {
+			ref, err := storer.ResolveReference(up.sto, ref.Name())
+			if err != nil {
+				continue // a HEAD without a branch is advertised without a hash
+			}
+			up.tips[ref.Hash()] = true
+			for tag, err := object.GetTag(up.sto, ref.Hash()); err == nil; tag, err = object.GetTag(up.sto, tag.Target) {
+				up.tips[tag.Target] = true
+			}
+		}
+	}
+	if up.tips[h] {
+		return true, nil
+	}
+
+	if up.fromTips == nil {
+		tips := make([]plumbing.Hash, 0, len(up.tips))
+		for tip := range up.tips {
+			tips = append(tips, tip)
+		}
+		up.fromTips = make(map[plumbing.Hash]bool)
+		if _, err := up.reachable(tips, nil, nil, up.fromTips); err != nil {
+			up.fromTips = nil
+			return false, err
+		}
+	}
+	return up.fromTips[h], nil
+}
+
+// common returns the haves that are commits found in the repository
+func (up *UploadPack) common(haves []plumbing.Hash) []plumbing.Hash {
+	var common []plumbing.Hash
+	for _, h := range haves {
+		if _, err := up.sto.EncodedObject(plumbing.CommitObject, h); err == nil {
+			common = append(common, h)
+		}
+	}
+	return common
+}
+
+// sendPack streams the packfile of the objects the client wants, but doesn't have, to w.
+// When the client asked for a sideband the packfile is muxed onto channel 1 in packets as
+// large as the sideband allows, progress goes to channel 2 and errors to channel 3. Without
+// a sideband the packfile is written as is.
+func (up *UploadPack) sendPack(w io.Writer, req *uploadRequest, haves []plumbing.Hash) error {
+	var sb *pktline.SidebandEncoder
+	switch req.sideband {
+	case pktline.Sideband64k:
+		sb = pktline.NewEncoder(w, pktline.WithSideband64kMuxer).Sideband.(*pktline.SidebandEncoder)
+	case pktline.Sideband:
+		sb = pktline.NewEncoder(w, pktline.WithSidebandMuxer).Sideband.(*pktline.SidebandEncoder)
+	}
+
+	fail := func(err error) error {
+		if sb != nil {
+			sb.EncodeError(err.Error() + "\n")
+		}
+		return err
+	}
+	progress := func(format string, v ...interface{}) {
+		if sb != nil && !req.noProgress {
+			sb.EncodeProgress(fmt.Sprintf(format, v...))
+		}
+	}
+
+	objs, err := up.objects(req, haves)
+	if err != nil {
+		return fail(err)
+	}
+	progress("Enumerating objects: %d, done.\n", len(objs))
+
+	if sb == nil {
+		if _, err := packfile.NewEncoder(w, up.sto, !req.ofsDelta).Encode(objs, packWindow); err != nil {
+			return ErrPackEncode.F(err)
+		}
+		return nil
+	}
+
+	sbw := sb.Writer(pktline.SidebandPackfile)
+	if _, err := packfile.NewEncoder(sbw, up.sto, !req.ofsDelta).Encode(objs, packWindow); err != nil {
+		return fail(ErrPackEncode.F(err))
+	}
+	if err := sbw.Flush(); err != nil {
+		return ErrPackEncode.F(err)
+	}
+	progress("Total %d, done.\n", len(objs))
+	pktline.NewEncoder(w).Flush()
+
+	return nil
+}
+
+// objects returns all of the objects that are reachable from the wants but not from
+// the haves, the history stops at the shallow boundary and the filter of a partial clone
+// leaves objects out. Annotated tags that point into the objects are added when the
+// client asked for them with include-tag.
+func (up *UploadPack) objects(req *uploadRequest, haves []plumbing.Hash) ([]plumbing.Hash, error) {
+	clientShallow := make(map[plumbing.Hash]bool, len(req.shallows))
+	for _, h := range req.shallows {
+		clientShallow[h] = true
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	if _, err := up.reachable(haves, clientShallow, nil, seen); err != nil {
+		return nil, ErrRevList.F(err)
+	}
+
+	objs, err := up.reachable(req.wants, req.cut, req.filter, seen)
+	if err != nil {
+		return nil, ErrRevList.F(err)
+	}
+
+	if req.includeTag {
+		objs, err = up.includeTags(objs)
+		if err != nil {
+			return nil, ErrRevList.F(err)
+		}
+	}
+
+	return objs, nil
+}
+
+// reachable adds every object that is reachable from the objects in from to seen, and
+// returns the ones that were not seen before in the order they were found. The parents
+// of the commits in cut are not followed, the client doesn't have them or won't get them.
+//
+// The filter leaves trees and blobs out by their depth below the root tree of a commit,
+// or by their size. The objects in from are always kept since they were asked for by
+// their object id. A tree that is found again closer to the root is walked again, so the
+// filter uses the smallest depth of every object.
+func (up *UploadPack) reachable(from []plumbing.Hash, cut map[plumbing.Hash]bool, filter *objectFilter, seen map[plumbing.Hash]bool) ([]plumbing.Hash, error) {
+	type item struct {
+		h        plumbing.Hash
+		depth    int
+		explicit bool
+	}
+
+	var objs []plumbing.Hash
+	var stack []item
+	for _, h := range from {
+		stack = append(stack, item{h: h, explicit: true})
+	}
+
+	depths := make(map[plumbing.Hash]int) // the smallest depth that a tree was walked at
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if d, ok := depths[it.h]; ok && d <= it.depth {
+			continue
+		}
+		if seen[it.h] && !(filter != nil && it.depth < depths[it.h]) {
+			continue
+		}
+
+		obj, err := up.sto.EncodedObject(plumbing.AnyObject, it.h)
+		if err != nil {
+			return nil, err
+		}
+
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			c, err := object.DecodeCommit(up.sto, obj)
+			if err != nil {
+				return nil, err
+			}
+			if !cut[it.h] {
+				for _, p := range c.ParentHashes {
+					stack = append(stack, item{h: p})
+				}
+			}
+			stack = append(stack, item{h: c.TreeHash})
+		case plumbing.TreeObject:
+			if !it.explicit && filter.omitTree(it.depth) {
+				continue // it may still be found closer to the root
+			}
+			t, err := object.DecodeTree(up.sto, obj)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range t.Entries {
+				if e.Mode != filemode.Submodule {
+					stack = append(stack, item{h: e.Hash, depth: it.depth + 1})
+				}
+			}
+			if filter != nil {
+				depths[it.h] = it.depth
+			}
+		case plumbing.BlobObject:
+			if !it.explicit && filter.omitBlob(it.depth, obj.Size()) {
+				continue
+			}
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(up.sto, obj)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, item{h: t.Target, explicit: it.explicit})
+		}
+
+		if !seen[it.h] {
+			seen[it.h] = true
+			objs = append(objs, it.h)
+		}
+	}
+	return objs, nil
+}
+
+// includeTags adds the annotated tags whose target is part of objs
+func (up *UploadPack) includeTags(objs []plumbing.Hash) ([]plumbing.Hash, error) {
+	seen := make(map[plumbing.Hash]bool, len(objs))
+	for _, h := range objs {
+		seen[h] = true
+	}
+
+	iter, err := up.sto.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || !ref.Name().IsTag() || seen[ref.Hash()] {
+			return nil
+		}
+		var chain []plumbing.Hash
+		for h := ref.Hash(); ; {
+			tag, err := object.GetTag(up.sto, h)
+			if err != nil {
+				return nil // a lightweight tag, or an object we can't read
+			}
+			chain = append(chain, tag.Hash)
+			if tag.TargetType != plumbing.TagObject {
+				if seen[tag.Target] {
+					for _, t := range chain {
+						seen[t] = true
+						objs = append(objs, t)
+					}
+				}
+				return nil
+			}
+			h = tag.Target
+		}
+	})
+
+	return objs, err
+}
+
+// peelTag follows a tag until it reaches an object that is not a tag
+func peelTag(s storer.EncodedObjectStorer, tag *object.Tag) (plumbing.Hash, error) {
+	for tag.TargetType == plumbing.TagObject {
+		var err error
+		if tag, err = object.GetTag(s, tag.Target); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	return tag.Target, nil
+}
+
+// hasPrefix returns true if s starts with any of the prefixes, or if
+// there are no prefixes at all
+func hasPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHash returns true if s is a full hex encoded object id
+func isHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
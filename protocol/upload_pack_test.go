@@ -0,0 +1,186 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.xa4b.com/git/pktline"
+)
+
+func TestServeV0(t *testing.T) {
+	sto, hashes := testRepository(t, "configuration.toml", "a = 1\n", "a = 2\n")
+
+	tests := []struct {
+		name       string
+		data       string
+		stateless  bool
+		wantPrefix string
+		wantPack   bool
+	}{
+		{
+			name:       "clone without sideband",
+			data:       "0032want " + hashes[1].String() + "\n00000009done\n",
+			wantPrefix: "0008NAK\nPACK",
+			wantPack:   true,
+		},
+		{
+			name:       "clone with sideband",
+			data:       "0040want " + hashes[1].String() + " side-band-64k\n00000009done\n",
+			wantPrefix: "0008NAK\n",
+			wantPack:   true,
+		},
+		{
+			name:       "fetch acknowledges the first common commit",
+			data:       "0032want " + hashes[1].String() + "\n00000032have " + hashes[0].String() + "\n0000",
+			stateless:  true,
+			wantPrefix: "0031ACK " + hashes[0].String() + "\n",
+		},
+		{
+			name:       "shallow clone",
+			data:       "0032want " + hashes[1].String() + "\n000ddeepen 1\n00000009done\n",
+			wantPrefix: "0035shallow " + hashes[1].String() + "\n00000008NAK\nPACK",
+			wantPack:   true,
+		},
+		{
+			name: "deepen relative to the shallow commits",
+			data: "0042want " + hashes[1].String() + " deepen-relative\n" +
+				"0035shallow " + hashes[1].String() + "\n000ddeepen 1\n0000",
+			stateless:  true,
+			wantPrefix: "0037unshallow " + hashes[1].String() + "\n0000",
+		},
+		{
+			name:       "not our ref",
+			data:       "0032want " + strings.Repeat("1", 40) + "\n0000",
+			wantPrefix: "004aERR upload-pack: not our ref " + strings.Repeat("1", 40) + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		func(data string, stateless bool, wantPrefix string, wantPack bool) {
+			t.Run(test.name, func(t *testing.T) {
+				buf := new(bytes.Buffer)
+				NewUploadPack(sto).ServeV0(buf, strings.NewReader(data), stateless)
+				have := buf.String()
+				if !strings.HasPrefix(have, wantPrefix) {
+					t.Fatalf("have: %q want prefix: %q", have, wantPrefix)
+				}
+				if havePack := strings.Contains(have, "PACK"); havePack != wantPack {
+					t.Fatalf("have: %t want: %t", havePack, wantPack)
+				}
+			})
+		}(test.data, test.stateless, test.wantPrefix, test.wantPack)
+	}
+}
+
+func TestServeV0SidebandPackets(t *testing.T) {
+	sto, hashes := testRepository(t, "certs.pem", strings.Repeat("0123456789abcdef", 10000))
+
+	buf := new(bytes.Buffer)
+	data := "0040want " + hashes[0].String() + " side-band-64k\n00000009done\n"
+	if err := NewUploadPack(sto).ServeV0(buf, strings.NewReader(data), false); err != nil {
+		t.Fatal(err)
+	}
+
+	scn := pktline.NewScanner(buf)
+	if !scn.Scan() || scn.Text() != "NAK\n" {
+		t.Fatalf("have: %q want: %q", scn.Text(), "NAK\n")
+	}
+	for scn.Scan() {
+		if have := len(scn.Bytes()) + 4; have > 65520 {
+			t.Fatalf("have: %d want: <= %d", have, 65520)
+		}
+		if have := scn.Bytes()[0]; have < 1 || have > 2 {
+			t.Fatalf("have: %d want: %d or %d", have, pktline.SidebandPackfile, pktline.SidebandProgress)
+		}
+	}
+	if err := scn.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWantReachable(t *testing.T) {
+	sto, hashes := testRepository(t, "configuration.toml", "a = 1\n", "a = 2\n")
+
+	// an object that is in the repository, but that no ref reaches
+	blob := sto.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, _ := blob.Writer()
+	w.Write([]byte("secret\n"))
+	w.Close()
+	unreachable, err := sto.SetEncodedObject(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, err := NewNamespace(sto, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		up   *UploadPack
+		want plumbing.Hash
+		err  error
+	}{
+		{name: "a ref", up: NewUploadPack(sto), want: hashes[1]},
+		{name: "reachable from a ref", up: NewUploadPack(sto), want: hashes[0]},
+		{name: "not reachable", up: NewUploadPack(sto), want: unreachable, err: ErrNotOurRef},
+		{name: "not in the namespace", up: NewUploadPack(acme), want: hashes[1], err: ErrNotOurRef},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.up.want([]string{"want", test.want.String()})
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Fatalf("have: %v want: %v", err, test.err)
+			}
+		})
+	}
+}
+
+// testRepository returns the storage of an in-memory repository that has a
+// commit for each of the contents written to the file name, along with the
+// hashes of the commits in order.
+func testRepository(t *testing.T, name string, contents ...string) (*memory.Storage, []plumbing.Hash) {
+	t.Helper()
+
+	sto := memory.NewStorage()
+	fs := memfs.New()
+	repo, err := git.Init(sto, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []plumbing.Hash
+	for i, content := range contents {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+		f.Close()
+		if _, err := wt.Add(name); err != nil {
+			t.Fatal(err)
+		}
+		sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(int64(1e9+i), 0)}
+		h, err := wt.Commit("commit", &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+	}
+
+	return sto, hashes
+}
@@ -0,0 +1,224 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.xa4b.com/git/pktline"
+)
+
+// AdvertiseV2 writes the protocol v2 capability advertisement to w. It is the
+// first thing a server sends for a protocol v2 upload-pack.
+func (up *UploadPack) AdvertiseV2(w io.Writer) error {
+	enc := pktline.NewEncoder(w)
+	for _, ln := range []string{
+		"version 2",
+		fmt.Sprintf("%s=%s", capability.Agent, capability.DefaultAgent),
+		"ls-refs",
+		"fetch=shallow filter",
+		"object-format=sha1",
+	} {
+		if err := enc.EncodeString(ln + "\n"); err != nil {
+			return err
+		}
+	}
+	enc.Flush()
+	return nil
+}
+
+// ServeV2 writes the response of the protocol v2 command cmd to w. Errors that
+// come from a bad request are also sent to the client as an ERR packet.
+func (up *UploadPack) ServeV2(w io.Writer, cmd *Command) (err error) {
+	switch cmd.Name {
+	case "ls-refs":
+		err = up.lsRefs(w, cmd)
+	case "fetch":
+		err = up.fetch(w, cmd)
+	default:
+		err = ErrUnknownCommand.F(cmd.Name)
+	}
+
+	if err != nil {
+		pktline.NewEncoder(w).EncodeString(fmt.Sprintf("ERR %v\n", err))
+	}
+	return err
+}
+
+// lsRefs writes the references that match any of the ref-prefix arguments, or all
+// references when there are none. HEAD is always written first.
+func (up *UploadPack) lsRefs(w io.Writer, cmd *Command) error {
+	var symrefs, peel bool
+	var prefixes []string
+	for _, arg := range cmd.Args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case arg == "unborn": // unborn is not advertised, so there is nothing to show
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		default:
+			return ErrUnexpectedLine.F("ls-refs", arg)
+		}
+	}
+
+	refs, err := up.references()
+	if err != nil {
+		return ErrListRefs.F(err)
+	}
+
+	enc := pktline.NewEncoder(w)
+	for _, ref := range refs {
+		if !hasPrefix(ref.Name().String(), prefixes) {
+			continue
+		}
+
+		target, err := storer.ResolveReference(up.sto, ref.Name())
+		if err == plumbing.ErrReferenceNotFound {
+			continue // unborn
+		}
+		if err != nil {
+			return ErrListRefs.F(err)
+		}
+
+		ln := fmt.Sprintf("%s %s", target.Hash(), ref.Name())
+		if symrefs && ref.Type() == plumbing.SymbolicReference {
+			ln += fmt.Sprintf(" symref-target:%s", ref.Target())
+		}
+		if peel {
+			if tag, err := object.GetTag(up.sto, target.Hash()); err == nil {
+				if peeled, err := peelTag(up.sto, tag); err == nil {
+					ln += fmt.Sprintf(" peeled:%s", peeled)
+				}
+			}
+		}
+
+		if err := enc.EncodeString(ln + "\n"); err != nil {
+			return err
+		}
+	}
+	enc.Flush()
+
+	return nil
+}
+
+// references returns HEAD followed by all of the other references sorted by name
+func (up *UploadPack) references() ([]*plumbing.Reference, error) {
+	iter, err := up.sto.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+
+	head, err := up.sto.Reference(plumbing.HEAD)
+	switch err {
+	case nil:
+		refs = append([]*plumbing.Reference{head}, refs...)
+	case plumbing.ErrReferenceNotFound:
+	default:
+		return nil, err
+	}
+
+	return refs, nil
+}
+
+// fetch negotiates the common commits with the client and sends back a packfile once
+// the client is done, or a common base has been found. The shallow-info section comes
+// before the packfile when the client asked for a shallow history or has one.
+func (up *UploadPack) fetch(w io.Writer, cmd *Command) error {
+	req, err := up.fetchArgs(cmd)
+	if err != nil {
+		return err
+	}
+
+	common := up.common(req.haves)
+
+	enc := pktline.NewEncoder(w)
+	if !req.done {
+		enc.EncodeString("acknowledgments\n")
+		if len(common) == 0 {
+			enc.EncodeString("NAK\n")
+			enc.Flush()
+			return nil // the client needs to send more haves
+		}
+		for _, h := range common {
+			enc.EncodeString(fmt.Sprintf("ACK %s\n", h))
+		}
+		enc.EncodeString("ready\n")
+		enc.Delim()
+	}
+
+	if req.isShallow() {
+		shallow, unshallow, err := up.deepen(req)
+		if err != nil {
+			return err
+		}
+		enc.EncodeString("shallow-info\n")
+		writeShallowInfo(enc, shallow, unshallow)
+		enc.Delim()
+	}
+
+	enc.EncodeString("packfile\n")
+	return up.sendPack(w, req, common) // the packfile is always muxed in protocol v2
+}
+
+// fetchArgs parses the arguments of a fetch command
+func (up *UploadPack) fetchArgs(cmd *Command) (*uploadRequest, error) {
+	req := &uploadRequest{sideband: pktline.Sideband64k}
+	for _, arg := range cmd.Args {
+		kv := strings.SplitN(arg, " ", 2)
+		switch kv[0] {
+		case "want":
+			h, err := up.want(kv)
+			if err != nil {
+				return nil, err
+			}
+			req.wants = append(req.wants, h)
+		case "have":
+			if len(kv) != 2 || !isHash(kv[1]) {
+				return nil, ErrInvalidObjectID.F("fetch", arg)
+			}
+			req.haves = append(req.haves, plumbing.NewHash(kv[1]))
+		case "done":
+			req.done = true
+		case "ofs-delta":
+			req.ofsDelta = true
+		case "include-tag":
+			req.includeTag = true
+		case "no-progress":
+			req.noProgress = true
+		case "thin-pack": // packs are never thin
+		case "filter":
+			f, err := parseFilter(strings.TrimPrefix(arg, "filter "))
+			if err != nil {
+				return nil, err
+			}
+			req.filter = f
+		default:
+			if ok, err := req.shallowArg("fetch", kv); err != nil {
+				return nil, err
+			} else if !ok {
+				return nil, ErrUnexpectedLine.F("fetch", arg)
+			}
+		}
+	}
+	return req, nil
+}